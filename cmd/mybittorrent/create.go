@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/OmBudhiraja/torrent-client/internal/torrentfile"
+)
+
+// stringList is a flag which can be given multiple times
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+func create(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+
+	var announce stringList
+	flags.Var(&announce, "a", "Tracker announce url, can be given multiple times")
+
+	opts := torrentfile.CreateOptions{}
+	flags.StringVar(&opts.Comment, "c", "", "Comment stored in the torrent")
+	flags.StringVar(&opts.CreatedBy, "created-by", "mybittorrent", "Program stored as the creator of the torrent")
+	flags.BoolVar(&opts.Private, "private", false, "Mark the torrent as private")
+	flags.IntVar(&opts.PieceLength, "piece-length", 0, "Piece length in bytes, picked from the content size when 0")
+
+	var outPath string
+	flags.StringVar(&outPath, "o", "", "Path of the torrent file to write, defaults to <name>.torrent")
+
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		fmt.Println("Usage: mybittorrent create [options] <file or directory>")
+		os.Exit(1)
+	}
+
+	opts.Announce = announce
+
+	path := flags.Arg(0)
+
+	data, err := torrentfile.Create(path, opts)
+
+	if err != nil {
+		fmt.Println("Failed to create torrent: " + err.Error())
+		os.Exit(1)
+	}
+
+	if outPath == "" {
+		outPath = filepath.Base(filepath.Clean(path)) + ".torrent"
+	}
+
+	err = os.WriteFile(outPath, data, 0644)
+
+	if err != nil {
+		fmt.Println("Failed to write torrent: " + err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Printf("Created %s\n", outPath)
+}
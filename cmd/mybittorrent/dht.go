@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/dht"
+)
+
+// runDHTNode runs a DHT node without downloading anything, for instance as the bootstrap
+// node of a local swarm
+func runDHTNode(args []string) {
+	flags := flag.NewFlagSet("dht", flag.ExitOnError)
+
+	var config dht.Config
+	flags.IntVar(&config.Port, "port", 6881, "UDP port to listen on, 0 picks a free port")
+	dhtFlags(flags, &config)
+
+	flags.Parse(args)
+
+	defaultDHTState(flags, &config)
+
+	node, err := dht.New(config)
+
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("DHT node listening on udp port %d\n", node.Port())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			node.Close()
+			return
+		case <-ticker.C:
+			fmt.Printf("%d nodes known\n", node.Nodes())
+		}
+	}
+}
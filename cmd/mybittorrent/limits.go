@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
+)
+
+// rateLimits are the rate limits given on the command line in KiB/s, 0 does not limit anything
+type rateLimits struct {
+	download        int
+	upload          int
+	torrentDownload int
+	torrentUpload   int
+}
+
+// limitFlags registers the flags setting the rate limits on a flag set
+func limitFlags(flags *flag.FlagSet, limits *rateLimits) {
+	flags.IntVar(&limits.download, "download-limit", 0, "Maximum download rate of every torrent together in KiB/s, 0 does not limit it")
+	flags.IntVar(&limits.upload, "upload-limit", 0, "Maximum upload rate of every torrent together in KiB/s, 0 does not limit it")
+	flags.IntVar(&limits.torrentDownload, "torrent-download-limit", 0, "Maximum download rate of the torrent in KiB/s, 0 does not limit it")
+	flags.IntVar(&limits.torrentUpload, "torrent-upload-limit", 0, "Maximum upload rate of the torrent in KiB/s, 0 does not limit it")
+}
+
+// limiters are the limiters which can be changed while downloading, by the name of the flag
+// setting them
+type limiters map[string]*ratelimit.Limiter
+
+// newLimiters names the limiters of the config and of the torrent
+func newLimiters(config *p2p.Config, torrentDownload, torrentUpload *ratelimit.Limiter) limiters {
+	return limiters{
+		"download-limit":         config.DownloadLimit,
+		"upload-limit":           config.UploadLimit,
+		"torrent-download-limit": torrentDownload,
+		"torrent-upload-limit":   torrentUpload,
+	}
+}
+
+// control reads commands of the form "<flag name> <KiB/s>" from in, one per line, and changes the
+// rate of the named limiter, until in is closed
+func (l limiters) control(in io.Reader, out io.Writer) {
+	scanner := bufio.NewScanner(in)
+
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+
+		if len(fields) == 0 {
+			continue
+		}
+
+		if err := l.set(fields); err != nil {
+			fmt.Fprintln(out, err.Error())
+			continue
+		}
+
+		fmt.Fprintf(out, "%s set to %s KiB/s\n", fields[0], fields[1])
+	}
+}
+
+// set applies a single command to the limiters
+func (l limiters) set(fields []string) error {
+	limiter, ok := l[strings.TrimLeft(fields[0], "-")]
+
+	if !ok || len(fields) != 2 {
+		return fmt.Errorf("unknown command %q, use <limit name> <KiB/s>", strings.Join(fields, " "))
+	}
+
+	rate, err := strconv.Atoi(fields[1])
+
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid rate %q", fields[1])
+	}
+
+	limiter.SetRate(rate * 1024)
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
+)
+
+func TestLimitersControl(t *testing.T) {
+	download := ratelimit.New(0)
+	upload := ratelimit.New(1024)
+
+	l := limiters{"download-limit": download, "torrent-upload-limit": upload}
+
+	in := strings.NewReader("download-limit 100\n\n-torrent-upload-limit 0\nupload-limit 5\ndownload-limit fast\n")
+
+	var out bytes.Buffer
+
+	l.control(in, &out)
+
+	if rate := download.Rate(); rate != 100*1024 {
+		t.Fatalf("download rate = %d", rate)
+	}
+
+	if rate := upload.Rate(); rate != 0 {
+		t.Fatalf("upload rate = %d", rate)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+
+	if len(lines) != 4 || !strings.Contains(lines[2], "unknown") || !strings.Contains(lines[3], "invalid") {
+		t.Fatalf("unexpected output:\n%s", out.String())
+	}
+}
@@ -1,22 +1,54 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
 	"time"
 
+	"github.com/OmBudhiraja/torrent-client/internal/dht"
+	"github.com/OmBudhiraja/torrent-client/internal/lsd"
 	"github.com/OmBudhiraja/torrent-client/internal/magnetlink"
+	"github.com/OmBudhiraja/torrent-client/internal/mse"
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
 	"github.com/OmBudhiraja/torrent-client/internal/torrentfile"
+	"github.com/OmBudhiraja/torrent-client/internal/utp"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
 )
 
 type Downloader interface {
-	Download(outFile string) error
+	Download(ctx context.Context, outFile string) error
 }
 
 func main() {
 
-	downloader, err := getDownloader()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			verify(os.Args[2:])
+			return
+		case "create":
+			create(os.Args[2:])
+			return
+		case "scrape":
+			scrape(os.Args[2:])
+			return
+		case "dht":
+			runDHTNode(os.Args[2:])
+			return
+		}
+	}
+
+	download()
+}
+
+func download() {
+	downloader, config, limits, err := getDownloader()
 
 	if err != nil {
 		fmt.Println(err)
@@ -33,7 +65,21 @@ func main() {
 		outPath = flag.Args()[1]
 	}
 
-	err = downloader.Download(outPath)
+	// stop gracefully on Ctrl-C so that the download can be resumed later
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// the rate limits can be changed by typing their flag name and new value while downloading
+	go limits.control(os.Stdin, os.Stdout)
+
+	err = downloader.Download(ctx, outPath)
+
+	config.Close()
+
+	if errors.Is(err, context.Canceled) {
+		fmt.Println("Download interrupted, run the same command again to resume it")
+		os.Exit(1)
+	}
 
 	if err != nil {
 		fmt.Println("Failed to download file: " + err.Error())
@@ -44,41 +90,180 @@ func main() {
 
 }
 
-func getDownloader() (Downloader, error) {
-	peerId := []byte("00112233445566778899")
+func getDownloader() (Downloader, *p2p.Config, limiters, error) {
+	peerId := newPeerId()
 
 	var useMagnetLink bool
 	flag.BoolVar(&useMagnetLink, "m", false, "Use magnet link instead of torrent file")
 
+	config := &p2p.Config{PeerId: peerId}
+	flag.Float64Var(&config.SeedRatio, "seed-ratio", 0, "Keep seeding after the download until this upload ratio is reached")
+	flag.DurationVar(&config.SeedTime, "seed-time", 0, "Keep seeding after the download for at most this long")
+	flag.IntVar(&config.Port, "port", 6881, "Port to accept incoming peer connections on, 0 picks a free port")
+	flag.IntVar(&config.MaxPeers, "max-peers", 50, "Maximum number of peers connected at the same time")
+	flag.DurationVar(&config.StallTimeout, "stall-timeout", 5*time.Minute, "Give up when no data arrives for this long, 0 waits forever")
+	flag.BoolVar(&config.IsolateCorrupt, "isolate-corrupt", true, "Download pieces which failed their hash check again from other peers than the ones which sent them")
+	flag.IntVar(&config.UploadSlots, "upload-slots", 4, "Number of peers to upload to at the same time, besides one picked at random")
+
+	var limits rateLimits
+	limitFlags(flag.CommandLine, &limits)
+
+	config.Encryption = mse.Prefer
+	flag.Var(&config.Encryption, "encryption", "Peer connection encryption: disabled, prefer or require")
+
+	var files p2p.FileSelection
+	flag.Var(&files, "files", "Comma separated indices, ranges such as 2-5 and glob patterns of the files to download, all of them by default")
+
+	var sequential bool
+	flag.BoolVar(&sequential, "sequential", false, "Download the pieces in order, so that the beginning of the files can be used first")
+
+	var highFiles, lowFiles p2p.FileSelection
+	flag.Var(&highFiles, "high", "Files to download first, in the same format as -files")
+	flag.Var(&lowFiles, "low", "Files to download last, in the same format as -files")
+
+	var useUTP bool
+	flag.BoolVar(&useUTP, "utp", true, "Connect to and accept peers over uTP, falling back to tcp")
+
+	var useDHT bool
+	var dhtConfig dht.Config
+	flag.BoolVar(&useDHT, "dht", true, "Find peers on the DHT, private torrents never use it")
+	dhtFlags(flag.CommandLine, &dhtConfig)
+
+	var useLSD bool
+	flag.BoolVar(&useLSD, "lsd", true, "Find peers on the local network, private torrents never use it")
+
 	flag.Parse()
 
 	opts := flag.Args()
 
-	if len(opts) == 0 {
-		fmt.Println("Usage: mybittorrent <torrent filepath> <output path>")
-		os.Exit(1)
+	if len(opts) == 0 || (!useMagnetLink && len(os.Args) < 3) {
+		return nil, nil, nil, fmt.Errorf("Usage: mybittorrent <torrent filepath> <output path>")
 	}
 
-	if useMagnetLink {
-		mg, err := magnetlink.New(opts[0], peerId)
+	if files.String() != "" {
+		config.Files = &files
+	}
+
+	// the limiters are created even without a limit, so that one can be set while downloading
+	config.DownloadLimit = ratelimit.New(limits.download * 1024)
+	config.UploadLimit = ratelimit.New(limits.upload * 1024)
+
+	if sequential || highFiles.String() != "" || lowFiles.String() != "" {
+		config.Priorities = p2p.NewPriorities()
+		config.Priorities.SetSequential(sequential)
+
+		if lowFiles.String() != "" {
+			config.Priorities.SetFiles(&lowFiles, p2p.PriorityLow)
+		}
+
+		if highFiles.String() != "" {
+			config.Priorities.SetFiles(&highFiles, p2p.PriorityHigh)
+		}
+	}
+
+	listener, err := p2p.Listen(config.Port, peerId, config.Encryption)
+
+	if err != nil {
+		fmt.Printf("Not accepting incoming peers: %s\n", err.Error())
+	} else {
+		config.Listener = listener
+		config.Port = listener.Port()
+	}
+
+	if useUTP {
+		socket, err := utp.Listen(config.Port)
 
 		if err != nil {
-			return nil, fmt.Errorf("failed to parse magnet link: %s", err.Error())
+			fmt.Printf("Not using uTP: %s\n", err.Error())
+		} else {
+			config.UTP = socket
+
+			if config.Listener != nil {
+				config.Listener.Serve(socket)
+			}
 		}
+	}
+
+	// the dht and local service discovery are started once the torrent is known not to be private
+	if useDHT {
+		config.StartDHT = func() (*dht.DHT, error) {
+			// the dht shares the port number of the listener, over udp
+			dhtConfig.Port = config.Port
+			defaultDHTState(flag.CommandLine, &dhtConfig)
+
+			// and the socket itself if utp uses it already
+			if config.UTP != nil {
+				dhtConfig.Conn = config.UTP.PacketConn()
+			}
 
-		return mg, nil
+			return dht.New(dhtConfig)
+		}
 	}
 
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: mybittorrent <torrent filepath> <output path>")
-		os.Exit(1)
+	if useLSD {
+		config.StartLSD = lsd.New
 	}
 
-	tf, err := torrentfile.New(opts[0], peerId)
+	if useMagnetLink {
+		mg, err := magnetlink.New(opts[0], config)
+
+		if err != nil {
+			config.Close()
+			return nil, nil, nil, fmt.Errorf("failed to parse magnet link: %s", err.Error())
+		}
+
+		mg.DownloadLimit.SetRate(limits.torrentDownload * 1024)
+		mg.UploadLimit.SetRate(limits.torrentUpload * 1024)
+
+		return mg, config, newLimiters(config, mg.DownloadLimit, mg.UploadLimit), nil
+	}
+
+	tf, err := torrentfile.New(opts[0], config)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse torrent file: %s", err.Error())
+		config.Close()
+		return nil, nil, nil, fmt.Errorf("failed to parse torrent file: %s", err.Error())
 	}
 
-	return tf, nil
+	tf.DownloadLimit.SetRate(limits.torrentDownload * 1024)
+	tf.UploadLimit.SetRate(limits.torrentUpload * 1024)
+
+	return tf, config, newLimiters(config, tf.DownloadLimit, tf.UploadLimit), nil
+}
+
+// newPeerId returns a random peer id in the usual format, a client tag followed by random bytes,
+// so that peers can tell our instances apart
+func newPeerId() []byte {
+	peerId := make([]byte, 20)
+	copy(peerId, "-MB0001-")
+	rand.Read(peerId[8:])
+
+	return peerId
+}
+
+// dhtFlags registers the flags configuring the dht node on a flag set
+func dhtFlags(flags *flag.FlagSet, config *dht.Config) {
+	flags.Func("dht-bootstrap", "Comma separated host:port list of the nodes used to join the DHT", func(value string) error {
+		config.Bootstrap = strings.Split(value, ",")
+		return nil
+	})
+	flags.StringVar(&config.StatePath, "dht-state", "", "File where the DHT node id and known nodes are kept between runs, a file per port in the user cache directory by default")
+
+	config.Bootstrap = dht.DefaultBootstrapNodes
+}
+
+// defaultDHTState keeps the state of the dht node in the default file of its port, unless
+// -dht-state was given, an empty one disabling the state
+func defaultDHTState(flags *flag.FlagSet, config *dht.Config) {
+	given := false
+
+	flags.Visit(func(f *flag.Flag) {
+		if f.Name == "dht-state" {
+			given = true
+		}
+	})
+
+	if !given {
+		config.StatePath = dht.DefaultStatePath(config.Port)
+	}
 }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/OmBudhiraja/torrent-client/internal/magnetlink"
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+	"github.com/OmBudhiraja/torrent-client/internal/torrentfile"
+	"github.com/OmBudhiraja/torrent-client/internal/tracker"
+)
+
+func scrape(args []string) {
+	flags := flag.NewFlagSet("scrape", flag.ExitOnError)
+
+	var useMagnetLink bool
+	flags.BoolVar(&useMagnetLink, "m", false, "Use magnet link instead of torrent file")
+
+	flags.Parse(args)
+
+	if flags.NArg() < 1 {
+		fmt.Println("Usage: mybittorrent scrape [-m] <torrent filepath or magnet link>")
+		os.Exit(1)
+	}
+
+	var results []tracker.ScrapeResult
+	var err error
+
+	if useMagnetLink {
+		results, err = magnetlink.Scrape(flags.Arg(0))
+	} else {
+		var tf *torrentfile.TorrentFile
+
+		tf, err = torrentfile.New(flags.Arg(0), &p2p.Config{})
+
+		if err == nil {
+			results, err = tf.Scrape()
+		}
+	}
+
+	if err != nil {
+		fmt.Println("Failed to scrape: " + err.Error())
+		os.Exit(1)
+	}
+
+	failed := 0
+
+	for _, result := range results {
+		if result.Err != nil {
+			failed++
+			fmt.Printf("%s\n  error: %s\n", result.Tracker, result.Err.Error())
+			continue
+		}
+
+		fmt.Printf("%s\n  complete: %d  incomplete: %d  downloaded: %d\n", result.Tracker, result.Resp.Complete, result.Resp.Incomplete, result.Resp.Downloaded)
+	}
+
+	if failed == len(results) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+	"github.com/OmBudhiraja/torrent-client/internal/torrentfile"
+)
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+
+	if flags.NArg() < 2 {
+		fmt.Println("Usage: mybittorrent verify <torrent filepath> <path>")
+		os.Exit(1)
+	}
+
+	tf, err := torrentfile.New(flags.Arg(0), &p2p.Config{})
+
+	if err != nil {
+		fmt.Println("failed to parse torrent file: " + err.Error())
+		os.Exit(1)
+	}
+
+	result, err := tf.Verify(flags.Arg(1))
+
+	if err != nil {
+		fmt.Println("Failed to verify data: " + err.Error())
+		os.Exit(1)
+	}
+
+	for _, file := range result.Files {
+		percent := 100.0
+
+		if file.Length > 0 {
+			percent = float64(file.Verified) / float64(file.Length) * 100
+		}
+
+		fmt.Printf("%7.2f%%  %s\n", percent, file.Path)
+	}
+
+	fmt.Printf("\nVerified %d/%d pieces\n", result.Verified, result.Pieces)
+	fmt.Printf("Bitfield: %s\n", hex.EncodeToString(result.Bitfield))
+
+	if result.ResumeFile != "" {
+		fmt.Printf("Resume state saved to %s\n", result.ResumeFile)
+	}
+
+	if result.Verified != result.Pieces {
+		os.Exit(2)
+	}
+}
@@ -35,3 +35,14 @@ func (bf Bitfield) SetPiece(index int) {
 	}
 	bf[byteIndex] |= 1 << uint(7-offset)
 }
+
+// ClearPiece unsets a bit in the bitfield
+func (bf Bitfield) ClearPiece(index int) {
+	byteIndex := index / 8
+	offset := index % 8
+
+	if byteIndex < 0 || byteIndex >= len(bf) {
+		return
+	}
+	bf[byteIndex] &^= 1 << uint(7-offset)
+}
@@ -1,8 +1,10 @@
 package client
 
 import (
-	"encoding/binary"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
 	"github.com/OmBudhiraja/torrent-client/internal/extensions"
@@ -10,41 +12,135 @@ import (
 	"github.com/OmBudhiraja/torrent-client/internal/peer"
 )
 
+// peers send a keep alive at least every two minutes, a peer which sends nothing for longer is gone
+const readTimeout = 3 * time.Minute
+
 type Client struct {
 	Conn                      net.Conn
-	Choked                    bool
-	BitField                  bitfield.Bitfield
 	Peer                      peer.Peer
 	InfoHash                  [20]byte
 	PeerId                    []byte
-	SupportedExtension        map[string]int
-	MetadataSize              int
 	SupportsExtensionProtocol bool
+	// SupportsFastExtension tells if both sides support the fast extension messages
+	SupportsFastExtension bool
+	// Inbound tells if the peer connected to us, its address then uses a port it does not listen on
+	Inbound bool
+	// Downloaded and Uploaded count the bytes of the blocks received from and sent to the peer
+	Downloaded atomic.Int64
+	Uploaded   atomic.Int64
+
+	// requestQueue is the reqq of the peer from its extension handshake, 0 if it did not tell
+	requestQueue atomic.Int32
+
+	// the choker changes whether we choke the peer while its worker serves its requests
+	amChoking      atomic.Bool
+	peerInterested atomic.Bool
+
+	// what the peer tells us is recorded by ParsePeerMessage while its worker reads it
+	choked             atomic.Bool
+	haveAll            atomic.Bool
+	stateMu            sync.Mutex
+	bitField           bitfield.Bitfield
+	supportedExtension map[string]int
+	metadataSize       int
+	listenPort         int
+
+	writeMu sync.Mutex
 }
 
-func New(peer peer.Peer, infoHash [20]byte, peerId []byte, totalPieces int) (*Client, error) {
-	handshakeRes, err := peer.CompleteHandshake(infoHash[:], peerId)
+// New connects to a peer and completes the handshakes, private torrents do not offer peer exchange
+func New(p peer.Peer, infoHash [20]byte, peerId []byte, dialer peer.Dialer, listenPort int, private bool, totalPieces int) (*Client, error) {
+	handshakeRes, err := p.CompleteHandshake(infoHash[:], peerId, dialer)
 
 	if err != nil {
 		return nil, err
 	}
 
+	return NewFromHandshake(p, handshakeRes, peerId, listenPort, private, totalPieces), nil
+}
+
+// NewFromHandshake creates a client for a connection on which the handshake has already been completed,
+// listenPort is the port we accept connections on, 0 if we do not
+func NewFromHandshake(peer peer.Peer, handshakeRes *peer.HandshakeResponse, peerId []byte, listenPort int, private bool, totalPieces int) *Client {
 	if handshakeRes.SupportsExtensionProtocol {
-		extensions.SendHandshakeMessage(handshakeRes.Conn)
+		extensions.SendHandshakeMessage(handshakeRes.Conn, listenPort, private)
 	}
 
 	client := &Client{
 		Conn:                      handshakeRes.Conn,
-		Choked:                    true,
 		Peer:                      peer,
 		PeerId:                    peerId,
-		InfoHash:                  infoHash,
-		BitField:                  bitfield.New(totalPieces),
+		InfoHash:                  handshakeRes.InfoHash,
+		bitField:                  bitfield.New(totalPieces),
 		SupportsExtensionProtocol: handshakeRes.SupportsExtensionProtocol,
+		SupportsFastExtension:     handshakeRes.SupportsFastExtension,
 	}
 
-	return client, nil
+	client.amChoking.Store(true)
+	client.choked.Store(true)
+
+	return client
+}
+
+// Choked tells if the peer refuses to upload to us
+func (c *Client) Choked() bool {
+	return c.choked.Load()
+}
+
+// HaveAll tells if the peer sent have all, for when the number of pieces is not known yet
+func (c *Client) HaveAll() bool {
+	return c.haveAll.Load()
+}
+
+// BitField returns a copy of the pieces the peer told us about
+func (c *Client) BitField() bitfield.Bitfield {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	bf := make(bitfield.Bitfield, len(c.bitField))
+	copy(bf, c.bitField)
+
+	return bf
+}
+
+// ExtensionId returns the id the peer gave to an extension in its extension handshake, 0 if it
+// does not support it
+func (c *Client) ExtensionId(name string) int {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.supportedExtension[name]
+}
+
+// MetadataSize returns the size of the info dictionary, if the peer told us in the extension handshake
+func (c *Client) MetadataSize() int {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.metadataSize
+}
+
+// ListenPort returns the port the peer accepts connections on, if it told us in the extension handshake
+func (c *Client) ListenPort() int {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	return c.listenPort
+}
+
+// AmChoking tells if we refuse to upload to the peer
+func (c *Client) AmChoking() bool {
+	return c.amChoking.Load()
+}
+
+// RequestQueue returns the number of outstanding requests the peer queues, 0 if it did not tell
+func (c *Client) RequestQueue() int {
+	return int(c.requestQueue.Load())
+}
 
+// PeerInterested tells if the peer wants pieces we have
+func (c *Client) PeerInterested() bool {
+	return c.peerInterested.Load()
 }
 
 type MessageResult struct {
@@ -60,12 +156,12 @@ func (c *Client) ParsePeerMessage(messageResultChan chan *MessageResult, closeCh
 		case <-closeChan:
 			return
 		default:
+			c.Conn.SetReadDeadline(time.Now().Add(readTimeout))
+
 			msg, err := message.Read(c.Conn)
 
 			if err != nil {
-				messageResultChan <- &MessageResult{
-					Err: err,
-				}
+				deliverMessage(messageResultChan, closeChan, &MessageResult{Err: err})
 				return
 			}
 
@@ -81,54 +177,131 @@ func (c *Client) ParsePeerMessage(messageResultChan chan *MessageResult, closeCh
 
 			switch msg.ID {
 			case message.UnchokeMessageID:
-				c.Choked = false
+				c.choked.Store(false)
 			case message.ChokeMessageID:
-				c.Choked = true
+				c.choked.Store(true)
+			case message.InterestedMessageID:
+				c.peerInterested.Store(true)
+			case message.NotInterestedMessageID:
+				c.peerInterested.Store(false)
 			case message.HaveMessageID:
-				index := int(binary.BigEndian.Uint32(msg.Payload))
-				c.BitField.SetPiece(index)
+				index, err := message.ParseHavePayload(msg.Payload)
+
+				if err != nil {
+					deliverMessage(messageResultChan, closeChan, &MessageResult{Err: err})
+					return
+				}
+
+				c.stateMu.Lock()
+				c.bitField.SetPiece(index)
+				c.stateMu.Unlock()
 			case message.BitfieldMessageID:
-				c.BitField = msg.Payload
+				c.stateMu.Lock()
+				c.bitField = msg.Payload
+				c.stateMu.Unlock()
+			case message.HaveAllMessageID:
+				c.haveAll.Store(true)
+				c.setAll(0xff)
+			case message.HaveNoneMessageID:
+				c.haveAll.Store(false)
+				c.setAll(0)
 			case message.ExtensionMessageId:
 				res, err := extensions.ParseHandshakeMessage(msg.Payload)
 
 				if err != nil {
-					messageResultChan <- &MessageResult{
-						Err: err,
-					}
+					deliverMessage(messageResultChan, closeChan, &MessageResult{Err: err})
 					return
 				}
 
 				if res != nil {
-					c.MetadataSize = res.MetadataSize
-					c.SupportedExtension = res.M
+					c.stateMu.Lock()
+					c.metadataSize = res.MetadataSize
+					c.supportedExtension = res.M
+					c.listenPort = res.P
+					c.stateMu.Unlock()
+
+					c.requestQueue.Store(int32(res.Reqq))
 				}
 
 			case message.PieceMessageID:
 				//
+			case message.RequestMessageID:
+				// requests are answered by the worker as it owns the downloaded data
 			}
 
-			messageResultChan <- &result
+			deliverMessage(messageResultChan, closeChan, &result)
 		}
 	}
 }
 
+// setAll sets every byte of the bitfield of the peer to b
+func (c *Client) setAll(b byte) {
+	c.stateMu.Lock()
+	defer c.stateMu.Unlock()
+
+	for i := range c.bitField {
+		c.bitField[i] = b
+	}
+}
+
+// deliverMessage hands a message to the consumer unless the connection is being closed,
+// so that the reader does not block forever on a consumer which has already gone away
+func deliverMessage(messageResultChan chan *MessageResult, closeChan chan struct{}, result *MessageResult) {
+	select {
+	case messageResultChan <- result:
+	case <-closeChan:
+	}
+}
+
+// send writes a single message to the peer, serializing writes coming from multiple goroutines
+func (c *Client) send(msg *message.Message) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.Conn.Write(msg.Encode())
+
+	return err
+}
+
+// SendRawMsg writes an already encoded message to the peer, such as an extension message
+func (c *Client) SendRawMsg(msg []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	_, err := c.Conn.Write(msg)
+
+	return err
+}
+
+// SendKeepAliveMsg keeps the connection open while we have nothing else to send
+func (c *Client) SendKeepAliveMsg() error {
+	return c.send(nil)
+}
+
 func (c *Client) SendInterestedMsg() error {
 	msg := message.Message{
 		ID: message.InterestedMessageID,
 	}
-	_, err := c.Conn.Write(msg.Encode())
 
-	return err
+	return c.send(&msg)
+}
+
+func (c *Client) SendChokeMsg() error {
+	msg := message.Message{
+		ID: message.ChokeMessageID,
+	}
+	c.amChoking.Store(true)
+
+	return c.send(&msg)
 }
 
 func (c *Client) SendUnchokeMsg() error {
 	msg := message.Message{
 		ID: message.UnchokeMessageID,
 	}
-	_, err := c.Conn.Write(msg.Encode())
+	c.amChoking.Store(false)
 
-	return err
+	return c.send(&msg)
 }
 
 func (c *Client) SendRequestMsg(index, begin, length int) error {
@@ -136,9 +309,17 @@ func (c *Client) SendRequestMsg(index, begin, length int) error {
 		ID:      message.RequestMessageID,
 		Payload: message.FormatRequestPayload(index, begin, length),
 	}
-	_, err := c.Conn.Write(msg.Encode())
 
-	return err
+	return c.send(&msg)
+}
+
+func (c *Client) SendCancelMsg(index, begin, length int) error {
+	msg := message.Message{
+		ID:      message.CancelMessageID,
+		Payload: message.FormatRequestPayload(index, begin, length),
+	}
+
+	return c.send(&msg)
 }
 
 func (c *Client) SendHaveMsg(index int) error {
@@ -146,7 +327,49 @@ func (c *Client) SendHaveMsg(index int) error {
 		ID:      message.HaveMessageID,
 		Payload: message.FormatHavePayload(index),
 	}
-	_, err := c.Conn.Write(msg.Encode())
 
-	return err
+	return c.send(&msg)
+}
+
+func (c *Client) SendBitfieldMsg(bf bitfield.Bitfield) error {
+	msg := message.Message{
+		ID:      message.BitfieldMessageID,
+		Payload: bf,
+	}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendHaveAllMsg() error {
+	msg := message.Message{
+		ID: message.HaveAllMessageID,
+	}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendHaveNoneMsg() error {
+	msg := message.Message{
+		ID: message.HaveNoneMessageID,
+	}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendRejectRequestMsg(index, begin, length int) error {
+	msg := message.Message{
+		ID:      message.RejectRequestMessageID,
+		Payload: message.FormatRequestPayload(index, begin, length),
+	}
+
+	return c.send(&msg)
+}
+
+func (c *Client) SendPieceMsg(index, begin int, block []byte) error {
+	msg := message.Message{
+		ID:      message.PieceMessageID,
+		Payload: message.FormatPiecePayload(index, begin, block),
+	}
+
+	return c.send(&msg)
 }
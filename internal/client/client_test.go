@@ -0,0 +1,105 @@
+package client
+
+import (
+	"net"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/extensions"
+	"github.com/OmBudhiraja/torrent-client/internal/message"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+func TestParsePeerMessageState(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := NewFromHandshake(peer.Peer{Address: "127.0.0.1:6881"}, &peer.HandshakeResponse{Conn: conn}, nil, 0, false, 16)
+
+	if !c.Choked() {
+		t.Fatal("peer not choking us to begin with")
+	}
+
+	messages := make(chan *MessageResult)
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+
+	go c.ParsePeerMessage(messages, closeChan)
+
+	sent := []*message.Message{
+		{ID: message.UnchokeMessageID},
+		{ID: message.HaveMessageID, Payload: message.FormatHavePayload(3)},
+		{ID: message.HaveAllMessageID},
+		{ID: message.HaveNoneMessageID},
+		{ID: message.HaveMessageID, Payload: message.FormatHavePayload(9)},
+	}
+
+	// each message is sent once the previous one was checked, so that the state is not changed
+	// by the next message before
+	next := make(chan struct{})
+
+	go func() {
+		for _, msg := range sent {
+			other.Write(msg.Encode())
+			<-next
+		}
+
+		extensions.SendHandshakeMessage(other, 7000, false)
+	}()
+
+	for i := 0; i < len(sent)+1; i++ {
+		// the state is read by the worker while the next messages are parsed
+		c.Choked()
+		c.HaveAll()
+		c.BitField()
+		c.ExtensionId("ut_pex")
+
+		msg := <-messages
+
+		if msg.Err != nil {
+			t.Fatal(msg.Err)
+		}
+
+		if msg.Id == message.HaveAllMessageID && !c.HaveAll() {
+			t.Fatal("have all not recorded")
+		}
+
+		if i < len(sent) {
+			next <- struct{}{}
+		}
+	}
+
+	if c.Choked() || c.HaveAll() {
+		t.Fatal("unchoke or have none not recorded")
+	}
+
+	bf := c.BitField()
+
+	if bf.HasPiece(3) || !bf.HasPiece(9) {
+		t.Fatalf("bitfield %08b, want only piece 9", bf)
+	}
+
+	if c.ListenPort() != 7000 || c.ExtensionId("ut_pex") == 0 {
+		t.Fatalf("extension handshake not recorded: port %d", c.ListenPort())
+	}
+}
+
+func TestParsePeerMessageInvalidHave(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := NewFromHandshake(peer.Peer{Address: "127.0.0.1:6881"}, &peer.HandshakeResponse{Conn: conn}, nil, 0, false, 16)
+
+	messages := make(chan *MessageResult)
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+
+	go c.ParsePeerMessage(messages, closeChan)
+
+	go other.Write((&message.Message{ID: message.HaveMessageID, Payload: []byte{1}}).Encode())
+
+	if msg := <-messages; msg.Err == nil {
+		t.Fatal("have message with a short payload accepted")
+	}
+}
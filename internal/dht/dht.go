@@ -0,0 +1,472 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	queryTimeout = 5 * time.Second
+	// tokens handed out in get_peers replies are accepted for two secret rotations
+	secretRotateInterval = 5 * time.Minute
+	// peers announced to us are forgotten if they do not announce again
+	peerExpiry = 30 * time.Minute
+	// limits on the announced peers kept in memory
+	maxPeersPerTorrent = 200
+	maxTorrents        = 1000
+	// maximum number of peers returned in a single get_peers reply
+	maxPeersPerReply = 50
+	// how often the buckets are checked for refreshing and the node state is saved
+	maintenanceInterval = 5 * time.Minute
+)
+
+// DefaultBootstrapNodes are well known nodes used to join the DHT when no other node is known
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// Config holds the settings of a DHT node
+type Config struct {
+	// Port is the udp port the node listens on, 0 picks a free port
+	Port int
+	// StatePath is where the node id and the known nodes are kept between runs, empty disables it
+	StatePath string
+	// Bootstrap are the host:port addresses of the nodes used to join the DHT
+	Bootstrap []string
+	// Conn is an already open socket to share, such as the one of uTP, Port is ignored then
+	Conn net.PacketConn
+}
+
+type pendingQuery struct {
+	addr  *net.UDPAddr
+	reply chan *krpcMessage
+}
+
+// DHT is a node of the mainline DHT described in BEP 5. It answers the queries of other nodes
+// and finds the peers of torrents without the help of a tracker.
+type DHT struct {
+	conn   net.PacketConn
+	self   nodeId
+	table  *routingTable
+	config Config
+
+	// ready is closed once the node has tried to join the DHT
+	ready  chan struct{}
+	closed chan struct{}
+
+	mu            sync.Mutex
+	pending       map[string]*pendingQuery
+	transactionId uint16
+	secrets       [2][]byte
+	secretChanged time.Time
+	peers         map[[20]byte]map[string]time.Time
+}
+
+// New starts a DHT node and joins the DHT in the background using the nodes saved by a
+// previous run and the bootstrap nodes
+func New(config Config) (*DHT, error) {
+	state := loadState(config.StatePath)
+
+	self := randomNodeId()
+
+	if state != nil && len(state.Id) == len(self) {
+		copy(self[:], state.Id)
+	}
+
+	conn := config.Conn
+
+	if conn == nil {
+		udpConn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: config.Port})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen for dht nodes: %s", err.Error())
+		}
+
+		conn = udpConn
+	}
+
+	d := &DHT{
+		conn:          conn,
+		self:          self,
+		table:         newRoutingTable(self),
+		config:        config,
+		ready:         make(chan struct{}),
+		closed:        make(chan struct{}),
+		pending:       make(map[string]*pendingQuery),
+		secrets:       [2][]byte{newSecret(), newSecret()},
+		secretChanged: time.Now(),
+		peers:         make(map[[20]byte]map[string]time.Time),
+	}
+
+	var cached []*node
+
+	if state != nil {
+		cached, _ = decodeNodes(state.Nodes)
+	}
+
+	go d.serve()
+
+	go func() {
+		d.bootstrap(cached)
+		close(d.ready)
+		d.maintain()
+	}()
+
+	return d, nil
+}
+
+// Port returns the udp port the node is listening on
+func (d *DHT) Port() int {
+	return d.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// Nodes returns the number of nodes in the routing table
+func (d *DHT) Nodes() int {
+	return d.table.len()
+}
+
+// Close saves the known nodes and stops the node
+func (d *DHT) Close() error {
+	select {
+	case <-d.closed:
+		return nil
+	default:
+	}
+
+	close(d.closed)
+
+	// best effort, the node joins through the bootstrap nodes if the state is lost
+	d.saveState()
+
+	return d.conn.Close()
+}
+
+func (d *DHT) serve() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, from, err := d.conn.ReadFrom(buf)
+
+		if err != nil {
+			select {
+			case <-d.closed:
+				return
+			default:
+			}
+
+			continue
+		}
+
+		addr, ok := from.(*net.UDPAddr)
+
+		if !ok {
+			continue
+		}
+
+		msg, err := decodeMessage(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case krpcQuery:
+			d.handleQuery(msg, addr)
+		case krpcResponse, krpcError:
+			d.handleReply(msg, addr)
+		}
+	}
+}
+
+func (d *DHT) handleReply(msg *krpcMessage, addr *net.UDPAddr) {
+	d.mu.Lock()
+	query, ok := d.pending[msg.T]
+
+	// replies are only accepted from the node that was queried
+	if ok && query.addr.IP.Equal(addr.IP) && query.addr.Port == addr.Port {
+		delete(d.pending, msg.T)
+	} else {
+		ok = false
+	}
+	d.mu.Unlock()
+
+	if ok {
+		query.reply <- msg
+	}
+}
+
+func (d *DHT) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	if msg.A == nil || len(msg.A.Id) != len(d.self) {
+		d.send(errorMessage(msg.T, errorProtocol, "invalid node id"), addr)
+		return
+	}
+
+	var id nodeId
+	copy(id[:], msg.A.Id)
+
+	d.table.seen(id, addr)
+
+	reply := &krpcReturn{Id: string(d.self[:])}
+
+	switch msg.Q {
+	case pingMethod:
+
+	case findNodeMethod:
+		if len(msg.A.Target) != len(d.self) {
+			d.send(errorMessage(msg.T, errorProtocol, "invalid target"), addr)
+			return
+		}
+
+		var target nodeId
+		copy(target[:], msg.A.Target)
+
+		reply.Nodes = encodeNodes(d.table.closest(target, bucketSize))
+
+	case getPeersMethod:
+		if len(msg.A.InfoHash) != len(d.self) {
+			d.send(errorMessage(msg.T, errorProtocol, "invalid info hash"), addr)
+			return
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+
+		reply.Token = d.token(addr, 0)
+		reply.Values = d.storedPeers(infoHash)
+
+		if len(reply.Values) == 0 {
+			reply.Nodes = encodeNodes(d.table.closest(nodeId(infoHash), bucketSize))
+		}
+
+	case announcePeerMethod:
+		if len(msg.A.InfoHash) != len(d.self) {
+			d.send(errorMessage(msg.T, errorProtocol, "invalid info hash"), addr)
+			return
+		}
+
+		if !d.validToken(msg.A.Token, addr) {
+			d.send(errorMessage(msg.T, errorProtocol, "invalid token"), addr)
+			return
+		}
+
+		port := msg.A.Port
+
+		// the peer asks to use the source port of the query, for peers behind a NAT
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+
+		if !d.storePeer(infoHash, addr.IP, port) {
+			d.send(errorMessage(msg.T, errorProtocol, "invalid port"), addr)
+			return
+		}
+
+	default:
+		d.send(errorMessage(msg.T, errorMethodUnknown, "method unknown"), addr)
+		return
+	}
+
+	d.send(&krpcMessage{T: msg.T, Y: krpcResponse, R: reply}, addr)
+}
+
+func (d *DHT) send(msg *krpcMessage, addr *net.UDPAddr) error {
+	data, err := bencode.EncodeBytes(msg)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = d.conn.WriteTo(data, addr)
+
+	return err
+}
+
+// query sends a query to a node and waits for its reply. The node is added to the routing
+// table when it answers.
+func (d *DHT) query(addr *net.UDPAddr, method string, args *krpcArgs) (*krpcReturn, error) {
+	args.Id = string(d.self[:])
+
+	reply := make(chan *krpcMessage, 1)
+
+	d.mu.Lock()
+	d.transactionId++
+	transactionId := string(binary.BigEndian.AppendUint16(nil, d.transactionId))
+	d.pending[transactionId] = &pendingQuery{addr: addr, reply: reply}
+	d.mu.Unlock()
+
+	defer func() {
+		d.mu.Lock()
+		delete(d.pending, transactionId)
+		d.mu.Unlock()
+	}()
+
+	err := d.send(&krpcMessage{T: transactionId, Y: krpcQuery, Q: method, A: args}, addr)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to send %s query: %s", method, err.Error())
+	}
+
+	timeout := time.NewTimer(queryTimeout)
+	defer timeout.Stop()
+
+	var msg *krpcMessage
+
+	select {
+	case msg = <-reply:
+	case <-timeout.C:
+		return nil, fmt.Errorf("dht node %s did not respond", addr)
+	case <-d.closed:
+		return nil, fmt.Errorf("dht node closed")
+	}
+
+	if msg.Y == krpcError {
+		return nil, krpcErr(msg.E)
+	}
+
+	if msg.R == nil || len(msg.R.Id) != len(d.self) {
+		return nil, fmt.Errorf("dht node %s sent an invalid reply", addr)
+	}
+
+	var id nodeId
+	copy(id[:], msg.R.Id)
+
+	d.table.seen(id, addr)
+
+	return msg.R, nil
+}
+
+func newSecret() []byte {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return secret
+}
+
+// token returns the token handed to a node with the current secret, or with the previous one
+func (d *DHT) token(addr *net.UDPAddr, secret int) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if time.Since(d.secretChanged) > secretRotateInterval {
+		d.secrets[0], d.secrets[1] = newSecret(), d.secrets[0]
+		d.secretChanged = time.Now()
+	}
+
+	hash := sha1.New()
+	hash.Write(d.secrets[secret])
+	hash.Write(addr.IP.To16())
+
+	return string(hash.Sum(nil)[:8])
+}
+
+func (d *DHT) validToken(token string, addr *net.UDPAddr) bool {
+	return token != "" && (token == d.token(addr, 0) || token == d.token(addr, 1))
+}
+
+// storePeer records a peer which announced that it is downloading a torrent
+func (d *DHT) storePeer(infoHash [20]byte, ip net.IP, port int) bool {
+	compact, ok := encodePeer(ip, port)
+
+	if !ok {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	peers, ok := d.peers[infoHash]
+
+	if !ok {
+		if len(d.peers) >= maxTorrents {
+			// still a valid announce, there is just no room to remember it
+			return true
+		}
+
+		peers = make(map[string]time.Time)
+		d.peers[infoHash] = peers
+	}
+
+	if _, ok := peers[compact]; ok || len(peers) < maxPeersPerTorrent {
+		peers[compact] = time.Now()
+	}
+
+	return true
+}
+
+// storedPeers returns the peers which announced a torrent to us
+func (d *DHT) storedPeers(infoHash [20]byte) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var values []string
+
+	for compact, announced := range d.peers[infoHash] {
+		if time.Since(announced) > peerExpiry {
+			continue
+		}
+
+		values = append(values, compact)
+
+		if len(values) == maxPeersPerReply {
+			break
+		}
+	}
+
+	return values
+}
+
+// expirePeers forgets the peers which have not announced again in time
+func (d *DHT) expirePeers() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for infoHash, peers := range d.peers {
+		for compact, announced := range peers {
+			if time.Since(announced) > peerExpiry {
+				delete(peers, compact)
+			}
+		}
+
+		if len(peers) == 0 {
+			delete(d.peers, infoHash)
+		}
+	}
+}
+
+// maintain refreshes the buckets nobody has been heard from in a while, forgets expired
+// peers and saves the node state until the node is closed
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(maintenanceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.closed:
+			return
+		case <-ticker.C:
+		}
+
+		if d.table.len() == 0 {
+			d.bootstrap(nil)
+		}
+
+		for _, b := range d.table.staleBuckets() {
+			d.lookup(context.Background(), d.table.randomIdInBucket(b), findNodeMethod, nil)
+		}
+
+		d.expirePeers()
+		d.saveState()
+	}
+}
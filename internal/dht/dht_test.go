@@ -0,0 +1,127 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+// newTestNode starts a node on a random loopback port, joining the DHT through bootstrap
+func newTestNode(t *testing.T, bootstrap []string) *DHT {
+	t.Helper()
+
+	d, err := New(Config{Bootstrap: bootstrap})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { d.Close() })
+
+	select {
+	case <-d.ready:
+	case <-time.After(10 * time.Second):
+		t.Fatal("node did not finish joining the DHT")
+	}
+
+	return d
+}
+
+func TestLoopbackSwarm(t *testing.T) {
+	root := newTestNode(t, nil)
+	bootstrap := []string{fmt.Sprintf("127.0.0.1:%d", root.Port())}
+
+	var nodes []*DHT
+
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, newTestNode(t, bootstrap))
+	}
+
+	for i, d := range nodes {
+		if d.Nodes() == 0 {
+			t.Fatalf("node %d knows no other node after bootstrapping", i)
+		}
+	}
+
+	if root.Nodes() != len(nodes) {
+		t.Fatalf("bootstrap node knows %d nodes, want %d", root.Nodes(), len(nodes))
+	}
+
+	infoHash := [20]byte{1, 2, 3}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// the first node announces the torrent, nobody knows of peers for it yet
+	err := nodes[0].Announce(ctx, infoHash, 6881, func(peers []peer.Peer) {
+		t.Errorf("peers %v found before any announce", peers)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last one only looks it up and finds the first one
+	var found []peer.Peer
+
+	err = nodes[len(nodes)-1].Announce(ctx, infoHash, 0, func(peers []peer.Peer) {
+		found = append(found, peers...)
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) == 0 || found[0].Address != "127.0.0.1:6881" {
+		t.Fatalf("found peers %v, want the announced one", found)
+	}
+}
+
+func TestStateKeepsNodeId(t *testing.T) {
+	root := newTestNode(t, nil)
+	path := filepath.Join(t.TempDir(), "dht.dat")
+
+	d, err := New(Config{StatePath: path, Bootstrap: []string{fmt.Sprintf("127.0.0.1:%d", root.Port())}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	<-d.ready
+	d.Close()
+
+	again, err := New(Config{StatePath: path})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer again.Close()
+
+	if again.self != d.self {
+		t.Fatal("node id not kept between runs")
+	}
+
+	<-again.ready
+
+	// the saved nodes are enough to join without bootstrap nodes
+	if again.Nodes() == 0 {
+		t.Fatal("no node known from the state")
+	}
+}
+
+func TestDefaultStatePathPerPort(t *testing.T) {
+	if DefaultStatePath(0) != "" {
+		t.Fatal("node on a random port has a state file")
+	}
+
+	a, b := DefaultStatePath(6881), DefaultStatePath(6882)
+
+	if a != "" && a == b {
+		t.Fatalf("nodes on different ports share %s", a)
+	}
+}
@@ -0,0 +1,158 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	krpcQuery    = "q"
+	krpcResponse = "r"
+	krpcError    = "e"
+
+	pingMethod         = "ping"
+	findNodeMethod     = "find_node"
+	getPeersMethod     = "get_peers"
+	announcePeerMethod = "announce_peer"
+
+	// error codes defined by BEP 5
+	errorGeneric       = 201
+	errorProtocol      = 203
+	errorMethodUnknown = 204
+
+	// compact node info, 20 bytes of node id followed by 4 bytes of ip and 2 bytes of port
+	compactNodeSize = 26
+	// compact peer info, 4 bytes of ip and 2 bytes of port
+	compactPeerSize = 6
+)
+
+// krpcMessage is a query, response or error exchanged between DHT nodes as described in BEP 5
+type krpcMessage struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *krpcArgs     `bencode:"a,omitempty"`
+	R *krpcReturn   `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+}
+
+type krpcArgs struct {
+	Id          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+type krpcReturn struct {
+	Id     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+func decodeMessage(data []byte) (*krpcMessage, error) {
+	var msg krpcMessage
+
+	err := bencode.DecodeBytes(data, &msg)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode krpc message: %s", err.Error())
+	}
+
+	if msg.T == "" {
+		return nil, fmt.Errorf("krpc message has no transaction id")
+	}
+
+	return &msg, nil
+}
+
+// errorMessage builds the error reply to a query
+func errorMessage(transactionId string, code int, text string) *krpcMessage {
+	return &krpcMessage{
+		T: transactionId,
+		Y: krpcError,
+		E: []interface{}{code, text},
+	}
+}
+
+// krpcErr turns the error list of a reply into an error
+func krpcErr(e []interface{}) error {
+	if len(e) == 2 {
+		return fmt.Errorf("dht node returned error %v: %v", e[0], e[1])
+	}
+
+	return fmt.Errorf("dht node returned an error")
+}
+
+// node is a DHT node known by its id and udp address
+type node struct {
+	id   nodeId
+	addr *net.UDPAddr
+}
+
+// encodeNodes packs nodes in compact node info format, nodes without an ipv4 address are left out
+func encodeNodes(nodes []*node) string {
+	buf := make([]byte, 0, len(nodes)*compactNodeSize)
+
+	for _, n := range nodes {
+		ip := n.addr.IP.To4()
+
+		if ip == nil {
+			continue
+		}
+
+		buf = append(buf, n.id[:]...)
+		buf = append(buf, ip...)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n.addr.Port))
+	}
+
+	return string(buf)
+}
+
+// decodeNodes unpacks nodes in compact node info format
+func decodeNodes(data string) ([]*node, error) {
+	if len(data)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("invalid compact node info")
+	}
+
+	nodes := make([]*node, 0, len(data)/compactNodeSize)
+
+	for i := 0; i < len(data); i += compactNodeSize {
+		n := &node{
+			addr: &net.UDPAddr{
+				IP:   net.IP([]byte(data[i+20 : i+24])),
+				Port: int(binary.BigEndian.Uint16([]byte(data[i+24 : i+26]))),
+			},
+		}
+
+		copy(n.id[:], data[i:i+20])
+
+		if n.addr.Port == 0 {
+			continue
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	return nodes, nil
+}
+
+// encodePeer packs a peer in compact peer info format
+func encodePeer(ip net.IP, port int) (string, bool) {
+	ip = ip.To4()
+
+	if ip == nil || port <= 0 || port > 65535 {
+		return "", false
+	}
+
+	buf := make([]byte, 0, compactPeerSize)
+	buf = append(buf, ip...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+
+	return string(buf), true
+}
@@ -0,0 +1,291 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+const (
+	// alpha is the number of queries a lookup keeps in flight
+	alpha = 3
+	// how often a torrent is announced again
+	announceInterval = 15 * time.Minute
+	// how soon to try again when a lookup did not find any peer
+	retryAnnounceInterval = time.Minute
+)
+
+type lookupNode struct {
+	*node
+	queried bool
+	failed  bool
+	token   string
+}
+
+type lookupReply struct {
+	n     *lookupNode
+	reply *krpcReturn
+	err   error
+}
+
+// lookup iteratively queries the nodes closest to the target until none closer can be found,
+// and returns the closest nodes which answered. With get_peers, the peers returned along the
+// way are handed to onPeers.
+func (d *DHT) lookup(ctx context.Context, target nodeId, method string, onPeers func([]peer.Peer)) []*lookupNode {
+	var candidates []*lookupNode
+
+	seen := make(map[string]bool)
+	seenPeers := make(map[string]bool)
+
+	addCandidates := func(nodes []*node) {
+		for _, n := range nodes {
+			key := n.addr.String()
+
+			if n.id == d.self || seen[key] {
+				continue
+			}
+
+			seen[key] = true
+			candidates = append(candidates, &lookupNode{node: n})
+		}
+
+		sortLookupNodes(target, candidates)
+	}
+
+	addCandidates(d.table.closest(target, bucketSize*2))
+
+	replies := make(chan lookupReply, alpha)
+	inFlight := 0
+
+	for {
+		// query the closest nodes which have not been queried yet, looking no further than
+		// the first bucketSize nodes which have not failed
+		considered := 0
+
+		for _, n := range candidates {
+			if inFlight == alpha || considered == bucketSize {
+				break
+			}
+
+			if n.failed {
+				continue
+			}
+
+			considered++
+
+			if n.queried {
+				continue
+			}
+
+			n.queried = true
+			inFlight++
+
+			go func(n *lookupNode) {
+				args := &krpcArgs{}
+
+				if method == getPeersMethod {
+					args.InfoHash = string(target[:])
+				} else {
+					args.Target = string(target[:])
+				}
+
+				reply, err := d.query(n.addr, method, args)
+				replies <- lookupReply{n: n, reply: reply, err: err}
+			}(n)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		var result lookupReply
+
+		select {
+		case <-ctx.Done():
+			// replies is large enough for the queries in flight to finish without a reader
+			return nil
+		case result = <-replies:
+		}
+
+		inFlight--
+
+		if result.err != nil {
+			result.n.failed = true
+			d.table.failed(result.n.id)
+			continue
+		}
+
+		result.n.token = result.reply.Token
+
+		nodes, err := decodeNodes(result.reply.Nodes)
+
+		if err == nil {
+			addCandidates(nodes)
+		}
+
+		if onPeers == nil || len(result.reply.Values) == 0 {
+			continue
+		}
+
+		var peers []peer.Peer
+
+		for _, value := range result.reply.Values {
+			found, err := peer.UnmarshalCompact([]byte(value))
+
+			if err != nil {
+				continue
+			}
+
+			for _, p := range found {
+				if !seenPeers[p.Address] {
+					seenPeers[p.Address] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+
+		if len(peers) > 0 {
+			onPeers(peers)
+		}
+	}
+
+	var closest []*lookupNode
+
+	for _, n := range candidates {
+		if n.queried && !n.failed {
+			closest = append(closest, n)
+		}
+
+		if len(closest) == bucketSize {
+			break
+		}
+	}
+
+	return closest
+}
+
+func sortLookupNodes(target nodeId, nodes []*lookupNode) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.closer(nodes[i].id, nodes[j].id)
+	})
+}
+
+// bootstrap joins the DHT by asking the cached and bootstrap nodes for the nodes closest to
+// us, then looking up our own id to fill the routing table
+func (d *DHT) bootstrap(cached []*node) {
+	var addrs []*net.UDPAddr
+
+	for _, n := range cached {
+		addrs = append(addrs, n.addr)
+	}
+
+	for _, host := range d.config.Bootstrap {
+		addr, err := net.ResolveUDPAddr("udp4", host)
+
+		if err != nil {
+			continue
+		}
+
+		addrs = append(addrs, addr)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, addr := range addrs {
+		wg.Add(1)
+
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			d.query(addr, findNodeMethod, &krpcArgs{Target: string(d.self[:])})
+		}(addr)
+	}
+
+	wg.Wait()
+
+	d.lookup(context.Background(), d.self, findNodeMethod, nil)
+}
+
+// Announce looks up the peers of a torrent, handing them to onPeers as they are found, and then
+// tells the nodes closest to the torrent that we are accepting its peers on the given port
+func (d *DHT) Announce(ctx context.Context, infoHash [20]byte, port int, onPeers func([]peer.Peer)) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-d.ready:
+	}
+
+	if d.table.len() == 0 {
+		d.bootstrap(nil)
+	}
+
+	closest := d.lookup(ctx, nodeId(infoHash), getPeersMethod, onPeers)
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if len(closest) == 0 {
+		return fmt.Errorf("no dht nodes answered")
+	}
+
+	if port == 0 {
+		return nil
+	}
+
+	var wg sync.WaitGroup
+
+	for _, n := range closest {
+		if n.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func(n *lookupNode) {
+			defer wg.Done()
+
+			d.query(n.addr, announcePeerMethod, &krpcArgs{
+				InfoHash: string(infoHash[:]),
+				Port:     port,
+				Token:    n.token,
+			})
+		}(n)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+// Run announces a torrent periodically until the context is cancelled, handing the peers found
+// to onPeers. A port of 0 only looks up peers without announcing.
+func (d *DHT) Run(ctx context.Context, infoHash [20]byte, port int, onPeers func([]peer.Peer)) {
+	for {
+		found := false
+
+		err := d.Announce(ctx, infoHash, port, func(peers []peer.Peer) {
+			found = true
+			onPeers(peers)
+		})
+
+		wait := announceInterval
+
+		if err != nil || !found {
+			wait = retryAnnounceInterval
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
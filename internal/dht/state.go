@@ -0,0 +1,89 @@
+package dht
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zeebo/bencode"
+)
+
+// state is what a node keeps between runs. Keeping the same id lets the other nodes recognise
+// it, and the known nodes let it join the DHT without the bootstrap nodes.
+type state struct {
+	Id    string `bencode:"id"`
+	Nodes string `bencode:"nodes"`
+}
+
+// DefaultStatePath returns where the state of the node listening on port is kept when not
+// configured otherwise, nodes running side by side have a file each so that they do not share
+// their id. A node on a random port has no state to come back to.
+func DefaultStatePath(port int) string {
+	dir, err := os.UserCacheDir()
+
+	if err != nil || port == 0 {
+		return ""
+	}
+
+	return filepath.Join(dir, "mybittorrent", fmt.Sprintf("dht-%d.dat", port))
+}
+
+// loadState reads the state of a previous run, a missing or unusable state is ignored
+func loadState(path string) *state {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil
+	}
+
+	var s state
+
+	err = bencode.DecodeBytes(data, &s)
+
+	if err != nil {
+		return nil
+	}
+
+	return &s
+}
+
+func (d *DHT) saveState() error {
+	path := d.config.StatePath
+
+	nodes := d.table.nodes()
+
+	// keep the nodes of the previous run rather than none at all, when offline for instance
+	if path == "" || len(nodes) == 0 {
+		return nil
+	}
+
+	data, err := bencode.EncodeBytes(state{
+		Id:    string(d.self[:]),
+		Nodes: encodeNodes(nodes),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that an interruption never leaves a truncated state behind
+	tmpPath := path + ".tmp"
+
+	err = os.WriteFile(tmpPath, data, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,258 @@
+package dht
+
+import (
+	"crypto/rand"
+	"math/bits"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// bucketSize is the number of nodes kept per bucket, the K of Kademlia
+	bucketSize = 8
+	// a node which has not been heard from for this long is questionable and can be replaced
+	nodeQuestionableAfter = 15 * time.Minute
+	// a node which failed to answer this many queries in a row is bad and is replaced first
+	maxNodeFailures = 2
+)
+
+type nodeId [20]byte
+
+func randomNodeId() nodeId {
+	var id nodeId
+	rand.Read(id[:])
+	return id
+}
+
+// prefixLen returns the number of leading bits that two ids have in common
+func (id nodeId) prefixLen(other nodeId) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return len(id) * 8
+}
+
+// closer tells if a is closer to the target than b in the xor metric
+func (target nodeId) closer(a, b nodeId) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+
+		if da != db {
+			return da < db
+		}
+	}
+
+	return false
+}
+
+type tableNode struct {
+	*node
+	lastSeen time.Time
+	failures int
+}
+
+func (n *tableNode) good() bool {
+	return n.failures < maxNodeFailures && time.Since(n.lastSeen) < nodeQuestionableAfter
+}
+
+// routingTable keeps the known nodes in one bucket per length of the prefix they share with our
+// own id, so that nodes close to us are known in much more detail than the ones far away
+type routingTable struct {
+	self nodeId
+
+	mu      sync.Mutex
+	buckets [161][]*tableNode
+}
+
+func newRoutingTable(self nodeId) *routingTable {
+	return &routingTable{self: self}
+}
+
+func (rt *routingTable) bucket(id nodeId) int {
+	return rt.self.prefixLen(id)
+}
+
+// seen records that a node answered us or sent us a query. The node is added to its bucket if
+// there is room left or if it can replace a bad or questionable node.
+func (rt *routingTable) seen(id nodeId, addr *net.UDPAddr) {
+	if id == rt.self || addr.IP.To4() == nil {
+		return
+	}
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucket(id)
+	bucket := rt.buckets[b]
+
+	for _, n := range bucket {
+		if n.id == id {
+			// nodes are shared with running lookups, so they are replaced instead of modified
+			n.node = &node{id: id, addr: addr}
+			n.lastSeen = time.Now()
+			n.failures = 0
+			return
+		}
+	}
+
+	entry := &tableNode{node: &node{id: id, addr: addr}, lastSeen: time.Now()}
+
+	if len(bucket) < bucketSize {
+		rt.buckets[b] = append(bucket, entry)
+		return
+	}
+
+	// replace the worst node of the bucket if it is no longer good
+	worst := 0
+
+	for i, n := range bucket {
+		if n.failures > bucket[worst].failures || (n.failures == bucket[worst].failures && n.lastSeen.Before(bucket[worst].lastSeen)) {
+			worst = i
+		}
+	}
+
+	if !bucket[worst].good() {
+		bucket[worst] = entry
+	}
+}
+
+// failed records that a node did not answer a query, bad nodes are dropped once their bucket
+// has other nodes to offer
+func (rt *routingTable) failed(id nodeId) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b := rt.bucket(id)
+	bucket := rt.buckets[b]
+
+	for i, n := range bucket {
+		if n.id != id {
+			continue
+		}
+
+		n.failures++
+
+		if n.failures >= maxNodeFailures && len(bucket) > 1 {
+			rt.buckets[b] = append(bucket[:i], bucket[i+1:]...)
+		}
+
+		return
+	}
+}
+
+// closest returns up to count nodes of the table ordered by their distance to the target
+func (rt *routingTable) closest(target nodeId, count int) []*node {
+	rt.mu.Lock()
+	var nodes []*node
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if n.failures < maxNodeFailures {
+				nodes = append(nodes, n.node)
+			}
+		}
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(target, nodes)
+
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+
+	return nodes
+}
+
+// nodes returns every node of the table, the good ones first
+func (rt *routingTable) nodes() []*node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var good, other []*node
+
+	for _, bucket := range rt.buckets {
+		for _, n := range bucket {
+			if n.good() {
+				good = append(good, n.node)
+			} else {
+				other = append(other, n.node)
+			}
+		}
+	}
+
+	return append(good, other...)
+}
+
+// len returns the number of nodes in the table
+func (rt *routingTable) len() int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	count := 0
+
+	for _, bucket := range rt.buckets {
+		count += len(bucket)
+	}
+
+	return count
+}
+
+// staleBuckets returns the buckets, in use or next to be used, which have not seen any
+// activity for a while
+func (rt *routingTable) staleBuckets() []int {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var stale []int
+
+	for b, bucket := range rt.buckets[:160] {
+		if len(bucket) == 0 {
+			// only the bucket right after the deepest one in use can still fill up
+			if b > 0 && len(rt.buckets[b-1]) == 0 {
+				continue
+			}
+		}
+
+		fresh := false
+
+		for _, n := range bucket {
+			if time.Since(n.lastSeen) < nodeQuestionableAfter {
+				fresh = true
+				break
+			}
+		}
+
+		if !fresh {
+			stale = append(stale, b)
+		}
+	}
+
+	return stale
+}
+
+// randomIdInBucket returns an id which falls in the given bucket, to look up nodes for it
+func (rt *routingTable) randomIdInBucket(b int) nodeId {
+	id := randomNodeId()
+
+	// share the first b bits with our id and differ on the next one
+	for i := 0; i < b; i++ {
+		mask := byte(0x80) >> (i % 8)
+		id[i/8] = id[i/8]&^mask | rt.self[i/8]&mask
+	}
+
+	mask := byte(0x80) >> (b % 8)
+	id[b/8] = id[b/8]&^mask | ^rt.self[b/8]&mask
+
+	return id
+}
+
+// sortByDistance orders nodes by their distance to the target
+func sortByDistance(target nodeId, nodes []*node) {
+	sort.Slice(nodes, func(i, j int) bool {
+		return target.closer(nodes[i].id, nodes[j].id)
+	})
+}
@@ -6,29 +6,50 @@ import (
 	"net"
 
 	"github.com/OmBudhiraja/torrent-client/internal/extensions/metadata"
+	"github.com/OmBudhiraja/torrent-client/internal/extensions/pex"
 	"github.com/OmBudhiraja/torrent-client/internal/message"
 	"github.com/zeebo/bencode"
 )
 
 const (
 	ExtensionHandshakeId byte = 0
+	// RequestQueueSize is the number of outstanding requests we queue for a peer, sent as reqq
+	RequestQueueSize = 250
 )
 
 var (
 	supportedExtensions = map[string]int{
 		metadata.MetadataExtensionName: int(metadata.MetadataExtensionId), // Metadata extension id for our peer
+		pex.PexExtensionName:           int(pex.PexExtensionId),           // Peer exchange extension id for our peer
 	}
 )
 
 type extensionHandshakeT struct {
 	M            map[string]int `bencode:"m"`
 	MetadataSize int            `bencode:"metadata_size"`
+	// P is the port on which the peer accepts connections
+	P int `bencode:"p,omitempty"`
+	// Reqq is the number of outstanding requests the peer queues without dropping any
+	Reqq int `bencode:"reqq,omitempty"`
 }
 
-func SendHandshakeMessage(conn net.Conn) error {
+// SendHandshakeMessage sends our extension handshake, listenPort is the port we accept
+// connections on or 0 if we do not. Peer exchange is left out for private torrents.
+func SendHandshakeMessage(conn net.Conn, listenPort int, private bool) error {
+	m := make(map[string]int, len(supportedExtensions))
+
+	for name, id := range supportedExtensions {
+		if private && name == pex.PexExtensionName {
+			continue
+		}
+
+		m[name] = id
+	}
 
 	bencodedDictionary := extensionHandshakeT{
-		M: supportedExtensions,
+		M:    m,
+		P:    listenPort,
+		Reqq: RequestQueueSize,
 	}
 
 	extensionsListBytes, err := bencode.EncodeBytes(bencodedDictionary)
@@ -0,0 +1,72 @@
+package extensions
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/extensions/metadata"
+	"github.com/OmBudhiraja/torrent-client/internal/extensions/pex"
+)
+
+// handshake sends our extension handshake and parses it back
+func handshake(t *testing.T, private bool) *extensionHandshakeT {
+	t.Helper()
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	go SendHandshakeMessage(conn, 6881, private)
+
+	// length prefix and message id
+	header := make([]byte, 5)
+
+	if _, err := io.ReadFull(other, header); err != nil {
+		t.Fatal(err)
+	}
+
+	length := int(header[0])<<24 | int(header[1])<<16 | int(header[2])<<8 | int(header[3])
+	data := make([]byte, length-1)
+
+	if _, err := io.ReadFull(other, data); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := ParseHandshakeMessage(data)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return parsed
+}
+
+func TestHandshakeOffersPex(t *testing.T) {
+	parsed := handshake(t, false)
+
+	if parsed.M[pex.PexExtensionName] != int(pex.PexExtensionId) || parsed.M[metadata.MetadataExtensionName] != int(metadata.MetadataExtensionId) {
+		t.Fatalf("handshake offers %v", parsed.M)
+	}
+
+	if parsed.P != 6881 || parsed.Reqq != RequestQueueSize {
+		t.Fatalf("handshake has port %d and reqq %d", parsed.P, parsed.Reqq)
+	}
+}
+
+func TestPrivateHandshakeLeavesOutPex(t *testing.T) {
+	parsed := handshake(t, true)
+
+	if _, ok := parsed.M[pex.PexExtensionName]; ok {
+		t.Fatalf("private torrent handshake offers %v", parsed.M)
+	}
+
+	if parsed.M[metadata.MetadataExtensionName] != int(metadata.MetadataExtensionId) {
+		t.Fatalf("private torrent handshake offers %v", parsed.M)
+	}
+
+	// the extensions offered to other torrents are not changed
+	if _, ok := supportedExtensions[pex.PexExtensionName]; !ok {
+		t.Fatal("pex removed from the supported extensions")
+	}
+}
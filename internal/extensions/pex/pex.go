@@ -0,0 +1,222 @@
+package pex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/OmBudhiraja/torrent-client/internal/message"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+	"github.com/zeebo/bencode"
+)
+
+const (
+	PexExtensionId   byte = 2
+	PexExtensionName      = "ut_pex"
+
+	// flags describing each added peer
+	FlagEncryption byte = 0x01
+	FlagSeed       byte = 0x02
+	FlagUTP        byte = 0x04
+	FlagHolepunch  byte = 0x08
+	FlagReachable  byte = 0x10
+
+	// MaxPeers is the maximum number of added or dropped peers in a single message
+	MaxPeers = 50
+)
+
+type pexMsgDict struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped  string `bencode:"dropped"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+type PexPeer struct {
+	Peer  peer.Peer
+	Flags byte
+}
+
+type PexMessage struct {
+	Added   []PexPeer
+	Dropped []peer.Peer
+}
+
+func FormatPexMsg(peerPexExtensionId int, added []PexPeer, dropped []peer.Peer) ([]byte, error) {
+	var dataDict pexMsgDict
+
+	for _, p := range added {
+		compact, ipv6, err := compactPeer(p.Peer)
+
+		if err != nil {
+			continue
+		}
+
+		if ipv6 {
+			dataDict.Added6 += compact
+			dataDict.Added6F += string([]byte{p.Flags})
+		} else {
+			dataDict.Added += compact
+			dataDict.AddedF += string([]byte{p.Flags})
+		}
+	}
+
+	for _, p := range dropped {
+		compact, ipv6, err := compactPeer(p)
+
+		if err != nil {
+			continue
+		}
+
+		if ipv6 {
+			dataDict.Dropped6 += compact
+		} else {
+			dataDict.Dropped += compact
+		}
+	}
+
+	bencodedBytes, err := bencode.EncodeBytes(dataDict)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode pex message: %s", err.Error())
+	}
+
+	payload := make([]byte, 0, len(bencodedBytes)+1)
+
+	payload = append(payload, byte(peerPexExtensionId))
+	payload = append(payload, bencodedBytes...)
+
+	length := len(payload) + 1
+
+	msg := make([]byte, 4+length)
+
+	binary.BigEndian.PutUint32(msg[:4], uint32(length))
+
+	msg[4] = message.ExtensionMessageId
+	copy(msg[5:], payload)
+
+	return msg, nil
+}
+
+func ParsePexMsg(data []byte) (*PexMessage, error) {
+	var dataDict pexMsgDict
+
+	err := bencode.DecodeBytes(data, &dataDict)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode pex message: %s", err.Error())
+	}
+
+	added, err := parsePeers(dataDict.Added, net.IPv4len)
+
+	if err != nil {
+		return nil, err
+	}
+
+	added6, err := parsePeers(dataDict.Added6, net.IPv6len)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dropped, err := parsePeers(dataDict.Dropped, net.IPv4len)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dropped6, err := parsePeers(dataDict.Dropped6, net.IPv6len)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &PexMessage{
+		Dropped: append(dropped, dropped6...),
+	}
+
+	for i, p := range added {
+		res.Added = append(res.Added, PexPeer{Peer: p, Flags: flag(dataDict.AddedF, i)})
+	}
+
+	for i, p := range added6 {
+		res.Added = append(res.Added, PexPeer{Peer: p, Flags: flag(dataDict.Added6F, i)})
+	}
+
+	return res, nil
+}
+
+// AddedPeers returns the added peers without their flags
+func (m *PexMessage) AddedPeers() []peer.Peer {
+	peers := make([]peer.Peer, len(m.Added))
+
+	for i, p := range m.Added {
+		peers[i] = p.Peer
+	}
+
+	return peers
+}
+
+// flag returns the flags of the i-th peer, peers without flags have none set
+func flag(flags string, i int) byte {
+	if i >= len(flags) {
+		return 0
+	}
+
+	return flags[i]
+}
+
+// parsePeers parses peers in compact format, an ip of ipLen bytes followed by 2 bytes of port
+func parsePeers(data string, ipLen int) ([]peer.Peer, error) {
+	peerSize := ipLen + 2
+
+	if len(data)%peerSize != 0 {
+		return nil, fmt.Errorf("invalid pex peer data")
+	}
+
+	peers := make([]peer.Peer, 0, len(data)/peerSize)
+
+	for i := 0; i < len(data); i += peerSize {
+		ip := net.IP([]byte(data[i : i+ipLen]))
+		port := binary.BigEndian.Uint16([]byte(data[i+ipLen : i+peerSize]))
+
+		if port == 0 {
+			continue
+		}
+
+		peers = append(peers, peer.Peer{Address: net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))})
+	}
+
+	return peers, nil
+}
+
+// compactPeer packs the address of a peer in compact format, telling if it is an ipv6 address
+func compactPeer(p peer.Peer) (string, bool, error) {
+	host, portStr, err := net.SplitHostPort(p.Address)
+
+	if err != nil {
+		return "", false, err
+	}
+
+	ip := net.ParseIP(host)
+	port, err := strconv.Atoi(portStr)
+
+	if ip == nil || err != nil || port <= 0 || port > 65535 {
+		return "", false, fmt.Errorf("invalid peer address %s", p.Address)
+	}
+
+	ipv6 := ip.To4() == nil
+
+	if !ipv6 {
+		ip = ip.To4()
+	}
+
+	compact := make([]byte, 0, len(ip)+2)
+	compact = append(compact, ip...)
+	compact = binary.BigEndian.AppendUint16(compact, uint16(port))
+
+	return string(compact), ipv6, nil
+}
@@ -0,0 +1,240 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+const (
+	multicastAddress = "239.192.152.143:6771"
+	// how often each torrent is announced on the local network
+	announceInterval = 5 * time.Minute
+)
+
+// LSD finds peers on the local network with the multicast announces of BEP 14
+type LSD struct {
+	conn *net.UDPConn
+	// announces are sent from their own socket, as conn is bound to the multicast address
+	sendConn *net.UDPConn
+	group    *net.UDPAddr
+	cookie   string
+	closed   chan struct{}
+	mu       sync.Mutex
+	torrents map[[20]byte]func([]peer.Peer)
+}
+
+// New joins the local service discovery multicast group
+func New() (*LSD, error) {
+	group, err := net.ResolveUDPAddr("udp4", multicastAddress)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to join local service discovery group: %s", err.Error())
+	}
+
+	sendConn, err := net.ListenUDP("udp4", nil)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+
+	l := &LSD{
+		conn:     conn,
+		sendConn: sendConn,
+		group:    group,
+		cookie:   hex.EncodeToString(cookie),
+		closed:   make(chan struct{}),
+		torrents: make(map[[20]byte]func([]peer.Peer)),
+	}
+
+	go l.serve()
+
+	return l, nil
+}
+
+func (l *LSD) Close() error {
+	select {
+	case <-l.closed:
+		return nil
+	default:
+	}
+
+	close(l.closed)
+
+	l.sendConn.Close()
+
+	return l.conn.Close()
+}
+
+// Run announces a torrent on the local network periodically until the context is cancelled,
+// handing the peers which announce the same torrent to onPeers. A port of 0 only listens for
+// the announces of other peers.
+func (l *LSD) Run(ctx context.Context, infoHash [20]byte, port int, onPeers func([]peer.Peer)) {
+	l.mu.Lock()
+	l.torrents[infoHash] = onPeers
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		delete(l.torrents, infoHash)
+		l.mu.Unlock()
+	}()
+
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+
+	for {
+		if port != 0 {
+			// best effort, the next announce may get through
+			l.announce(infoHash, port)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (l *LSD) announce(infoHash [20]byte, port int) error {
+	msg := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: %s\r\n"+
+		"Port: %d\r\n"+
+		"Infohash: %x\r\n"+
+		"cookie: %s\r\n"+
+		"\r\n\r\n", multicastAddress, port, infoHash, l.cookie)
+
+	_, err := l.sendConn.WriteToUDP([]byte(msg), l.group)
+
+	return err
+}
+
+func (l *LSD) serve() {
+	buf := make([]byte, 2048)
+
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+
+		if err != nil {
+			select {
+			case <-l.closed:
+				return
+			default:
+			}
+
+			continue
+		}
+
+		port, infoHashes, err := l.parseAnnounce(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		announced := []peer.Peer{{Address: net.JoinHostPort(addr.IP.String(), strconv.Itoa(port))}}
+
+		for _, infoHash := range infoHashes {
+			l.mu.Lock()
+			onPeers := l.torrents[infoHash]
+			l.mu.Unlock()
+
+			if onPeers != nil {
+				onPeers(announced)
+			}
+		}
+	}
+}
+
+// parseAnnounce reads the port and the info hashes of an announce, announces sent by
+// ourselves are rejected
+func (l *LSD) parseAnnounce(data []byte) (int, [][20]byte, error) {
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	requestLine, err := reader.ReadString('\n')
+
+	if err != nil || strings.TrimSpace(requestLine) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, fmt.Errorf("not a local service discovery announce")
+	}
+
+	header, err := readHeader(reader)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if header.Get("cookie") == l.cookie {
+		return 0, nil, fmt.Errorf("own announce")
+	}
+
+	port, err := strconv.Atoi(header.Get("Port"))
+
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, nil, fmt.Errorf("invalid port")
+	}
+
+	var infoHashes [][20]byte
+
+	for _, value := range header.Values("Infohash") {
+		hash, err := hex.DecodeString(strings.TrimSpace(value))
+
+		if err != nil || len(hash) != 20 {
+			continue
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], hash)
+
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return port, infoHashes, nil
+}
+
+// readHeader reads the http style header lines of an announce
+func readHeader(reader *bufio.Reader) (http.Header, error) {
+	header := make(http.Header)
+
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+
+		if line == "" {
+			return header, nil
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+
+		if !ok {
+			return nil, fmt.Errorf("invalid header line")
+		}
+
+		header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+
+		if err != nil {
+			// the last line is not terminated
+			return header, nil
+		}
+	}
+}
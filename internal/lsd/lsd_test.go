@@ -0,0 +1,78 @@
+package lsd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var (
+	hashA = [20]byte{1, 2, 3}
+	hashB = [20]byte{4, 5, 6}
+)
+
+func announceMessage(lines ...string) []byte {
+	return []byte("BT-SEARCH * HTTP/1.1\r\n" +
+		"Host: " + multicastAddress + "\r\n" +
+		strings.Join(lines, "\r\n") + "\r\n\r\n\r\n")
+}
+
+func TestParseAnnounce(t *testing.T) {
+	l := &LSD{cookie: "mine"}
+
+	port, infoHashes, err := l.parseAnnounce(announceMessage(
+		"Port: 6881",
+		fmt.Sprintf("Infohash: %x", hashA),
+		fmt.Sprintf("Infohash: %X", hashB),
+		"Infohash: not-a-hash",
+		"cookie: theirs",
+	))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port != 6881 {
+		t.Fatalf("port is %d, want 6881", port)
+	}
+
+	// every valid info hash of the announce is kept
+	if len(infoHashes) != 2 || infoHashes[0] != hashA || infoHashes[1] != hashB {
+		t.Fatalf("info hashes are %x", infoHashes)
+	}
+}
+
+func TestParseAnnounceUnterminated(t *testing.T) {
+	l := &LSD{cookie: "mine"}
+
+	port, infoHashes, err := l.parseAnnounce([]byte(fmt.Sprintf("BT-SEARCH * HTTP/1.1\nPort: 51413\nInfohash: %x", hashA)))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if port != 51413 || len(infoHashes) != 1 || infoHashes[0] != hashA {
+		t.Fatalf("announce parsed as port %d and info hashes %x", port, infoHashes)
+	}
+}
+
+func TestParseAnnounceRejected(t *testing.T) {
+	l := &LSD{cookie: "mine"}
+	infoHash := fmt.Sprintf("Infohash: %x", hashA)
+
+	tests := map[string][]byte{
+		"own announce":    announceMessage("Port: 6881", infoHash, "cookie: mine"),
+		"missing port":    announceMessage(infoHash),
+		"port not number": announceMessage("Port: abc", infoHash),
+		"port zero":       announceMessage("Port: 0", infoHash),
+		"port too large":  announceMessage("Port: 65536", infoHash),
+		"other request":   []byte("GET / HTTP/1.1\r\nPort: 6881\r\n\r\n"),
+		"bad header":      announceMessage("Port 6881", infoHash),
+	}
+
+	for name, data := range tests {
+		if _, _, err := l.parseAnnounce(data); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
@@ -1,17 +1,19 @@
 package magnetlink
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"math"
 	"net/url"
 	"strings"
+	"sync"
 
 	"github.com/OmBudhiraja/torrent-client/internal/p2p"
 	"github.com/OmBudhiraja/torrent-client/internal/peer"
 	"github.com/OmBudhiraja/torrent-client/internal/torrentfile"
 	"github.com/OmBudhiraja/torrent-client/internal/tracker"
-	"github.com/OmBudhiraja/torrent-client/pkg/progressbar"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
 	"github.com/zeebo/bencode"
 )
 
@@ -20,28 +22,129 @@ const (
 )
 
 type MagnetLink struct {
-	torrent  *p2p.Torrent
-	dsm      *p2p.DownloadSessionManger
-	infoHash [20]byte
-	peerId   []byte
-	peers    []peer.Peer
+	torrent   *p2p.Torrent
+	dsm       *p2p.DownloadSessionManger
+	infoHash  [20]byte
+	config    *p2p.Config
+	announcer *tracker.Announcer
+	peers     []peer.Peer
+	// webSeeds are the http mirrors given with ws, used once the metadata is known
+	webSeeds []string
+	// selection picks the files to download, from so unless given in the config
+	selection *p2p.FileSelection
+
+	// DownloadLimit and UploadLimit cap the transfer rates of the torrent, they do not limit
+	// anything until their rate is set, which can be done while it runs
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
 
 	metadataBytesChan      chan []byte
 	isMetataDownloadedChan chan struct{}
 	torrentInitailizedChan chan struct{}
+
+	mu         sync.Mutex
+	knownPeers map[string]bool
+	// connecting is the number of peers asked for the metadata at the same time, at most the
+	// peer limit of the config, the others are pending until one of them is done
+	connecting int
+	pending    []peer.Peer
+}
+
+func New(magnetUrl string, config *p2p.Config) (*MagnetLink, error) {
+	params, err := parse(magnetUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	infoHash, trackers := params.infoHash, params.trackers
+
+	selection := params.selection
+
+	if config.Files != nil {
+		selection = config.Files
+	}
+
+	if trackers.Len() == 0 && len(config.PeerSources()) == 0 {
+		return nil, fmt.Errorf("magnet link has no trackers and the dht and local service discovery are disabled")
+	}
+
+	var announcer *tracker.Announcer
+	var peers []peer.Peer
+
+	if trackers.Len() > 0 {
+		announcer = tracker.NewAnnouncer(trackers, infoHash, config.PeerId, config.Port)
+
+		fmt.Printf("Waiting for peers...")
+		// the size of the torrent is unknown until its metadata is downloaded
+		peers, err = announcer.Announce(tracker.EventStarted, tracker.Stats{Left: math.MaxInt64})
+
+		if err != nil {
+			fmt.Println()
+
+			// the announcer keeps trying while the other sources look for peers
+			if len(config.PeerSources()) == 0 {
+				return nil, err
+			}
+		} else {
+			fmt.Printf("\rFound %d peers           \n", len(peers))
+		}
+	}
+
+	magnetLink := &MagnetLink{
+		infoHash:               infoHash,
+		config:                 config,
+		announcer:              announcer,
+		peers:                  peers,
+		webSeeds:               params.webSeeds,
+		selection:              selection,
+		DownloadLimit:          ratelimit.New(0),
+		UploadLimit:            ratelimit.New(0),
+		metadataBytesChan:      make(chan []byte),
+		isMetataDownloadedChan: make(chan struct{}),
+		torrentInitailizedChan: make(chan struct{}),
+		knownPeers:             make(map[string]bool),
+	}
+
+	return magnetLink, nil
+}
+
+// Scrape asks the trackers of a magnet link for the swarm statistics of its torrent
+func Scrape(magnetUrl string) ([]tracker.ScrapeResult, error) {
+	params, err := parse(magnetUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if params.trackers.Len() == 0 {
+		return nil, fmt.Errorf("magnet link has no trackers")
+	}
+
+	return params.trackers.Scrape(params.infoHash), nil
 }
 
-func New(magnetUrl string, peerId []byte) (*MagnetLink, error) {
+type magnetParams struct {
+	infoHash [20]byte
+	trackers *tracker.TrackerList
+	webSeeds []string
+	// selection holds the files to download given with so, as described in BEP 53
+	selection *p2p.FileSelection
+}
+
+// parse extracts the info hash, the trackers, the web seeds and the selected files of a magnet link
+func parse(magnetUrl string) (*magnetParams, error) {
 	parsedUrl, err := url.Parse(magnetUrl)
 
 	if err != nil {
 		return nil, err
 	}
 
-	trackerUrl := parsedUrl.Query().Get("tr")
+	// every tracker of the magnet link gets its own tier
+	var announceList [][]string
 
-	if trackerUrl == "" {
-		return nil, fmt.Errorf("dht magnet links are not supported yet")
+	for _, trackerUrl := range parsedUrl.Query()["tr"] {
+		announceList = append(announceList, []string{trackerUrl})
 	}
 
 	infoType := parsedUrl.Query().Get("xt")
@@ -56,39 +159,66 @@ func New(magnetUrl string, peerId []byte) (*MagnetLink, error) {
 		return nil, fmt.Errorf("failed to decode info hash: %s", err.Error())
 	}
 
-	infoHash := [20]byte{}
-	copy(infoHash[:], hash)
+	if len(hash) != 20 {
+		return nil, fmt.Errorf("invalid info hash length")
+	}
 
-	fmt.Printf("Waiting for peers...")
-	peers, err := tracker.GetPeers(trackerUrl, infoHash, peerId, math.MaxInt)
+	params := &magnetParams{
+		trackers: tracker.NewTrackerList("", announceList),
+		webSeeds: parsedUrl.Query()["ws"],
+	}
 
-	if err != nil {
-		fmt.Println()
-		return nil, err
+	copy(params.infoHash[:], hash)
+
+	if so := parsedUrl.Query().Get("so"); so != "" {
+		params.selection, err = parseSelectOnly(so)
+
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	fmt.Printf("\rFound %d peers           \n", len(peers))
+	return params, nil
+}
 
-	magnetLink := &MagnetLink{
-		infoHash:               infoHash,
-		peerId:                 peerId,
-		peers:                  peers,
-		metadataBytesChan:      make(chan []byte),
-		isMetataDownloadedChan: make(chan struct{}),
-		torrentInitailizedChan: make(chan struct{}),
+// parseSelectOnly parses the so parameter, which only holds file indices and ranges of them
+func parseSelectOnly(so string) (*p2p.FileSelection, error) {
+	for _, item := range strings.Split(so, ",") {
+		if strings.Trim(item, "0123456789-") != "" {
+			return nil, fmt.Errorf("invalid file selection: %s", so)
+		}
 	}
 
-	return magnetLink, nil
+	selection, err := p2p.ParseFileSelection(so)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid file selection: %s", err.Error())
+	}
+
+	return selection, nil
 }
 
-func (magnetLink *MagnetLink) Download(outpath string) error {
+func (magnetLink *MagnetLink) Download(ctx context.Context, outpath string) error {
+
+	magnetLink.addPeers(magnetLink.peers)
 
-	for _, peer := range magnetLink.peers {
-		go handlePeer(peer, magnetLink)
+	// the other sources of peers are needed before the metadata tells if the torrent is private
+	sourcesCtx, stopPeerSources := context.WithCancel(ctx)
+	defer stopPeerSources()
+
+	for _, source := range magnetLink.config.PeerSources() {
+		go source.Run(sourcesCtx, magnetLink.infoHash, magnetLink.config.AnnouncedPort(), magnetLink.addPeers)
 	}
 
+	var mt []byte
+
 	// wait until one peer has completed metadata download
-	mt := <-magnetLink.metadataBytesChan
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case mt = <-magnetLink.metadataBytesChan:
+	}
+
 	close(magnetLink.isMetataDownloadedChan)
 
 	err := magnetLink.initializeTorrentFromMetadata(mt, outpath)
@@ -97,37 +227,42 @@ func (magnetLink *MagnetLink) Download(outpath string) error {
 		return fmt.Errorf("failed to load torrent metadata: %s", err.Error())
 	}
 
-	progressbar := progressbar.New(len(magnetLink.torrent.PieceHashes))
-
-	progressbar.Start()
-	defer progressbar.Finish()
+	if magnetLink.torrent.Private {
+		stopPeerSources()
+	}
 
 	dsm, err := magnetLink.torrent.Initiate()
-	magnetLink.dsm = dsm
-	defer dsm.CloseFiles()
-
-	downloadedPices := 0
-
-	close(magnetLink.torrentInitailizedChan)
 
 	if err != nil {
 		return fmt.Errorf("failed to initiate torrent download: %s", err.Error())
 	}
 
-	for downloadedPices < len(magnetLink.torrent.PieceHashes) {
-		piece := <-dsm.Results
-		downloadedPices++
+	magnetLink.dsm = dsm
+	defer dsm.Close()
 
-		err := piece.WriteToFiles(dsm.PieceToFileMap[piece.Index], magnetLink.torrent.PieceLength)
+	close(magnetLink.torrentInitailizedChan)
 
-		if err != nil {
-			return fmt.Errorf("failed to write piece to file: %s", err.Error())
-		}
+	// the peers which were waiting for the metadata are connected to by the peer manager
+	magnetLink.mu.Lock()
+	pending := magnetLink.pending
+	magnetLink.pending = nil
+	magnetLink.mu.Unlock()
+
+	dsm.AddPeers(pending)
+
+	stopAnnouncer := dsm.StartAnnouncer(ctx)
+	defer stopAnnouncer()
 
-		progressbar.Update(downloadedPices)
+	stopWebSeeds := dsm.StartWebSeeds(ctx)
+	defer stopWebSeeds()
+
+	err = dsm.WaitForCompletion(ctx)
+
+	if err != nil {
+		return fmt.Errorf("failed to write piece to file: %w", err)
 	}
 
-	close(dsm.WorkQueue)
+	dsm.Seed(ctx)
 
 	return nil
 }
@@ -141,6 +276,11 @@ func (magnetLink *MagnetLink) initializeTorrentFromMetadata(metadata []byte, out
 		return fmt.Errorf("failed to decode metadata: %s", err.Error())
 	}
 
+	// v2 only torrents need the piece layers, which are not part of the metadata
+	if info.IsV2Only() {
+		return fmt.Errorf("v2 only torrents are not supported from magnet links")
+	}
+
 	pieceHashes, err := info.PieceHashes()
 
 	if err != nil {
@@ -152,17 +292,83 @@ func (magnetLink *MagnetLink) initializeTorrentFromMetadata(metadata []byte, out
 	// Create torrent file from metadata
 	t := &p2p.Torrent{
 		InfoHash:    magnetLink.infoHash,
-		PieceHashes: pieceHashes,
+		PieceHashes: p2p.V1PieceHashes(pieceHashes),
 		PieceLength: info.PieceLength,
 		Length:      info.Length,
 		Name:        info.Name,
 		Files:       files,
-		PeerId:      magnetLink.peerId,
 		Peers:       magnetLink.peers,
 		Outpath:     outpath,
+		Config:      magnetLink.config,
+		Announcer:   magnetLink.announcer,
+		Private:     info.Private == 1,
+		WebSeeds:    magnetLink.webSeeds,
+		Selection:   magnetLink.selection,
+		Priorities:  magnetLink.config.Priorities,
+
+		DownloadLimit: magnetLink.DownloadLimit,
+		UploadLimit:   magnetLink.UploadLimit,
 	}
 
 	magnetLink.torrent = t
 
 	return nil
 }
+
+// addPeers connects to the peers that have not been seen yet, asking them for the metadata
+// until the torrent is initialized and handing them to the download session afterwards
+func (magnetLink *MagnetLink) addPeers(peers []peer.Peer) {
+	magnetLink.mu.Lock()
+
+	select {
+	case <-magnetLink.torrentInitailizedChan:
+		magnetLink.mu.Unlock()
+		magnetLink.dsm.AddPeers(peers)
+		return
+	default:
+	}
+
+	defer magnetLink.mu.Unlock()
+
+	for _, p := range peers {
+		if magnetLink.knownPeers[p.Address] {
+			continue
+		}
+
+		magnetLink.knownPeers[p.Address] = true
+
+		if magnetLink.connecting >= magnetLink.config.PeerLimit() {
+			magnetLink.pending = append(magnetLink.pending, p)
+			continue
+		}
+
+		magnetLink.connecting++
+
+		go handlePeer(p, magnetLink)
+	}
+}
+
+// peerDone connects to a pending peer in place of a peer asked for the metadata which is done,
+// until the torrent is initialized
+func (magnetLink *MagnetLink) peerDone() {
+	magnetLink.mu.Lock()
+	defer magnetLink.mu.Unlock()
+
+	magnetLink.connecting--
+
+	select {
+	case <-magnetLink.torrentInitailizedChan:
+		return
+	default:
+	}
+
+	if len(magnetLink.pending) == 0 {
+		return
+	}
+
+	p := magnetLink.pending[0]
+	magnetLink.pending = magnetLink.pending[1:]
+	magnetLink.connecting++
+
+	go handlePeer(p, magnetLink)
+}
@@ -1,20 +1,32 @@
 package magnetlink
 
 import (
+	"sync"
+
 	"github.com/OmBudhiraja/torrent-client/internal/client"
 	"github.com/OmBudhiraja/torrent-client/internal/extensions"
 	"github.com/OmBudhiraja/torrent-client/internal/extensions/metadata"
+	"github.com/OmBudhiraja/torrent-client/internal/extensions/pex"
 	"github.com/OmBudhiraja/torrent-client/internal/message"
 	"github.com/OmBudhiraja/torrent-client/internal/peer"
 )
 
 func handlePeer(peerClient peer.Peer, magnetLink *MagnetLink) {
-	c, err := client.New(peerClient, magnetLink.infoHash, magnetLink.peerId, 0)
+	var peerDone sync.Once
+	release := func() { peerDone.Do(magnetLink.peerDone) }
+	defer release()
+
+	// whether the torrent is private is not known before its metadata is
+	c, err := client.New(peerClient, magnetLink.infoHash, magnetLink.config.PeerId, magnetLink.config.Dialer(), magnetLink.config.AnnouncedPort(), false, 0)
 
 	if err != nil {
 		return
 	}
 
+	defer c.Conn.Close()
+
+	c.Conn = magnetLink.config.LimitConn(c.Conn, magnetLink.DownloadLimit, magnetLink.UploadLimit)
+
 	messageResultChan := make(chan *client.MessageResult, 30)
 
 	peerCloseChan := make(chan struct{})
@@ -23,7 +35,7 @@ func handlePeer(peerClient peer.Peer, magnetLink *MagnetLink) {
 	go c.ParsePeerMessage(messageResultChan, peerCloseChan)
 
 	var fullMetadata []byte
-	var downloadedMetadataSize int
+	var metadataSize, downloadedMetadataSize int
 
 outerLoop:
 	for {
@@ -43,23 +55,26 @@ outerLoop:
 			}
 
 			extensionId := msg.Data[0]
-			peerMetadataExtensionId := c.SupportedExtension[metadata.MetadataExtensionName]
+			peerMetadataExtensionId := c.ExtensionId(metadata.MetadataExtensionName)
 
 			// extension handshake completed
 			// send metadata request message if the peer supports metadata extension
 			if extensionId == extensions.ExtensionHandshakeId {
 
-				// peer does not support metadata extension
+				// peer does not support metadata extension, another peer is asked in its place
 				if peerMetadataExtensionId == 0 {
+					release()
 					continue
 				}
 
+				metadataSize = c.MetadataSize()
+
 				var numPieces int
 
-				if c.MetadataSize == 0 {
+				if metadataSize == 0 {
 					numPieces = 1
 				} else {
-					numPieces = (c.MetadataSize + metadata.PieceSize - 1) / metadata.PieceSize
+					numPieces = (metadataSize + metadata.PieceSize - 1) / metadata.PieceSize
 				}
 
 				for i := 0; i < numPieces; i++ {
@@ -81,6 +96,17 @@ outerLoop:
 
 			}
 
+			// grow the swarm with the peers exchanged while the metadata is not known yet
+			if extensionId == pex.PexExtensionId {
+				pexMsg, err := pex.ParsePexMsg(msg.Data[1:])
+
+				if err != nil {
+					continue
+				}
+
+				magnetLink.addPeers(pexMsg.AddedPeers())
+			}
+
 			if extensionId == metadata.MetadataExtensionId {
 				metadataRes, err := metadata.HandleMetadataMsg(msg.Data[1:])
 
@@ -98,16 +124,16 @@ outerLoop:
 					continue
 				}
 
-				if c.MetadataSize == 0 {
-					c.MetadataSize = metadataRes.TotalSize
-				} else if c.MetadataSize != 0 && c.MetadataSize != metadataRes.TotalSize {
+				if metadataSize == 0 {
+					metadataSize = metadataRes.TotalSize
+				} else if metadataSize != 0 && metadataSize != metadataRes.TotalSize {
 					// metadata size does not match
 					// fmt.Println("metadata size does not match???????")
 					continue
 				}
 
 				if len(fullMetadata) == 0 {
-					fullMetadata = make([]byte, c.MetadataSize)
+					fullMetadata = make([]byte, metadataSize)
 				}
 
 				if metadataRes.MsgType == int(metadata.ExtensionMessageDataId) {
@@ -119,7 +145,7 @@ outerLoop:
 
 					downloadedMetadataSize += len(metadataRes.Data)
 
-					if downloadedMetadataSize == c.MetadataSize {
+					if downloadedMetadataSize == metadataSize {
 						// metadata download completed
 						select {
 						case magnetLink.metadataBytesChan <- fullMetadata:
@@ -138,5 +164,6 @@ outerLoop:
 		break
 	}
 
-	magnetLink.torrent.ResumeWorker(c, magnetLink.dsm.WorkQueue, magnetLink.dsm.Results, messageResultChan, peerCloseChan)
+	// the peer manager decides whether to keep the peer, as it does for the peers it connects to
+	magnetLink.torrent.AdoptWorker(c, magnetLink.dsm, messageResultChan, peerCloseChan)
 }
@@ -2,6 +2,7 @@ package message
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 	"net"
 )
@@ -16,7 +17,15 @@ const (
 	RequestMessageID       byte = 6
 	PieceMessageID         byte = 7
 	CancelMessageID        byte = 8
-	ExtensionMessageId     byte = 20
+
+	// messages of the fast extension
+	SuggestPieceMessageID  byte = 13
+	HaveAllMessageID       byte = 14
+	HaveNoneMessageID      byte = 15
+	RejectRequestMessageID byte = 16
+	AllowedFastMessageID   byte = 17
+
+	ExtensionMessageId byte = 20
 )
 
 type Message struct {
@@ -82,6 +91,8 @@ func FormatRequestPayload(index, begin, length int) []byte {
 	return payload
 }
 
+// FormatHavePayload formats the payload of a have message, suggest piece and allowed fast
+// messages carry the same payload
 func FormatHavePayload(index int) []byte {
 	payload := make([]byte, 4)
 
@@ -89,3 +100,36 @@ func FormatHavePayload(index int) []byte {
 
 	return payload
 }
+
+func FormatPiecePayload(index, begin int, block []byte) []byte {
+	payload := make([]byte, 8+len(block))
+
+	binary.BigEndian.PutUint32(payload[:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+
+	return payload
+}
+
+// ParseHavePayload reads the piece index of a have, suggest piece or allowed fast message
+func ParseHavePayload(payload []byte) (int, error) {
+	if len(payload) != 4 {
+		return 0, fmt.Errorf("invalid have payload length %d", len(payload))
+	}
+
+	return int(binary.BigEndian.Uint32(payload)), nil
+}
+
+// ParseRequestPayload reads a request message, reject request and cancel messages carry the
+// same payload
+func ParseRequestPayload(payload []byte) (index, begin, length int, err error) {
+	if len(payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("invalid request payload length %d", len(payload))
+	}
+
+	index = int(binary.BigEndian.Uint32(payload[:4]))
+	begin = int(binary.BigEndian.Uint32(payload[4:8]))
+	length = int(binary.BigEndian.Uint32(payload[8:12]))
+
+	return index, begin, length, nil
+}
@@ -0,0 +1,319 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+)
+
+const protocolHeader = "\x13BitTorrent protocol"
+
+// Initiate runs the encrypted handshake on an outbound connection for the torrent with the
+// given info hash. Plaintext is offered besides RC4 unless the policy requires encryption.
+func Initiate(conn net.Conn, infoHash []byte, policy Policy) (*Conn, error) {
+	private, public, err := newKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(public, randomPad()...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	otherPublic := make([]byte, keyLen)
+
+	_, err = io.ReadFull(r, otherPublic)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %s", err.Error())
+	}
+
+	secret, err := sharedSecret(otherPublic, private)
+
+	if err != nil {
+		return nil, err
+	}
+
+	encrypter := newRC4("keyA", secret, infoHash)
+	decrypter := newRC4("keyB", secret, infoHash)
+
+	provide := CryptoRC4
+
+	if policy != Require {
+		provide |= CryptoPlaintext
+	}
+
+	padC := make([]byte, len(randomPad()))
+
+	// no initial payload, the bittorrent handshake follows the encrypted handshake
+	header := make([]byte, 0, len(vc)+8+len(padC))
+	header = append(header, vc...)
+	header = binary.BigEndian.AppendUint32(header, provide)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(padC)))
+	header = append(header, padC...)
+	header = binary.BigEndian.AppendUint16(header, 0)
+
+	encryptedHeader := make([]byte, len(header))
+	encrypter.XORKeyStream(encryptedHeader, header)
+
+	msg := hash([]byte("req1"), secret)
+	msg = append(msg, xor(hash([]byte("req2"), infoHash), hash([]byte("req3"), secret))...)
+	msg = append(msg, encryptedHeader...)
+
+	_, err = conn.Write(msg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the reply starts with the encrypted verification constant after the padding
+	encryptedVC := make([]byte, len(vc))
+	decrypter.XORKeyStream(encryptedVC, vc)
+
+	err = synchronize(r, encryptedVC, maxPadLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 6)
+
+	err = readDecrypted(r, decrypter, reply)
+
+	if err != nil {
+		return nil, err
+	}
+
+	selected := binary.BigEndian.Uint32(reply[:4])
+	padD := make([]byte, binary.BigEndian.Uint16(reply[4:]))
+
+	if len(padD) > maxPadLen {
+		return nil, fmt.Errorf("invalid padding length %d", len(padD))
+	}
+
+	err = readDecrypted(r, decrypter, padD)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch selected {
+	case CryptoRC4:
+		return &Conn{
+			Conn:      conn,
+			Encrypted: true,
+			reader:    cipher.StreamReader{S: decrypter, R: r},
+			encrypter: encrypter,
+		}, nil
+	case CryptoPlaintext:
+		if provide&CryptoPlaintext == 0 {
+			break
+		}
+
+		return &Conn{Conn: conn, reader: r}, nil
+	}
+
+	return nil, fmt.Errorf("peer selected an unsupported crypto method %d", selected)
+}
+
+// Accept runs the handshake of an inbound connection, which is either encrypted or a
+// plaintext bittorrent handshake as allowed by the policy. infoHashes returns the torrents
+// we serve, one of which the encrypted handshake has to be for.
+func Accept(conn net.Conn, policy Policy, infoHashes func() [][20]byte) (*Conn, error) {
+	r := bufio.NewReader(conn)
+
+	start, err := r.Peek(len(protocolHeader))
+
+	if err != nil {
+		return nil, err
+	}
+
+	if string(start) == protocolHeader {
+		if policy == Require {
+			return nil, fmt.Errorf("plaintext connection refused")
+		}
+
+		return &Conn{Conn: conn, reader: r}, nil
+	}
+
+	if policy == Disabled {
+		return nil, fmt.Errorf("encrypted connection refused")
+	}
+
+	otherPublic := make([]byte, keyLen)
+
+	_, err = io.ReadFull(r, otherPublic)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %s", err.Error())
+	}
+
+	private, public, err := newKeyPair()
+
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := sharedSecret(otherPublic, private)
+
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Write(append(public, randomPad()...))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = synchronize(r, hash([]byte("req1"), secret), maxPadLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	obfuscatedHash := make([]byte, 20)
+
+	_, err = io.ReadFull(r, obfuscatedHash)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the info hash is only sent hashed, find which of our torrents it is
+	req2 := xor(obfuscatedHash, hash([]byte("req3"), secret))
+
+	var infoHash []byte
+
+	for _, candidate := range infoHashes() {
+		if bytes.Equal(hash([]byte("req2"), candidate[:]), req2) {
+			infoHash = candidate[:]
+			break
+		}
+	}
+
+	if infoHash == nil {
+		return nil, fmt.Errorf("encrypted handshake for an unknown torrent")
+	}
+
+	decrypter := newRC4("keyA", secret, infoHash)
+	encrypter := newRC4("keyB", secret, infoHash)
+
+	header := make([]byte, len(vc)+6)
+
+	err = readDecrypted(r, decrypter, header)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:len(vc)], vc) {
+		return nil, fmt.Errorf("invalid verification constant")
+	}
+
+	provide := binary.BigEndian.Uint32(header[len(vc) : len(vc)+4])
+	padC := make([]byte, binary.BigEndian.Uint16(header[len(vc)+4:]))
+
+	if len(padC) > maxPadLen {
+		return nil, fmt.Errorf("invalid padding length %d", len(padC))
+	}
+
+	// the padding is followed by the length of the initial payload
+	padAndLen := make([]byte, len(padC)+2)
+
+	err = readDecrypted(r, decrypter, padAndLen)
+
+	if err != nil {
+		return nil, err
+	}
+
+	initialPayload := make([]byte, binary.BigEndian.Uint16(padAndLen[len(padC):]))
+
+	err = readDecrypted(r, decrypter, initialPayload)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+
+	switch {
+	case provide&CryptoRC4 != 0:
+		selected = CryptoRC4
+	case provide&CryptoPlaintext != 0 && policy != Require:
+		selected = CryptoPlaintext
+	default:
+		return nil, fmt.Errorf("no supported crypto method offered")
+	}
+
+	padD := make([]byte, len(randomPad()))
+
+	reply := make([]byte, 0, len(vc)+6+len(padD))
+	reply = append(reply, vc...)
+	reply = binary.BigEndian.AppendUint32(reply, selected)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(padD)))
+	reply = append(reply, padD...)
+
+	encryptedReply := make([]byte, len(reply))
+	encrypter.XORKeyStream(encryptedReply, reply)
+
+	_, err = conn.Write(encryptedReply)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the initial payload is always encrypted, it comes before the rest of the stream
+	if selected == CryptoPlaintext {
+		return &Conn{Conn: conn, reader: io.MultiReader(bytes.NewReader(initialPayload), r)}, nil
+	}
+
+	return &Conn{
+		Conn:      conn,
+		Encrypted: true,
+		reader:    io.MultiReader(bytes.NewReader(initialPayload), cipher.StreamReader{S: decrypter, R: r}),
+		encrypter: encrypter,
+	}, nil
+}
+
+// synchronize skips the random padding of the other side, reading until pattern is found
+// within the maximum padding length
+func synchronize(r *bufio.Reader, pattern []byte, maxPad int) error {
+	window := make([]byte, 0, maxPad+len(pattern))
+
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return fmt.Errorf("failed to synchronize with the encrypted stream: %s", err.Error())
+		}
+
+		window = append(window, b)
+
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("failed to synchronize with the encrypted stream")
+}
+
+func readDecrypted(r io.Reader, decrypter cipher.Stream, buf []byte) error {
+	_, err := io.ReadFull(r, buf)
+
+	if err != nil {
+		return err
+	}
+
+	decrypter.XORKeyStream(buf, buf)
+
+	return nil
+}
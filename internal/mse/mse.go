@@ -0,0 +1,180 @@
+package mse
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+)
+
+const (
+	// crypto methods offered and selected during the handshake
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+
+	// length of the public keys and of the shared secret
+	keyLen = 96
+	// maximum length of the random padding after each step of the handshake
+	maxPadLen = 512
+	// padding we send ourselves, kept short as it only makes the stream harder to fingerprint
+	ourMaxPadLen = 64
+)
+
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+
+	// verification constant, its encrypted form marks the end of the padding
+	vc = make([]byte, 8)
+)
+
+// Policy decides which connections are encrypted
+type Policy int
+
+const (
+	// Disabled only speaks plaintext
+	Disabled Policy = iota
+	// Prefer encrypts connections, falling back to plaintext with peers which do not support it
+	Prefer
+	// Require refuses plaintext connections
+	Require
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	}
+
+	return fmt.Sprintf("Policy(%d)", int(p))
+}
+
+// Set parses a policy by name, so that a Policy can be used as a flag value
+func (p *Policy) Set(value string) error {
+	for _, policy := range []Policy{Disabled, Prefer, Require} {
+		if policy.String() == value {
+			*p = policy
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown encryption policy %q, expected disabled, prefer or require", value)
+}
+
+// Conn is a connection which went through the encrypted handshake, the payload is RC4
+// encrypted unless plaintext was selected
+type Conn struct {
+	net.Conn
+	// Encrypted tells if the payload is encrypted, only the handshake is otherwise
+	Encrypted bool
+
+	reader io.Reader
+	// encrypter is nil when plaintext was selected
+	encrypter cipher.Stream
+	writeMu   sync.Mutex
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.encrypter == nil {
+		return c.Conn.Write(b)
+	}
+
+	// the key stream must be applied in the order the bytes are sent
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	encrypted := make([]byte, len(b))
+	c.encrypter.XORKeyStream(encrypted, b)
+
+	return c.Conn.Write(encrypted)
+}
+
+// newKeyPair returns a random private key and the matching public key
+func newKeyPair() (*big.Int, []byte, error) {
+	privateBytes := make([]byte, 20)
+
+	_, err := rand.Read(privateBytes)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	private := new(big.Int).SetBytes(privateBytes)
+	public := new(big.Int).Exp(generator, private, prime)
+
+	return private, padKey(public), nil
+}
+
+// sharedSecret computes the secret from the public key of the other side
+func sharedSecret(otherPublic []byte, private *big.Int) ([]byte, error) {
+	y := new(big.Int).SetBytes(otherPublic)
+
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(prime) >= 0 {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	return padKey(new(big.Int).Exp(y, private, prime)), nil
+}
+
+// padKey returns a number as a big endian byte string of the key length
+func padKey(n *big.Int) []byte {
+	key := make([]byte, keyLen)
+	n.FillBytes(key)
+
+	return key
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+
+	for _, part := range parts {
+		h.Write(part)
+	}
+
+	return h.Sum(nil)
+}
+
+// newRC4 returns the cipher for one direction of the stream, with the first 1024 bytes
+// of the key stream discarded
+func newRC4(name string, secret, skey []byte) cipher.Stream {
+	c, _ := rc4.NewCipher(hash([]byte(name), secret, skey))
+
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+
+	return c
+}
+
+// randomPad returns up to ourMaxPadLen random bytes
+func randomPad() []byte {
+	n := make([]byte, 1)
+	rand.Read(n)
+
+	pad := make([]byte, int(n[0])%(ourMaxPadLen+1))
+	rand.Read(pad)
+
+	return pad
+}
+
+func xor(a, b []byte) []byte {
+	res := make([]byte, len(a))
+
+	for i := range a {
+		res[i] = a[i] ^ b[i]
+	}
+
+	return res
+}
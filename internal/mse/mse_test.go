@@ -0,0 +1,181 @@
+package mse
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+var testInfoHash = [20]byte{1, 2, 3, 4, 5}
+
+// recordConn keeps a copy of everything written to the connection
+type recordConn struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	c.written.Write(b)
+	return c.Conn.Write(b)
+}
+
+type acceptResult struct {
+	conn *Conn
+	err  error
+}
+
+// handshakeResult holds both ends of a handshake, out is the initiating side
+type handshakeResult struct {
+	out, in       *Conn
+	outErr, inErr error
+	// recorded holds what the initiating side wrote
+	recorded *recordConn
+}
+
+// handshake connects over loopback and runs Initiate and Accept with the given policies
+func handshake(t *testing.T, initiate, accept Policy, served [20]byte) handshakeResult {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	accepted := make(chan acceptResult, 1)
+
+	go func() {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			accepted <- acceptResult{err: err}
+			return
+		}
+
+		c, err := Accept(conn, accept, func() [][20]byte { return [][20]byte{served} })
+
+		if err != nil {
+			conn.Close()
+		}
+
+		accepted <- acceptResult{c, err}
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	recorded := &recordConn{Conn: conn}
+	out, outErr := Initiate(recorded, testInfoHash[:], initiate)
+
+	in := <-accepted
+
+	if in.conn != nil {
+		t.Cleanup(func() { in.conn.Close() })
+	}
+
+	return handshakeResult{out: out, in: in.conn, outErr: outErr, inErr: in.err, recorded: recorded}
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	h := handshake(t, Prefer, Prefer, testInfoHash)
+
+	if h.outErr != nil || h.inErr != nil {
+		t.Fatalf("handshake failed: %v, %v", h.outErr, h.inErr)
+	}
+
+	out, in := h.out, h.in
+
+	if !out.Encrypted || !in.Encrypted {
+		t.Fatal("prefer on both sides did not select rc4")
+	}
+
+	msg := []byte(protocolHeader + " over rc4")
+
+	go out.Write(msg)
+
+	got := make([]byte, len(msg))
+
+	if _, err := io.ReadFull(in, got); err != nil || !bytes.Equal(got, msg) {
+		t.Fatalf("accepting side read %q, %v", got, err)
+	}
+
+	if bytes.Contains(h.recorded.written.Bytes(), []byte(protocolHeader)) {
+		t.Fatal("payload sent in the clear")
+	}
+
+	reply := []byte("and back")
+
+	go in.Write(reply)
+
+	got = make([]byte, len(reply))
+
+	if _, err := io.ReadFull(out, got); err != nil || !bytes.Equal(got, reply) {
+		t.Fatalf("initiating side read %q, %v", got, err)
+	}
+}
+
+func TestUnknownTorrent(t *testing.T) {
+	if h := handshake(t, Prefer, Prefer, [20]byte{9}); h.inErr == nil {
+		t.Fatal("handshake for a torrent we do not serve accepted")
+	}
+}
+
+func TestAcceptPlaintext(t *testing.T) {
+	for _, policy := range []Policy{Disabled, Prefer, Require} {
+		client, server := net.Pipe()
+
+		go client.Write([]byte(protocolHeader))
+
+		conn, err := Accept(server, policy, nil)
+
+		if policy == Require {
+			if err == nil {
+				t.Fatal("plaintext accepted by require")
+			}
+
+			client.Close()
+			continue
+		}
+
+		if err != nil || conn.Encrypted {
+			t.Fatalf("%s: plaintext refused: %v", policy, err)
+		}
+
+		// the bytes looked at to tell plaintext apart are still there for the bittorrent handshake
+		got := make([]byte, len(protocolHeader))
+
+		if _, err := io.ReadFull(conn, got); err != nil || string(got) != protocolHeader {
+			t.Fatalf("%s: read %q, %v", policy, got, err)
+		}
+
+		client.Close()
+	}
+}
+
+func TestAcceptDisabledRefusesEncryption(t *testing.T) {
+	if h := handshake(t, Prefer, Disabled, testInfoHash); h.outErr == nil || h.inErr == nil {
+		t.Fatal("encrypted handshake accepted by disabled")
+	}
+}
+
+func TestPolicyFlag(t *testing.T) {
+	var p Policy
+
+	for _, name := range []string{"disabled", "prefer", "require"} {
+		if err := p.Set(name); err != nil || p.String() != name {
+			t.Fatalf("Set(%q) gave %s, %v", name, p, err)
+		}
+	}
+
+	if err := p.Set("maybe"); err == nil {
+		t.Fatal("unknown policy accepted")
+	}
+}
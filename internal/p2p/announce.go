@@ -0,0 +1,92 @@
+package p2p
+
+import (
+	"context"
+	"sync"
+
+	"github.com/OmBudhiraja/torrent-client/internal/tracker"
+)
+
+// Stats returns the transfer counters of the session as reported to the trackers
+func (dsm *DownloadSessionManger) Stats() tracker.Stats {
+	dsm.mu.Lock()
+	defer dsm.mu.Unlock()
+
+	left := 0
+
+	for i := range dsm.T.PieceHashes {
+		if dsm.wanted.HasPiece(i) && !dsm.Bitfield.HasPiece(i) {
+			left += dsm.T.getPieceLength(i)
+		}
+	}
+
+	return tracker.Stats{
+		Uploaded:   dsm.uploaded.Load(),
+		Downloaded: dsm.downloaded.Load(),
+		Left:       int64(left),
+	}
+}
+
+// StartAnnouncer keeps the trackers informed in the background and feeds the peers they return
+// into the session, the returned function sends the stopped event and waits for it
+func (dsm *DownloadSessionManger) StartAnnouncer(ctx context.Context) (stop func()) {
+	announcer := dsm.T.Announcer
+
+	if announcer == nil {
+		return func() {}
+	}
+
+	// a torrent which is already complete when starting is seeding, not completing, and
+	// downloading some of the files only never completes it
+	completed := dsm.downloadComplete
+
+	if wanted, done := dsm.wantedPieces(); wanted == done || wanted < len(dsm.T.PieceHashes) {
+		completed = nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		announcer.Run(ctx, dsm.Stats, completed, dsm.AddPeers)
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// usesPeerSources tells if the peers of the torrent can be found without its trackers, private
+// torrents only get their peers from their trackers
+func (t *Torrent) usesPeerSources() bool {
+	return !t.Private && len(t.Config.PeerSources()) > 0
+}
+
+// StartPeerSources looks for the peers of the torrent on the DHT and the local network in the
+// background and feeds them into the session, the returned function stops looking and waits
+// for the sources to be done
+func (dsm *DownloadSessionManger) StartPeerSources(ctx context.Context) (stop func()) {
+	if !dsm.T.usesPeerSources() {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	for _, source := range dsm.T.Config.PeerSources() {
+		wg.Add(1)
+
+		go func(source PeerSource) {
+			defer wg.Done()
+			source.Run(ctx, dsm.T.InfoHash, dsm.T.Config.AnnouncedPort(), dsm.AddPeers)
+		}(source)
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
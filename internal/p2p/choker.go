@@ -0,0 +1,200 @@
+package p2p
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+)
+
+const (
+	chokeInterval = 10 * time.Second
+	// the optimistic unchoke moves to another peer every this many rounds
+	optimisticUnchokeRounds = 3
+	defaultUploadSlots      = 4
+)
+
+// choker decides which peers we upload to, with the tit-for-tat algorithm of the original client:
+// the interested peers we download the most from are unchoked, or the ones we upload the most to
+// once seeding, along with one more peer picked at random so that new peers get a chance to show
+// what they can give back
+type choker struct {
+	// wake asks for free upload slots to be filled right away, when a peer gets interested
+	wake       chan struct{}
+	round      int
+	optimistic *client.Client
+	// transferred holds the bytes exchanged with each peer as of the previous round
+	transferred map[*client.Client]int64
+	random      *rand.Rand
+}
+
+func newChoker() *choker {
+	return &choker{
+		wake:        make(chan struct{}, 1),
+		transferred: make(map[*client.Client]int64),
+		random:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// wakeChoker fills the free upload slots without waiting for the next round
+func (dsm *DownloadSessionManger) wakeChoker() {
+	select {
+	case dsm.choker.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runChoker chokes and unchokes the peers every round until the session is closed
+func (dsm *DownloadSessionManger) runChoker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dsm.closed:
+			return
+		case <-ticker.C:
+			dsm.chokeRound()
+		case <-dsm.choker.wake:
+			dsm.fillUploadSlots()
+		}
+	}
+}
+
+func (dsm *DownloadSessionManger) uploadSlots() int {
+	if dsm.T.Config.UploadSlots > 0 {
+		return dsm.T.Config.UploadSlots
+	}
+
+	return defaultUploadSlots
+}
+
+// connectedClients returns the peers currently registered with the session, once they were sent
+// the pieces we have. Messages are sent to them without the lock, which a slow peer would hold.
+func (dsm *DownloadSessionManger) connectedClients() []*client.Client {
+	dsm.mu.Lock()
+	defer dsm.mu.Unlock()
+
+	clients := make([]*client.Client, 0, len(dsm.clients))
+
+	for c, announced := range dsm.clients {
+		if announced {
+			clients = append(clients, c)
+		}
+	}
+
+	return clients
+}
+
+func (dsm *DownloadSessionManger) isSeeding() bool {
+	select {
+	case <-dsm.downloadComplete:
+		return true
+	default:
+		return false
+	}
+}
+
+// chokeRound unchokes the interested peers with the best rates over the last round plus the
+// optimistic unchoke, and chokes every other peer
+func (dsm *DownloadSessionManger) chokeRound() {
+	ch := dsm.choker
+	clients := dsm.connectedClients()
+	seeding := dsm.isSeeding()
+
+	rates := make(map[*client.Client]int64, len(clients))
+	transferred := make(map[*client.Client]int64, len(clients))
+
+	for _, c := range clients {
+		total := c.Downloaded.Load()
+
+		if seeding {
+			total = c.Uploaded.Load()
+		}
+
+		// the counters of peers connected during the round start from 0
+		rates[c] = total - ch.transferred[c]
+		transferred[c] = total
+	}
+
+	// disconnected peers are forgotten
+	ch.transferred = transferred
+
+	var interested []*client.Client
+
+	for _, c := range clients {
+		if c.PeerInterested() {
+			interested = append(interested, c)
+		}
+	}
+
+	sort.Slice(interested, func(i, j int) bool {
+		return rates[interested[i]] > rates[interested[j]]
+	})
+
+	unchoke := make(map[*client.Client]bool)
+
+	for i := 0; i < len(interested) && i < dsm.uploadSlots(); i++ {
+		unchoke[interested[i]] = true
+	}
+
+	// the optimistic unchoke rotates every few rounds, or as soon as it leaves, loses interest or
+	// earns a regular slot
+	_, connected := rates[ch.optimistic]
+
+	if !connected || unchoke[ch.optimistic] || !ch.optimistic.PeerInterested() || ch.round%optimisticUnchokeRounds == 0 {
+		ch.optimistic = nil
+
+		var candidates []*client.Client
+
+		for _, c := range interested {
+			if !unchoke[c] {
+				candidates = append(candidates, c)
+			}
+		}
+
+		if len(candidates) > 0 {
+			ch.optimistic = candidates[ch.random.Intn(len(candidates))]
+		}
+	}
+
+	if ch.optimistic != nil {
+		unchoke[ch.optimistic] = true
+	}
+
+	ch.round++
+
+	for _, c := range clients {
+		if unchoke[c] && c.AmChoking() {
+			c.SendUnchokeMsg()
+		} else if !unchoke[c] && !c.AmChoking() {
+			c.SendChokeMsg()
+		}
+	}
+}
+
+// fillUploadSlots unchokes interested peers while fewer peers than the upload slots plus the
+// optimistic unchoke are unchoked, so that new peers do not wait for the next round
+func (dsm *DownloadSessionManger) fillUploadSlots() {
+	clients := dsm.connectedClients()
+
+	unchoked := 0
+
+	for _, c := range clients {
+		if !c.AmChoking() {
+			unchoked++
+		}
+	}
+
+	for _, c := range clients {
+		if unchoked >= dsm.uploadSlots()+1 {
+			return
+		}
+
+		if c.AmChoking() && c.PeerInterested() {
+			c.SendUnchokeMsg()
+			unchoked++
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package p2p
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/message"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+// addTestPeer registers a connected peer which we downloaded the given bytes from, the messages
+// sent to it are discarded
+func addTestPeer(t *testing.T, dsm *DownloadSessionManger, interested bool, downloaded int64) *client.Client {
+	t.Helper()
+
+	conn, other := net.Pipe()
+	c := client.NewFromHandshake(peer.Peer{Address: "peer" + strconv.Itoa(len(dsm.clients))}, &peer.HandshakeResponse{Conn: conn}, nil, 0, false, len(dsm.T.PieceHashes))
+
+	messages := make(chan *client.MessageResult)
+	closeChan := make(chan struct{})
+
+	t.Cleanup(func() {
+		close(closeChan)
+		conn.Close()
+		other.Close()
+	})
+
+	go c.ParsePeerMessage(messages, closeChan)
+
+	if interested {
+		go other.Write((&message.Message{ID: message.InterestedMessageID}).Encode())
+
+		if msg := <-messages; msg.Err != nil || !c.PeerInterested() {
+			t.Fatal("peer did not get interested")
+		}
+	}
+
+	go io.Copy(io.Discard, other)
+
+	c.Downloaded.Add(downloaded)
+	dsm.clients[c] = true
+
+	return c
+}
+
+func newTestChoker(slots int) *DownloadSessionManger {
+	return &DownloadSessionManger{
+		T:       &Torrent{PieceHashes: make([]PieceHash, 4), Config: &Config{UploadSlots: slots}},
+		clients: make(map[*client.Client]bool),
+		choker:  newChoker(),
+	}
+}
+
+func unchokedPeers(clients []*client.Client) int {
+	unchoked := 0
+
+	for _, c := range clients {
+		if !c.AmChoking() {
+			unchoked++
+		}
+	}
+
+	return unchoked
+}
+
+func TestChokeRoundUnchokesFastestPeers(t *testing.T) {
+	dsm := newTestChoker(2)
+
+	var clients []*client.Client
+
+	for _, downloaded := range []int64{100, 500, 200, 400, 300} {
+		clients = append(clients, addTestPeer(t, dsm, true, downloaded))
+	}
+
+	uninterested := addTestPeer(t, dsm, false, 1000)
+
+	dsm.chokeRound()
+
+	if clients[1].AmChoking() || clients[3].AmChoking() {
+		t.Fatal("the fastest peers were not unchoked")
+	}
+
+	if !uninterested.AmChoking() {
+		t.Fatal("uninterested peer unchoked")
+	}
+
+	// the upload slots plus the optimistic unchoke
+	if got := unchokedPeers(clients); got != 3 {
+		t.Fatalf("%d peers unchoked, want 3", got)
+	}
+
+	optimistic := dsm.choker.optimistic
+
+	if optimistic == nil || optimistic == clients[1] || optimistic == clients[3] {
+		t.Fatal("optimistic unchoke not picked among the other interested peers")
+	}
+}
+
+func TestChokeRoundUsesRateOfTheRound(t *testing.T) {
+	dsm := newTestChoker(1)
+
+	slow := addTestPeer(t, dsm, true, 0)
+	fast := addTestPeer(t, dsm, true, 1000)
+
+	dsm.chokeRound()
+
+	if fast.AmChoking() {
+		t.Fatal("fastest peer not unchoked")
+	}
+
+	// the peer which sent the most so far sent nothing during the next round
+	slow.Downloaded.Add(500)
+	dsm.chokeRound()
+
+	if slow.AmChoking() || dsm.choker.optimistic == slow {
+		t.Fatal("peer with the best rate of the round did not get the upload slot")
+	}
+}
+
+func TestChokeRoundForgetsDisconnectedPeers(t *testing.T) {
+	dsm := newTestChoker(1)
+
+	c := addTestPeer(t, dsm, true, 100)
+
+	dsm.chokeRound()
+	delete(dsm.clients, c)
+	dsm.chokeRound()
+
+	if _, ok := dsm.choker.transferred[c]; ok || dsm.choker.optimistic == c {
+		t.Fatal("disconnected peer still tracked by the choker")
+	}
+}
+
+func TestFillUploadSlots(t *testing.T) {
+	dsm := newTestChoker(2)
+
+	var clients []*client.Client
+
+	for i := 0; i < 5; i++ {
+		clients = append(clients, addTestPeer(t, dsm, true, 0))
+	}
+
+	uninterested := addTestPeer(t, dsm, false, 0)
+
+	dsm.fillUploadSlots()
+
+	if got := unchokedPeers(clients); got != 3 {
+		t.Fatalf("%d peers unchoked, want the 2 slots and the optimistic unchoke", got)
+	}
+
+	if !uninterested.AmChoking() {
+		t.Fatal("uninterested peer unchoked")
+	}
+
+	dsm.fillUploadSlots()
+
+	if got := unchokedPeers(clients); got != 3 {
+		t.Fatalf("%d peers unchoked after the slots were full", got)
+	}
+}
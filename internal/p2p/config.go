@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/dht"
+	"github.com/OmBudhiraja/torrent-client/internal/lsd"
+	"github.com/OmBudhiraja/torrent-client/internal/mse"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+	"github.com/OmBudhiraja/torrent-client/internal/utp"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
+)
+
+// PeerSource finds the peers of a torrent without the help of its trackers. Run looks for peers
+// until the context is cancelled, announcing that we accept peers on port unless it is 0.
+type PeerSource interface {
+	Run(ctx context.Context, infoHash [20]byte, port int, onPeers func([]peer.Peer))
+}
+
+// Config holds the client wide settings that every torrent download shares
+type Config struct {
+	PeerId []byte
+	// Port is the port announced to trackers on which Listener accepts peers
+	Port int
+	// Listener accepts incoming peer connections, nil disables them
+	Listener *Listener
+	// DHT finds peers without the help of trackers, nil disables it
+	DHT *dht.DHT
+	// LSD finds peers on the local network, nil disables it
+	LSD *lsd.LSD
+	// StartDHT and StartLSD create DHT and LSD the first time the peer sources are needed, so that
+	// downloading a private torrent never joins them. Nil leaves DHT and LSD as they are.
+	StartDHT func() (*dht.DHT, error)
+	StartLSD func() (*lsd.LSD, error)
+	// Encryption decides which peer connections go through the encrypted handshake
+	Encryption mse.Policy
+	// UTP connects to and accepts peers over utp, nil only uses tcp
+	UTP *utp.Socket
+
+	// Files picks the files to download from multi-file torrents, nil downloads all of them
+	Files *FileSelection
+	// Priorities decides in which order the pieces are downloaded, nil downloads them rarest first
+	Priorities *Priorities
+
+	// MaxPeers is the maximum number of peers connected at the same time, 0 uses 50
+	MaxPeers int
+	// StallTimeout fails a download when no data arrives for this long, 0 waits forever
+	StallTimeout time.Duration
+	// IsolateCorrupt downloads the pieces which failed their hash check again from other peers than
+	// the ones which sent them, when other peers have them, so that the corrupt blocks are pinned
+	// on the peer which sent them sooner
+	IsolateCorrupt bool
+	// UploadSlots is the number of peers we upload to besides the optimistic unchoke, 0 uses 4
+	UploadSlots int
+
+	// DownloadLimit and UploadLimit cap the transfer rates of every torrent using the config
+	// together, nil does not limit them
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	// SeedRatio is the upload/download ratio after which seeding stops, 0 disables it
+	SeedRatio float64
+	// SeedTime is the maximum time to keep seeding after the download completes, 0 disables it
+	SeedTime time.Duration
+
+	startSources sync.Once
+}
+
+// PeerLimit returns the maximum number of peers a torrent connects to at the same time
+func (c *Config) PeerLimit() int {
+	if c.MaxPeers > 0 {
+		return c.MaxPeers
+	}
+
+	return defaultMaxPeers
+}
+
+func (c *Config) shouldSeed() bool {
+	return c.SeedRatio > 0 || c.SeedTime > 0
+}
+
+// AnnouncedPort returns the port on which other peers can connect to us, 0 when incoming
+// connections are disabled
+func (c *Config) AnnouncedPort() int {
+	if c.Listener == nil {
+		return 0
+	}
+
+	return c.Port
+}
+
+// Dialer returns how connections to peers are made
+func (c *Config) Dialer() peer.Dialer {
+	return peer.Dialer{Encryption: c.Encryption, UTP: c.UTP}
+}
+
+// LimitConn caps the transfer rates of a peer connection with the limits of the config and the
+// given limits of its torrent
+func (c *Config) LimitConn(conn net.Conn, download, upload *ratelimit.Limiter) net.Conn {
+	return ratelimit.NewConn(conn, []*ratelimit.Limiter{c.DownloadLimit, download}, []*ratelimit.Limiter{c.UploadLimit, upload})
+}
+
+// PeerSources returns the enabled sources of peers besides the trackers, starting them on the
+// first call
+func (c *Config) PeerSources() []PeerSource {
+	c.startSources.Do(c.startPeerSources)
+
+	var sources []PeerSource
+
+	if c.DHT != nil {
+		sources = append(sources, c.DHT)
+	}
+
+	if c.LSD != nil {
+		sources = append(sources, c.LSD)
+	}
+
+	return sources
+}
+
+func (c *Config) startPeerSources() {
+	if c.StartDHT != nil {
+		node, err := c.StartDHT()
+
+		if err != nil {
+			fmt.Printf("Not using the DHT: %s\n", err.Error())
+		} else {
+			c.DHT = node
+		}
+	}
+
+	if c.StartLSD != nil {
+		localDiscovery, err := c.StartLSD()
+
+		if err != nil {
+			fmt.Printf("Not using local service discovery: %s\n", err.Error())
+		} else {
+			c.LSD = localDiscovery
+		}
+	}
+}
+
+// Close stops accepting peers, leaves the DHT and stops local service discovery
+func (c *Config) Close() {
+	// the peer sources are not started once closed
+	c.startSources.Do(func() {})
+
+	// the utp socket is closed last, the dht may share it
+	if c.UTP != nil {
+		defer c.UTP.Close()
+	}
+
+	if c.Listener != nil {
+		c.Listener.Close()
+	}
+
+	if c.DHT != nil {
+		c.DHT.Close()
+	}
+
+	if c.LSD != nil {
+		c.LSD.Close()
+	}
+}
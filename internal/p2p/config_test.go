@@ -0,0 +1,53 @@
+package p2p
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/dht"
+	"github.com/OmBudhiraja/torrent-client/internal/lsd"
+)
+
+// countingConfig returns a config whose peer sources fail to start, counting the attempts
+func countingConfig(starts *int) *Config {
+	return &Config{
+		StartDHT: func() (*dht.DHT, error) {
+			*starts++
+			return nil, errors.New("no network")
+		},
+		StartLSD: func() (*lsd.LSD, error) {
+			*starts++
+			return nil, errors.New("no network")
+		},
+	}
+}
+
+func TestPrivateTorrentDoesNotStartPeerSources(t *testing.T) {
+	starts := 0
+
+	torrent := &Torrent{Config: countingConfig(&starts), Private: true}
+
+	if torrent.usesPeerSources() || starts != 0 {
+		t.Fatalf("private torrent started %d peer sources", starts)
+	}
+
+	torrent.Private = false
+
+	torrent.usesPeerSources()
+	torrent.usesPeerSources()
+
+	if starts != 2 {
+		t.Fatalf("peer sources started %d times, want each once", starts)
+	}
+}
+
+func TestClosedConfigDoesNotStartPeerSources(t *testing.T) {
+	starts := 0
+
+	config := countingConfig(&starts)
+	config.Close()
+
+	if len(config.PeerSources()) != 0 || starts != 0 {
+		t.Fatalf("closed config started %d peer sources", starts)
+	}
+}
@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"bytes"
+	"sync"
+)
+
+const (
+	// a peer which sent blocks of this many pieces which failed their hash check is banned, even
+	// though it may not be the one which sent the corrupt blocks
+	maxHashFailures = 3
+)
+
+// corruption keeps track of the peers which sent blocks of pieces which failed their hash check.
+// The blocks of a failed piece are kept until the piece is verified, comparing them with the
+// verified blocks then tells for sure which peer sent corrupt data.
+type corruption struct {
+	mu sync.Mutex
+	// failed holds the blocks of the last failed download of each piece and who sent them
+	failed map[int]*pieceDownload
+	// strikes counts the failed pieces each host sent blocks of
+	strikes map[string]int
+}
+
+func newCorruption() *corruption {
+	return &corruption{
+		failed:  make(map[int]*pieceDownload),
+		strikes: make(map[string]int),
+	}
+}
+
+// senderHosts returns the hosts of the peers which sent the blocks of a piece, web seeds aside
+func (pd *pieceDownload) senderHosts() []string {
+	seen := make(map[string]bool)
+
+	var hosts []string
+
+	for _, sender := range pd.senders {
+		if sender == "" || seen[peerHost(sender)] {
+			continue
+		}
+
+		seen[peerHost(sender)] = true
+		hosts = append(hosts, peerHost(sender))
+	}
+
+	return hosts
+}
+
+// pieceFailed gives a strike to every peer which sent blocks of a piece which failed its hash
+// check, banning the ones with too many of them, and keeps the blocks to find the culprit once
+// the piece is verified
+func (dsm *DownloadSessionManger) pieceFailed(pd *pieceDownload) {
+	hosts := pd.senderHosts()
+
+	if len(hosts) == 0 {
+		return
+	}
+
+	cr := dsm.corruption
+
+	var banned []string
+
+	cr.mu.Lock()
+
+	cr.failed[pd.work.Index] = pd
+
+	for _, host := range hosts {
+		cr.strikes[host]++
+
+		if cr.strikes[host] >= maxHashFailures {
+			banned = append(banned, host)
+		}
+	}
+
+	cr.mu.Unlock()
+
+	for _, host := range banned {
+		dsm.banPeer(host)
+	}
+
+	if dsm.T.Config.IsolateCorrupt {
+		dsm.Picker.Exclude(pd.work.Index, hosts)
+	}
+}
+
+// pieceVerified compares a verified piece with the blocks of its last failed download, the peers
+// which sent different blocks are banned and the strike of the others is taken back
+func (dsm *DownloadSessionManger) pieceVerified(pd *pieceDownload) {
+	cr := dsm.corruption
+
+	cr.mu.Lock()
+
+	failed, ok := cr.failed[pd.work.Index]
+	delete(cr.failed, pd.work.Index)
+
+	if !ok {
+		cr.mu.Unlock()
+		return
+	}
+
+	culprits := make(map[string]bool)
+
+	for block, data := range failed.blocks {
+		if failed.senders[block] != "" && !bytes.Equal(data, pd.blocks[block]) {
+			culprits[peerHost(failed.senders[block])] = true
+		}
+	}
+
+	for _, host := range failed.senderHosts() {
+		if !culprits[host] && cr.strikes[host] > 0 {
+			cr.strikes[host]--
+		}
+	}
+
+	cr.mu.Unlock()
+
+	for host := range culprits {
+		dsm.banPeer(host)
+	}
+}
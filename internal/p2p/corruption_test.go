@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+)
+
+const (
+	peerA = "10.0.0.1:6881"
+	peerB = "10.0.0.2:6881"
+	peerC = "10.0.0.3:6881"
+)
+
+func newCorruptionSession(n int) (*DownloadSessionManger, *PiecePicker) {
+	dsm := newTestSession(n)
+	dsm.corruption = newCorruption()
+	dsm.Picker, _ = newTestPicker(n)
+
+	return dsm, dsm.Picker
+}
+
+// download picks a piece and fills its two blocks with data from the given senders, then checks
+// it the way a worker does
+func download(dsm *DownloadSessionManger, index int, blocks [2][]byte, senders [2]string, verified bool) {
+	pp := dsm.Picker
+
+	pd := pp.Pick(onlyPiece(len(pp.pieces), index), "")
+
+	for block := range blocks {
+		pp.AddBlock(pd, block, blocks[block], senders[block])
+	}
+
+	pp.Finish(pd, verified)
+	pp.Release(pd)
+
+	if verified {
+		dsm.pieceVerified(pd)
+	} else {
+		dsm.pieceFailed(pd)
+	}
+}
+
+func onlyPiece(n, index int) bitfield.Bitfield {
+	bf := bitfield.New(n)
+	bf.SetPiece(index)
+
+	return bf
+}
+
+func strikes(dsm *DownloadSessionManger, address string) int {
+	dsm.corruption.mu.Lock()
+	defer dsm.corruption.mu.Unlock()
+
+	return dsm.corruption.strikes[peerHost(address)]
+}
+
+var (
+	goodBlock = []byte("good")
+	badBlock  = []byte("bad!")
+)
+
+func TestCulpritBannedOnceThePieceIsVerified(t *testing.T) {
+	dsm, _ := newCorruptionSession(1)
+
+	// B sent the corrupt block, which is not known yet
+	download(dsm, 0, [2][]byte{goodBlock, badBlock}, [2]string{peerA, peerB}, false)
+
+	if strikes(dsm, peerA) != 1 || strikes(dsm, peerB) != 1 {
+		t.Fatal("senders of the failed piece did not get a strike")
+	}
+
+	if dsm.peers.isBanned(peerA) || dsm.peers.isBanned(peerB) {
+		t.Fatal("peer banned after a single failed piece")
+	}
+
+	download(dsm, 0, [2][]byte{goodBlock, goodBlock}, [2]string{peerC, peerC}, true)
+
+	if !dsm.peers.isBanned(peerB) {
+		t.Fatal("peer which sent a corrupt block not banned")
+	}
+
+	if dsm.peers.isBanned(peerA) || strikes(dsm, peerA) != 0 {
+		t.Fatal("strike of the peer which sent a good block not taken back")
+	}
+
+	if dsm.peers.isBanned(peerC) || strikes(dsm, peerC) != 0 {
+		t.Fatal("peer which completed the piece punished")
+	}
+}
+
+func TestBanAfterTooManyFailedPieces(t *testing.T) {
+	dsm, _ := newCorruptionSession(maxHashFailures)
+
+	for i := 0; i < maxHashFailures; i++ {
+		if dsm.peers.isBanned(peerA) {
+			t.Fatalf("peer banned after %d failed pieces", i)
+		}
+
+		download(dsm, i, [2][]byte{badBlock, badBlock}, [2]string{peerA, peerA}, false)
+	}
+
+	if !dsm.peers.isBanned(peerA) {
+		t.Fatalf("peer not banned after %d failed pieces", maxHashFailures)
+	}
+}
+
+func TestStrikeTakenBackKeepsPeer(t *testing.T) {
+	dsm, _ := newCorruptionSession(maxHashFailures)
+
+	// A shares every failed piece with the peer which corrupts them, and is cleared each time
+	for i := 0; i < maxHashFailures; i++ {
+		download(dsm, i, [2][]byte{goodBlock, badBlock}, [2]string{peerA, peerB}, false)
+		download(dsm, i, [2][]byte{goodBlock, goodBlock}, [2]string{peerC, peerC}, true)
+	}
+
+	if dsm.peers.isBanned(peerA) || strikes(dsm, peerA) != 0 {
+		t.Fatal("peer which only sent good blocks banned")
+	}
+}
+
+func TestWebSeedBlocksGiveNoStrike(t *testing.T) {
+	dsm, _ := newCorruptionSession(1)
+
+	download(dsm, 0, [2][]byte{badBlock, badBlock}, [2]string{"", ""}, false)
+
+	dsm.corruption.mu.Lock()
+	defer dsm.corruption.mu.Unlock()
+
+	if len(dsm.corruption.strikes) != 0 || len(dsm.corruption.failed) != 0 {
+		t.Fatal("blocks from web seeds counted against peers")
+	}
+}
+
+func TestIsolateCorruptPiece(t *testing.T) {
+	dsm, pp := newCorruptionSession(1)
+	dsm.T.Config.IsolateCorrupt = true
+
+	// A, B and C have the piece
+	pp.PeerHas(0)
+	pp.PeerHas(0)
+
+	download(dsm, 0, [2][]byte{goodBlock, badBlock}, [2]string{peerA, peerB}, false)
+
+	all := onlyPiece(1, 0)
+
+	if pp.Pick(all, peerHost(peerA)) != nil || pp.Pick(all, peerHost(peerB)) != nil {
+		t.Fatal("failed piece handed again to the peers which sent it")
+	}
+
+	if pp.Pick(all, peerHost(peerC)) == nil {
+		t.Fatal("failed piece not handed to another peer")
+	}
+}
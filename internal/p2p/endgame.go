@@ -0,0 +1,66 @@
+package p2p
+
+import (
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+)
+
+// pickEndgame hands out a piece which is already being downloaded by other peers, so that the
+// last pieces are not stuck on slow peers. Whichever peer delivers a block first wins and the
+// others cancel their request for it. Pieces skipped since they were picked are left to the peers
+// already on them, as are pieces the host is excluded from. Must be called with the lock held.
+func (pp *PiecePicker) pickEndgame(bf bitfield.Bitfield, host string) *pieceDownload {
+	var picked *pieceDownload
+
+	for index, pd := range pp.inProgress {
+		if pd.complete || !bf.HasPiece(index) || pp.priority[index] == PrioritySkip || pp.isExcluded(index, host) {
+			continue
+		}
+
+		// spread the peers evenly over the remaining pieces
+		if picked == nil || pd.workers < picked.workers {
+			picked = pd
+		}
+	}
+
+	if picked != nil {
+		picked.workers++
+	}
+
+	return picked
+}
+
+// inEndgame tells if every piece left to download is in progress
+func (pp *PiecePicker) inEndgame() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.missingCount() == 0
+}
+
+// cancelReceived cancels the requests that another peer has already delivered the block for
+func (w *worker) cancelReceived() error {
+	for _, a := range w.active {
+		for block := range a.requested {
+			if !w.dsm.Picker.hasBlock(a.pd, block) {
+				continue
+			}
+
+			err := w.cancelBlock(a.pd, block)
+
+			if err != nil {
+				return err
+			}
+
+			delete(a.requested, block)
+			w.outstanding--
+		}
+	}
+
+	return nil
+}
+
+func (w *worker) cancelBlock(pd *pieceDownload, block int) error {
+	begin, length := pd.blockRange(block)
+
+	return w.c.SendCancelMsg(pd.work.Index, begin, length)
+}
@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+)
+
+// MerkleBlockSize is the size of the leaves of the merkle trees of v2 torrents
+const MerkleBlockSize = 16384
+
+// PieceHash is what a downloaded piece is checked against, the sha1 hash of the piece for v1
+// torrents or the root of the sha256 merkle tree of its blocks for v2 torrents, as described
+// in BEP 52
+type PieceHash struct {
+	Sha1 [20]byte
+	// Root is nil for v1 torrents
+	Root *MerkleRoot
+}
+
+type MerkleRoot struct {
+	Hash [32]byte
+	// Leaves is the width of the tree, the blocks of the piece followed by zero hashes
+	Leaves int
+}
+
+// V1PieceHashes wraps the sha1 hashes of the pieces of a v1 torrent
+func V1PieceHashes(hashes [][20]byte) []PieceHash {
+	pieceHashes := make([]PieceHash, len(hashes))
+
+	for i, hash := range hashes {
+		pieceHashes[i] = PieceHash{Sha1: hash}
+	}
+
+	return pieceHashes
+}
+
+// Verify checks the data of a piece against its hash
+func (h PieceHash) Verify(data []byte) bool {
+	if h.Root == nil {
+		hash := sha1.Sum(data)
+		return bytes.Equal(hash[:], h.Sha1[:])
+	}
+
+	root := MerkleRootOf(data, h.Root.Leaves)
+
+	return root == h.Root.Hash
+}
+
+// MerkleRootOf computes the root of the merkle tree of the sha256 hashes of the 16 KiB blocks of
+// data, the tree is padded with zero hashes up to the given number of leaves
+func MerkleRootOf(data []byte, leaves int) [32]byte {
+	hashes := make([][32]byte, 0, leaves)
+
+	for begin := 0; begin < len(data); begin += MerkleBlockSize {
+		end := min(begin+MerkleBlockSize, len(data))
+		hashes = append(hashes, sha256.Sum256(data[begin:end]))
+	}
+
+	return MerkleRootOfHashes(hashes, leaves, [32]byte{})
+}
+
+// MerkleRootOfHashes computes the root of a merkle tree from one of its layers, padded with the
+// pad hash up to the given width, which must be a power of two
+func MerkleRootOfHashes(hashes [][32]byte, width int, pad [32]byte) [32]byte {
+	layer := make([][32]byte, width)
+
+	for i := range layer {
+		if i < len(hashes) {
+			layer[i] = hashes[i]
+		} else {
+			layer[i] = pad
+		}
+	}
+
+	for len(layer) > 1 {
+		next := make([][32]byte, len(layer)/2)
+
+		for i := range next {
+			next[i] = sha256.Sum256(append(layer[2*i][:], layer[2*i+1][:]...))
+		}
+
+		layer = next
+	}
+
+	return layer[0]
+}
+
+// ZeroSubtreeRoot returns the root of a tree of the given width made of zero hashes only, which
+// pads the upper layers of a merkle tree
+func ZeroSubtreeRoot(width int) [32]byte {
+	return MerkleRootOfHashes(nil, width, [32]byte{})
+}
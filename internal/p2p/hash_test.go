@@ -0,0 +1,102 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+)
+
+func hashPair(a, b [32]byte) [32]byte {
+	return sha256.Sum256(append(a[:], b[:]...))
+}
+
+func TestVerifyV1(t *testing.T) {
+	data := []byte("some piece data")
+	hash := PieceHash{Sha1: sha1.Sum(data)}
+
+	if !hash.Verify(data) {
+		t.Fatal("piece does not match its own hash")
+	}
+
+	if hash.Verify([]byte("other piece data")) {
+		t.Fatal("other piece matches the hash")
+	}
+}
+
+func TestMerkleRootOf(t *testing.T) {
+	data := bytes.Repeat([]byte{1}, 2*MerkleBlockSize+100)
+
+	first := sha256.Sum256(data[:MerkleBlockSize])
+	second := sha256.Sum256(data[MerkleBlockSize : 2*MerkleBlockSize])
+	third := sha256.Sum256(data[2*MerkleBlockSize:])
+
+	// three blocks padded with a zero hash up to four leaves
+	want := hashPair(hashPair(first, second), hashPair(third, [32]byte{}))
+
+	if got := MerkleRootOf(data, 4); got != want {
+		t.Fatalf("root is %x, want %x", got, want)
+	}
+
+	// eight leaves pad the tree with a zero subtree of width four
+	want = hashPair(want, ZeroSubtreeRoot(4))
+
+	if got := MerkleRootOf(data, 8); got != want {
+		t.Fatalf("root of wider tree is %x, want %x", got, want)
+	}
+}
+
+func TestMerkleRootOfSingleBlock(t *testing.T) {
+	data := []byte("short file")
+
+	if got, want := MerkleRootOf(data, 1), sha256.Sum256(data); got != want {
+		t.Fatalf("root of a single block is %x, want its hash %x", got, want)
+	}
+}
+
+func TestZeroSubtreeRoot(t *testing.T) {
+	if got := ZeroSubtreeRoot(1); got != [32]byte{} {
+		t.Fatalf("zero subtree of width 1 is %x", got)
+	}
+
+	zero := [32]byte{}
+	want := hashPair(hashPair(zero, zero), hashPair(zero, zero))
+
+	if got := ZeroSubtreeRoot(4); got != want {
+		t.Fatalf("zero subtree of width 4 is %x, want %x", got, want)
+	}
+}
+
+func TestMerkleRootOfHashesPad(t *testing.T) {
+	leaves := [][32]byte{sha256.Sum256([]byte("a")), sha256.Sum256([]byte("b")), sha256.Sum256([]byte("c"))}
+	pad := ZeroSubtreeRoot(2)
+
+	want := hashPair(hashPair(leaves[0], leaves[1]), hashPair(leaves[2], pad))
+
+	if got := MerkleRootOfHashes(leaves, 4, pad); got != want {
+		t.Fatalf("root is %x, want %x", got, want)
+	}
+}
+
+func TestVerifyV2(t *testing.T) {
+	data := bytes.Repeat([]byte("v2"), MerkleBlockSize+10)
+	hash := PieceHash{Root: &MerkleRoot{Hash: MerkleRootOf(data, 4), Leaves: 4}}
+
+	if !hash.Verify(data) {
+		t.Fatal("piece does not match its own merkle root")
+	}
+
+	corrupted := append([]byte(nil), data...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	if hash.Verify(corrupted) {
+		t.Fatal("corrupted piece matches the merkle root")
+	}
+
+	// the width of the tree is part of the root
+	hash.Root.Leaves = 2
+
+	if hash.Verify(data) {
+		t.Fatal("piece matches a root of a different width")
+	}
+}
@@ -0,0 +1,152 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/mse"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+const (
+	inboundHandshakeTimeout = 10 * time.Second
+)
+
+// Listener accepts incoming peer connections and hands them to the torrent they asked for
+type Listener struct {
+	ln         net.Listener
+	peerId     []byte
+	encryption mse.Policy
+
+	mu       sync.Mutex
+	sessions map[[20]byte]*DownloadSessionManger
+}
+
+// Listen starts accepting peer connections on the given port, 0 picks any free port.
+// Encrypted and plaintext connections are accepted as allowed by the encryption policy.
+func Listen(port int, peerId []byte, encryption mse.Policy) (*Listener, error) {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %s", err.Error())
+	}
+
+	l := &Listener{
+		ln:         ln,
+		peerId:     peerId,
+		encryption: encryption,
+		sessions:   make(map[[20]byte]*DownloadSessionManger),
+	}
+
+	go l.serve(ln)
+
+	return l, nil
+}
+
+// Serve also accepts the peer connections of ln, such as a utp socket listening on the same
+// port number
+func (l *Listener) Serve(ln net.Listener) {
+	go l.serve(ln)
+}
+
+// Port returns the port on which the listener is accepting connections
+func (l *Listener) Port() int {
+	return l.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (l *Listener) Close() error {
+	return l.ln.Close()
+}
+
+func (l *Listener) register(dsm *DownloadSessionManger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sessions[dsm.T.InfoHash] = dsm
+}
+
+func (l *Listener) unregister(dsm *DownloadSessionManger) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[dsm.T.InfoHash] == dsm {
+		delete(l.sessions, dsm.T.InfoHash)
+	}
+}
+
+func (l *Listener) session(infoHash [20]byte) *DownloadSessionManger {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.sessions[infoHash]
+}
+
+func (l *Listener) infoHashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	infoHashes := make([][20]byte, 0, len(l.sessions))
+
+	for infoHash := range l.sessions {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+func (l *Listener) serve(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			// listener closed
+			return
+		}
+
+		go l.handleConn(conn)
+	}
+}
+
+func (l *Listener) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(inboundHandshakeTimeout))
+
+	encryptedConn, err := mse.Accept(conn, l.encryption, l.infoHashes)
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	handshakeRes, err := peer.AcceptHandshake(encryptedConn, l.peerId, func(infoHash [20]byte) bool {
+		return l.session(infoHash) != nil
+	})
+
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	dsm := l.session(handshakeRes.InfoHash)
+
+	if dsm == nil {
+		// torrent was removed while completing the handshake
+		conn.Close()
+		return
+	}
+
+	remotePeer := peer.Peer{Address: conn.RemoteAddr().String()}
+
+	if !dsm.acceptsInbound(remotePeer.Address) {
+		conn.Close()
+		return
+	}
+	peerClient := client.NewFromHandshake(remotePeer, handshakeRes, l.peerId, l.Port(), dsm.T.Private, len(dsm.T.PieceHashes))
+	peerClient.Inbound = true
+
+	dsm.T.runClient(peerClient, dsm)
+}
@@ -1,36 +1,72 @@
 package p2p
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+	"github.com/OmBudhiraja/torrent-client/internal/client"
 	"github.com/OmBudhiraja/torrent-client/internal/peer"
+	"github.com/OmBudhiraja/torrent-client/internal/tracker"
 	"github.com/OmBudhiraja/torrent-client/pkg/progressbar"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
 )
 
 const (
 	maxBlockSize = 16384
-	maxBacklog   = 5
 )
 
 type Torrent struct {
 	Name        string
 	Peers       []peer.Peer
 	InfoHash    [20]byte
-	PieceHashes [][20]byte
+	PieceHashes []PieceHash
 	PieceLength int
-	Length      int
-	PeerId      []byte
-	Files       []File
-	Outpath     string
+	// PieceLengths holds the length of every piece of v2 torrents, whose pieces end with their
+	// file. Nil when only the last piece of the torrent is shorter than PieceLength.
+	PieceLengths []int
+	Length       int
+	Files        []File
+	Outpath      string
+	Config       *Config
+	// Announcer finds peers from the trackers of the torrent, nil if it has none
+	Announcer *tracker.Announcer
+	// Private torrents only get their peers from their trackers, as described in BEP 27
+	Private bool
+	// WebSeeds are the urls of http mirrors of the torrent
+	WebSeeds []string
+	// Selection picks the files to download from a multi-file torrent, nil downloads all of them
+	Selection *FileSelection
+	// Priorities decides in which order the pieces are downloaded, nil downloads every selected
+	// piece rarest first
+	Priorities *Priorities
+	// DownloadLimit and UploadLimit cap the transfer rates of the torrent on top of the limits of
+	// its config, nil does not limit them
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
 }
 
 type File struct {
 	Length int
 	Path   string
+	// Padding files align the next file on a piece boundary, they are made of zeros and never
+	// written to disk, as described in BEP 47
+	Padding bool
 }
 
 type OutputFile struct {
+	// path of the file within the torrent, empty for single file torrents
+	path    string
+	padding bool
+	// unselected files are not created, the parts of them shared with the pieces of selected
+	// files are kept in the parts file of the torrent instead, at offset
+	unselected bool
+	offset     int
 	length     int
 	startRange int
 	endRange   int
@@ -38,85 +74,185 @@ type OutputFile struct {
 }
 
 type DownloadSessionManger struct {
-	WorkQueue      chan *PieceWork
+	Picker         *PiecePicker
 	Results        chan *PieceResult
 	Outfiles       []*OutputFile
 	PieceToFileMap map[int][]*OutputFile
 	T              *Torrent
+
+	// Bitfield holds the pieces that have been verified and written to disk
+	Bitfield bitfield.Bitfield
+	// wanted holds the pieces overlapping the selected files
+	wanted bitfield.Bitfield
+	// Done is closed once the session is over and the workers should disconnect
+	Done     chan struct{}
+	doneOnce sync.Once
+
+	mu sync.Mutex
+	// clients are the connected peers, true once they were sent the pieces we have
+	clients map[*client.Client]bool
+	peers   *peerManager
+	// pexSent holds the peers each connected peer has been told about through peer exchange
+	pexSent          map[*client.Client]map[string]bool
+	uploaded         atomic.Int64
+	downloaded       atomic.Int64
+	downloadComplete chan struct{}
+	lastResumeSave   time.Time
+	// lastProgress is the time in unix nanoseconds when data last arrived for the session
+	lastProgress atomic.Int64
+	// closed is closed once the session is closed, to stop its background tasks
+	closed chan struct{}
+	choker *choker
+	// corruption tracks the peers which sent blocks of pieces which failed their hash check
+	corruption *corruption
 }
 
 func (t *Torrent) Initiate() (*DownloadSessionManger, error) {
 
-	workQueue := make(chan *PieceWork, len(t.PieceHashes))
-	results := make(chan *PieceResult)
+	outfiles, err := t.openOutputFiles(openOutputFile)
 
-	isMultifile := len(t.Files) > 0
+	if err != nil {
+		return nil, err
+	}
 
-	var outfiles []*OutputFile
+	pieceToFileMap := t.mapPiecesToFiles(outfiles)
 
-	if isMultifile {
-		outfiles = make([]*OutputFile, len(t.Files))
-		for index, file := range t.Files {
-			path := filepath.Join(t.Outpath, t.Name, file.Path)
-			err := os.MkdirAll(filepath.Dir(path), 0755)
+	pieces := make([]*PieceWork, len(t.PieceHashes))
 
-			if err != nil {
-				return nil, err
-			}
+	for i, pieceHash := range t.PieceHashes {
+		pieces[i] = &PieceWork{
+			Index:  i,
+			Length: t.getPieceLength(i),
+			Hash:   pieceHash,
+		}
+	}
 
-			outfile, err := os.Create(path)
+	dsm := &DownloadSessionManger{
+		Picker:           NewPiecePicker(pieces),
+		Results:          make(chan *PieceResult),
+		Outfiles:         outfiles,
+		PieceToFileMap:   pieceToFileMap,
+		T:                t,
+		Bitfield:         bitfield.New(len(t.PieceHashes)),
+		wanted:           bitfield.New(len(t.PieceHashes)),
+		Done:             make(chan struct{}),
+		clients:          make(map[*client.Client]bool),
+		peers:            newPeerManager(),
+		pexSent:          make(map[*client.Client]map[string]bool),
+		downloadComplete: make(chan struct{}),
+		closed:           make(chan struct{}),
+		choker:           newChoker(),
+		corruption:       newCorruption(),
+	}
 
-			if err != nil {
-				return nil, err
-			}
+	dsm.lastProgress.Store(time.Now().UnixNano())
 
-			startRange := 0
+	// only the pieces overlapping a selected file are downloaded
+	dsm.applyPriorities()
 
-			if index > 0 {
-				startRange = outfiles[index-1].endRange
-			}
+	err = dsm.resume()
 
-			outfiles[index] = &OutputFile{
-				length:     file.Length,
-				file:       outfile,
-				startRange: startRange,
-				endRange:   startRange + file.Length,
-			}
+	if err != nil {
+		dsm.CloseFiles()
+		return nil, err
+	}
+
+	if t.Priorities != nil {
+		go dsm.watchPriorities()
+	}
+
+	go dsm.runChoker()
+	go dsm.runPeerManager()
+
+	if t.Config.Listener != nil {
+		t.Config.Listener.register(dsm)
+	}
+
+	// private torrents only get their peers from their trackers
+	if !t.Private {
+		go dsm.runPex()
+	}
+
+	return dsm, nil
+}
+
+// openOutputFiles lays out the files of the torrent one after the other, opening each of them with open
+func (t *Torrent) openOutputFiles(open func(path string) (*os.File, error)) ([]*OutputFile, error) {
+	files := t.Files
+
+	// a single file torrent is stored directly under its name
+	if len(files) == 0 {
+		files = []File{{Length: t.Length}}
+	}
+
+	selected, err := t.selectedFiles()
+
+	if err != nil {
+		return nil, err
+	}
+
+	outfiles := make([]*OutputFile, len(files))
 
+	var partsFile *os.File
+
+	for index, file := range files {
+		var outfile *os.File
+
+		startRange := 0
+
+		if index > 0 {
+			startRange = outfiles[index-1].endRange
 		}
 
-	} else {
-		outfiles = make([]*OutputFile, 1)
-		// check if outpath directory exists
-		if _, err := os.Stat(t.Outpath); os.IsNotExist(err) {
-			err := os.MkdirAll(t.Outpath, 0755)
+		unselected := selected != nil && !file.Padding && !selected[index]
+		offset := 0
 
-			if err != nil {
-				return nil, err
+		switch {
+		case file.Padding:
+		case unselected:
+			if partsFile == nil {
+				partsFile, err = open(t.partsFilePath())
 			}
-		}
 
-		filePath := filepath.Join(t.Outpath, t.Name)
-		outfile, err := os.Create(filePath)
+			// the parts file is sparse, holding data at the position it has in the torrent
+			outfile = partsFile
+			offset = startRange
+		default:
+			outfile, err = open(filepath.Join(t.Outpath, t.Name, file.Path))
+		}
 
 		if err != nil {
+			closeOutputFiles(outfiles[:index])
 			return nil, err
 		}
 
-		outfiles[0] = &OutputFile{
+		outfiles[index] = &OutputFile{
+			path:       file.Path,
+			padding:    file.Padding,
+			unselected: unselected,
+			offset:     offset,
+			length:     file.Length,
 			file:       outfile,
-			startRange: 0,
-			endRange:   t.Length,
-			length:     t.Length,
+			startRange: startRange,
+			endRange:   startRange + file.Length,
 		}
-
 	}
 
-	// store a map of each piece index to the files that it belongs to
+	return outfiles, nil
+}
+
+// partsFilePath is where the parts of unselected files shared with the pieces of selected files
+// are kept
+func (t *Torrent) partsFilePath() string {
+	return filepath.Join(t.Outpath, t.Name+".parts")
+}
+
+// mapPiecesToFiles returns a map of each piece index to the files that it belongs to
+func (t *Torrent) mapPiecesToFiles(outfiles []*OutputFile) map[int][]*OutputFile {
 	pieceToFileMap := make(map[int][]*OutputFile)
 	lastFileIndex := 0
 
-	for i, pieceHash := range t.PieceHashes {
+	for i := range t.PieceHashes {
 		pieceLength := t.getPieceLength(i)
 
 		pieceStartOffset := i * t.PieceLength
@@ -140,63 +276,198 @@ func (t *Torrent) Initiate() (*DownloadSessionManger, error) {
 				break
 			}
 		}
+	}
 
-		workQueue <- &PieceWork{
-			Index:  i,
-			Length: pieceLength,
-			Hash:   pieceHash,
-		}
+	return pieceToFileMap
+}
 
+// openOutputFile opens a file for reading and writing without truncating it, so that
+// the data of an interrupted download can be resumed
+func openOutputFile(path string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+
+	if err != nil {
+		return nil, err
 	}
 
-	return &DownloadSessionManger{
-		WorkQueue:      workQueue,
-		Results:        results,
-		Outfiles:       outfiles,
-		PieceToFileMap: pieceToFileMap,
-	}, nil
+	return os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
 }
 
-func (t *Torrent) Download() error {
+func (t *Torrent) Download(ctx context.Context) error {
 
-	progressbar := progressbar.New(len(t.PieceHashes))
+	dsm, err := t.Initiate()
 
-	progressbar.Start()
-	defer progressbar.Finish()
+	if err != nil {
+		return err
+	}
 
-	dsm, err := t.Initiate()
+	defer dsm.Close()
+
+	if t.Announcer != nil && !t.Announcer.Started() {
+		fmt.Printf("Waiting for peers...")
+		peers, err := t.Announcer.Announce(tracker.EventStarted, dsm.Stats())
+
+		if err != nil {
+			fmt.Println()
+
+			// the announcer keeps trying while the other sources look for peers
+			if !t.usesPeerSources() && len(t.WebSeeds) == 0 {
+				return err
+			}
+		} else {
+			fmt.Printf("\rFound %d peers           \n", len(peers))
+		}
+
+		t.Peers = append(t.Peers, peers...)
+	}
+
+	if len(t.Peers) == 0 && !t.usesPeerSources() && len(t.WebSeeds) == 0 {
+		return fmt.Errorf("no peers found")
+	}
+
+	stopAnnouncer := dsm.StartAnnouncer(ctx)
+	defer stopAnnouncer()
+
+	stopPeerSources := dsm.StartPeerSources(ctx)
+	defer stopPeerSources()
+
+	stopWebSeeds := dsm.StartWebSeeds(ctx)
+	defer stopWebSeeds()
+
+	dsm.AddPeers(t.Peers)
+
+	err = dsm.WaitForCompletion(ctx)
 
 	if err != nil {
 		return err
 	}
 
-	defer dsm.CloseFiles()
+	dsm.Seed(ctx)
+
+	return nil
+}
+
+// WaitForCompletion writes the downloaded pieces to disk until every piece which is not skipped is
+// present or the context is cancelled
+func (dsm *DownloadSessionManger) WaitForCompletion(ctx context.Context) error {
+	t := dsm.T
+
+	wanted, _ := dsm.wantedPieces()
+
+	progressbar := progressbar.New(wanted)
+
+	progressbar.Start()
+	defer progressbar.Finish()
+
+	var stalled <-chan time.Time
 
-	for _, peer := range t.Peers {
-		go t.StartWorker(peer, dsm.WorkQueue, dsm.Results)
+	if t.Config.StallTimeout > 0 {
+		ticker := time.NewTicker(stallCheckInterval(t.Config.StallTimeout))
+		defer ticker.Stop()
+
+		// no data arriving since the session started counts as well
+		dsm.lastProgress.Store(time.Now().UnixNano())
+		stalled = ticker.C
 	}
 
-	var piecesDownloaded int
+	for {
+		// grab the channel first so that no change of priorities is missed
+		changed := dsm.Picker.Changed()
+
+		// the wanted pieces change along with the priorities
+		wanted, piecesDownloaded := dsm.wantedPieces()
 
-	for piecesDownloaded < len(t.PieceHashes) {
-		piece := <-dsm.Results
-		piecesDownloaded++
+		progressbar.SetTotal(wanted)
+		progressbar.Update(piecesDownloaded)
+
+		if piecesDownloaded == wanted {
+			break
+		}
 
-		err = piece.WriteToFiles(dsm.PieceToFileMap[piece.Index], t.PieceLength)
+		var piece *PieceResult
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+			continue
+		case <-stalled:
+			err := dsm.checkStalled()
+
+			if err != nil {
+				return err
+			}
+
+			continue
+		case piece = <-dsm.Results:
+		}
+
+		dsm.downloaded.Add(int64(piece.Length))
+		dsm.lastProgress.Store(time.Now().UnixNano())
+
+		err := piece.WriteToFiles(dsm.PieceToFileMap[piece.Index], t.PieceLength)
 
 		if err != nil {
 			return err
 		}
 
-		progressbar.Update(piecesDownloaded)
+		dsm.markPieceDone(piece.Index)
+
+		if time.Since(dsm.lastResumeSave) > resumeSaveInterval {
+			// best effort, the pieces are checked again if the state is out of date
+			dsm.SaveResumeState()
+		}
 	}
 
-	close(dsm.WorkQueue)
+	close(dsm.downloadComplete)
 
 	return nil
 }
 
+// stallCheckInterval is how often the progress is checked against the stall timeout
+func stallCheckInterval(timeout time.Duration) time.Duration {
+	return minDuration(time.Second, timeout)
+}
+
+// checkStalled fails the download once no data arrived for longer than the stall timeout
+func (dsm *DownloadSessionManger) checkStalled() error {
+	since := time.Since(time.Unix(0, dsm.lastProgress.Load()))
+
+	if since < dsm.T.Config.StallTimeout {
+		return nil
+	}
+
+	connected, candidates, banned := dsm.peerCounts()
+
+	return fmt.Errorf("download stalled, no data received for %s (%d peers connected, %d known, %d banned)",
+		since.Round(time.Second), connected, candidates, banned)
+}
+
+// wantedPieces returns the number of pieces overlapping the selected files and how many of them
+// have been downloaded
+func (dsm *DownloadSessionManger) wantedPieces() (wanted, done int) {
+	dsm.mu.Lock()
+	defer dsm.mu.Unlock()
+
+	for i := range dsm.T.PieceHashes {
+		if !dsm.wanted.HasPiece(i) {
+			continue
+		}
+
+		wanted++
+
+		if dsm.Bitfield.HasPiece(i) {
+			done++
+		}
+	}
+
+	return wanted, done
+}
+
 func (t *Torrent) getPieceLength(pieceIndex int) int {
+	if t.PieceLengths != nil {
+		return t.PieceLengths[pieceIndex]
+	}
 
 	length := t.PieceLength
 
@@ -207,8 +478,52 @@ func (t *Torrent) getPieceLength(pieceIndex int) int {
 	return length
 }
 
-func (dsm *DownloadSessionManger) CloseFiles() {
-	for _, file := range dsm.Outfiles {
-		file.file.Close()
+// end tells the workers to disconnect, when the session is over or closed before
+func (dsm *DownloadSessionManger) end() {
+	dsm.doneOnce.Do(func() {
+		close(dsm.Done)
+	})
+}
+
+// Close stops accepting peers for the session, saves the resume state and closes its files
+func (dsm *DownloadSessionManger) Close() error {
+	// the workers may still be running when the download failed
+	dsm.end()
+	close(dsm.closed)
+
+	if dsm.T.Config.Listener != nil {
+		dsm.T.Config.Listener.unregister(dsm)
 	}
+
+	// best effort, the next run starts over if the state cannot be saved
+	dsm.SaveResumeState()
+
+	return dsm.CloseFiles()
+}
+
+func (dsm *DownloadSessionManger) CloseFiles() error {
+	return closeOutputFiles(dsm.Outfiles)
+}
+
+// closeOutputFiles closes each file once, the parts file is shared by every unselected file,
+// and returns the first error
+func closeOutputFiles(outfiles []*OutputFile) error {
+	closed := make(map[*os.File]bool)
+
+	var firstErr error
+
+	for _, outfile := range outfiles {
+		// files missing from disk are never opened when verifying, and padding files never are
+		if outfile.file == nil || closed[outfile.file] {
+			continue
+		}
+
+		closed[outfile.file] = true
+
+		if err := outfile.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
 }
@@ -0,0 +1,306 @@
+package p2p
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+const (
+	defaultMaxPeers = 50
+	// how often the peer manager looks for peers to connect to
+	peerManagerInterval = time.Second
+	// failed peers are retried after this long, doubling with each failure in a row
+	peerRetryInterval    = 30 * time.Second
+	maxPeerRetryInterval = 10 * time.Minute
+	// peers failing this many times in a row are banned
+	maxPeerFailures = 5
+)
+
+// peerManager owns the peers known to a session, it connects to them up to the maximum number of
+// peers, retries the ones which failed with a backoff and bans the ones which keep failing
+type peerManager struct {
+	mu         sync.Mutex
+	candidates map[string]*candidate
+	// banned holds the ip addresses of the peers we refuse to talk to
+	banned map[string]bool
+	// outbound is the number of connections we opened which are still running
+	outbound int
+	wake     chan struct{}
+}
+
+type candidate struct {
+	peer      peer.Peer
+	connected bool
+	failures  int
+	retryAt   time.Time
+}
+
+func newPeerManager() *peerManager {
+	return &peerManager{
+		candidates: make(map[string]*candidate),
+		banned:     make(map[string]bool),
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// peerHost returns the ip address of a peer, which is what bans apply to
+func peerHost(address string) string {
+	host, _, err := net.SplitHostPort(address)
+
+	if err != nil {
+		return address
+	}
+
+	return host
+}
+
+func (dsm *DownloadSessionManger) maxPeers() int {
+	return dsm.T.Config.PeerLimit()
+}
+
+// AddPeers adds the peers that the session has not seen yet to the candidates to connect to
+func (dsm *DownloadSessionManger) AddPeers(peers []peer.Peer) {
+	select {
+	case <-dsm.Done:
+		return
+	default:
+	}
+
+	pm := dsm.peers
+
+	pm.mu.Lock()
+
+	for _, p := range peers {
+		if _, ok := pm.candidates[p.Address]; ok || pm.banned[peerHost(p.Address)] {
+			continue
+		}
+
+		pm.candidates[p.Address] = &candidate{peer: p}
+	}
+
+	pm.mu.Unlock()
+
+	select {
+	case pm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// runPeerManager connects to the candidates whenever a connection slot is free, until the
+// session is over
+func (dsm *DownloadSessionManger) runPeerManager() {
+	ticker := time.NewTicker(peerManagerInterval)
+	defer ticker.Stop()
+
+	for {
+		dsm.connectPeers()
+
+		select {
+		case <-dsm.Done:
+			return
+		case <-dsm.closed:
+			return
+		case <-ticker.C:
+		case <-dsm.peers.wake:
+		}
+	}
+}
+
+// connectPeers starts workers for the candidates which are due, the ones which failed the least
+// first, and asks the trackers for more peers when there are not enough of them
+func (dsm *DownloadSessionManger) connectPeers() {
+	pm := dsm.peers
+
+	inbound := dsm.inboundCount()
+
+	pm.mu.Lock()
+
+	free := dsm.maxPeers() - inbound - pm.outbound
+	now := time.Now()
+
+	var ready []*candidate
+
+	for _, c := range pm.candidates {
+		if !c.connected && !now.Before(c.retryAt) {
+			ready = append(ready, c)
+		}
+	}
+
+	sort.Slice(ready, func(i, j int) bool {
+		return ready[i].failures < ready[j].failures
+	})
+
+	for i := 0; i < len(ready) && i < free; i++ {
+		ready[i].connected = true
+		pm.outbound++
+
+		go dsm.T.StartWorker(ready[i].peer, dsm)
+	}
+
+	starving := free > len(ready)
+
+	pm.mu.Unlock()
+
+	if starving && dsm.T.Announcer != nil && !dsm.isSeeding() {
+		dsm.T.Announcer.RequestPeers()
+	}
+}
+
+// adoptPeer accounts for a peer connected before the session started as if the manager had
+// connected to it. It returns false when the peer is banned, already connected or there is no room
+// for it, a peer without room is kept to connect to later.
+func (dsm *DownloadSessionManger) adoptPeer(p peer.Peer) bool {
+	pm := dsm.peers
+
+	inbound := dsm.inboundCount()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.banned[peerHost(p.Address)] {
+		return false
+	}
+
+	c, ok := pm.candidates[p.Address]
+
+	if ok && c.connected {
+		return false
+	}
+
+	if !ok {
+		c = &candidate{peer: p}
+		pm.candidates[p.Address] = c
+	}
+
+	if inbound+pm.outbound >= dsm.maxPeers() {
+		return false
+	}
+
+	c.connected = true
+	pm.outbound++
+
+	return true
+}
+
+// peerDisconnected is called when the connection to a candidate ends, a peer which exchanged no
+// data failed and is retried later, or banned if it keeps failing
+func (dsm *DownloadSessionManger) peerDisconnected(address string, useful bool) {
+	pm := dsm.peers
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	c, ok := pm.candidates[address]
+
+	// only the connections the manager accounts for free a slot
+	if !ok || !c.connected {
+		return
+	}
+
+	pm.outbound--
+	c.connected = false
+
+	// the peer was banned while connected
+	if pm.banned[peerHost(address)] {
+		delete(pm.candidates, address)
+		return
+	}
+
+	if useful {
+		c.failures = 0
+		c.retryAt = time.Now().Add(peerRetryInterval)
+		return
+	}
+
+	c.failures++
+
+	if c.failures >= maxPeerFailures {
+		pm.ban(peerHost(address))
+		return
+	}
+
+	retry := peerRetryInterval
+
+	for i := 1; i < c.failures && retry < maxPeerRetryInterval; i++ {
+		retry *= 2
+	}
+
+	c.retryAt = time.Now().Add(minDuration(retry, maxPeerRetryInterval))
+}
+
+// ban forgets about the candidates of a host and refuses them from now on, must be called with
+// the lock held
+func (pm *peerManager) ban(host string) {
+	pm.banned[host] = true
+
+	for address, c := range pm.candidates {
+		if peerHost(address) == host && !c.connected {
+			delete(pm.candidates, address)
+		}
+	}
+}
+
+// banPeer bans a host and disconnects the peers connected from it
+func (dsm *DownloadSessionManger) banPeer(host string) {
+	dsm.peers.mu.Lock()
+	dsm.peers.ban(host)
+	dsm.peers.mu.Unlock()
+
+	for _, c := range dsm.connectedClients() {
+		if peerHost(c.Peer.Address) == host {
+			// the worker of the peer stops once its connection fails
+			c.Conn.Close()
+		}
+	}
+}
+
+func (pm *peerManager) isBanned(address string) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return pm.banned[peerHost(address)]
+}
+
+// acceptsInbound tells if a peer connecting to us is let in, banned peers are not and neither is
+// anybody once the maximum number of peers is reached
+func (dsm *DownloadSessionManger) acceptsInbound(address string) bool {
+	pm := dsm.peers
+
+	if pm.isBanned(address) {
+		return false
+	}
+
+	inbound := dsm.inboundCount()
+
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	return inbound+pm.outbound < dsm.maxPeers()
+}
+
+// inboundCount returns the number of connected peers which connected to us
+func (dsm *DownloadSessionManger) inboundCount() int {
+	inbound := 0
+
+	for _, c := range dsm.connectedClients() {
+		if c.Inbound {
+			inbound++
+		}
+	}
+
+	return inbound
+}
+
+// peerCounts returns the number of connected peers, of peers to connect to and of banned hosts
+func (dsm *DownloadSessionManger) peerCounts() (connected, candidates, banned int) {
+	connected = len(dsm.connectedClients())
+
+	dsm.peers.mu.Lock()
+	defer dsm.peers.mu.Unlock()
+
+	return connected, len(dsm.peers.candidates), len(dsm.peers.banned)
+}
@@ -0,0 +1,76 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+func TestAdoptPeer(t *testing.T) {
+	dsm := newTestSession(1)
+	dsm.T.Config.MaxPeers = 2
+
+	a := peer.Peer{Address: "10.0.0.1:6881"}
+	b := peer.Peer{Address: "10.0.0.2:6881"}
+	c := peer.Peer{Address: "10.0.0.3:6881"}
+
+	if !dsm.adoptPeer(a) || !dsm.adoptPeer(b) {
+		t.Fatal("peers not adopted below the limit")
+	}
+
+	if dsm.adoptPeer(a) {
+		t.Fatal("connected peer adopted twice")
+	}
+
+	if dsm.adoptPeer(c) {
+		t.Fatal("peer adopted above the limit")
+	}
+
+	// the peer without room is connected to later
+	if candidate := dsm.peers.candidates[c.Address]; candidate == nil || candidate.connected {
+		t.Fatal("peer without room not kept as a candidate")
+	}
+
+	dsm.peerDisconnected(a.Address, true)
+
+	if !dsm.adoptPeer(c) {
+		t.Fatal("peer not adopted once a slot was freed")
+	}
+
+	dsm.peers.ban(peerHost(b.Address))
+	dsm.peerDisconnected(b.Address, true)
+
+	if dsm.adoptPeer(b) {
+		t.Fatal("banned peer adopted")
+	}
+}
+
+func TestPeerDisconnectedOnlyFreesManagedSlots(t *testing.T) {
+	dsm := newTestSession(1)
+
+	dsm.AddPeers([]peer.Peer{{Address: "10.0.0.1:6881"}})
+	dsm.connectPeersTo(1)
+
+	// a peer the manager never connected to, and one disconnecting twice
+	dsm.peerDisconnected("10.0.0.9:6881", false)
+	dsm.peerDisconnected("10.0.0.1:6881", true)
+	dsm.peerDisconnected("10.0.0.1:6881", true)
+
+	if dsm.peers.outbound != 0 {
+		t.Fatalf("outbound = %d, want 0", dsm.peers.outbound)
+	}
+}
+
+// connectPeersTo marks the first n candidates as connected, as connectPeers does without
+// starting their workers
+func (dsm *DownloadSessionManger) connectPeersTo(n int) {
+	for _, c := range dsm.peers.candidates {
+		if n == 0 {
+			return
+		}
+
+		c.connected = true
+		dsm.peers.outbound++
+		n--
+	}
+}
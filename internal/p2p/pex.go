@@ -0,0 +1,185 @@
+package p2p
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/extensions/pex"
+	"github.com/OmBudhiraja/torrent-client/internal/mse"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+	"github.com/OmBudhiraja/torrent-client/internal/utp"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
+)
+
+const (
+	// peer exchange messages are sent at most once a minute, as required by BEP 11
+	pexInterval = time.Minute
+)
+
+// pexPeer returns the address on which other peers can reach a connected peer, the address of a
+// peer which connected to us is only known if it told us its listen port
+func pexPeer(c *client.Client) (pex.PexPeer, bool) {
+	var flags byte
+
+	conn := c.Conn
+
+	// the limits are in the way of the connection the peer was reached on
+	if limitedConn, ok := conn.(*ratelimit.Conn); ok {
+		conn = limitedConn.Unwrap()
+	}
+
+	// the peer is known to support encryption
+	if encryptedConn, ok := conn.(*mse.Conn); ok {
+		if encryptedConn.Encrypted {
+			flags |= pex.FlagEncryption
+		}
+
+		conn = encryptedConn.Conn
+	}
+
+	if _, ok := conn.(*utp.Conn); ok {
+		flags |= pex.FlagUTP
+	}
+
+	if !c.Inbound {
+		return pex.PexPeer{Peer: c.Peer, Flags: flags | pex.FlagReachable}, true
+	}
+
+	listenPort := c.ListenPort()
+
+	if listenPort == 0 {
+		return pex.PexPeer{}, false
+	}
+
+	host, _, err := net.SplitHostPort(c.Peer.Address)
+
+	if err != nil {
+		return pex.PexPeer{}, false
+	}
+
+	return pex.PexPeer{Peer: peer.Peer{Address: net.JoinHostPort(host, strconv.Itoa(listenPort))}, Flags: flags}, true
+}
+
+// runPex periodically tells the connected peers which peers joined or left the swarm since the
+// last message, until the session is closed
+func (dsm *DownloadSessionManger) runPex() {
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-dsm.closed:
+			return
+		case <-ticker.C:
+		}
+
+		dsm.sendPex()
+	}
+}
+
+func (dsm *DownloadSessionManger) sendPex() {
+	clients := dsm.connectedClients()
+
+	current := make(map[string]pex.PexPeer)
+
+	for _, c := range clients {
+		if p, ok := pexPeer(c); ok {
+			current[p.Peer.Address] = p
+		}
+	}
+
+	// the messages are worked out under the lock and sent without it, as the connections may be slow
+	msgs := make(map[*client.Client][]byte)
+
+	dsm.mu.Lock()
+
+	for _, c := range clients {
+		// the peer disconnected since
+		if _, ok := dsm.clients[c]; !ok {
+			continue
+		}
+
+		extensionId := c.ExtensionId(pex.PexExtensionName)
+
+		if extensionId == 0 {
+			continue
+		}
+
+		sent, ok := dsm.pexSent[c]
+
+		if !ok {
+			sent = make(map[string]bool)
+			dsm.pexSent[c] = sent
+		}
+
+		self, _ := pexPeer(c)
+
+		var added []pex.PexPeer
+		var dropped []peer.Peer
+
+		for address, p := range current {
+			if len(added) == pex.MaxPeers {
+				break
+			}
+
+			if address != self.Peer.Address && !sent[address] {
+				sent[address] = true
+				added = append(added, p)
+			}
+		}
+
+		for address := range sent {
+			if len(dropped) == pex.MaxPeers {
+				break
+			}
+
+			if _, ok := current[address]; !ok {
+				delete(sent, address)
+				dropped = append(dropped, peer.Peer{Address: address})
+			}
+		}
+
+		if len(added) == 0 && len(dropped) == 0 {
+			continue
+		}
+
+		msg, err := pex.FormatPexMsg(extensionId, added, dropped)
+
+		if err != nil {
+			continue
+		}
+
+		msgs[c] = msg
+	}
+
+	dsm.mu.Unlock()
+
+	for c, msg := range msgs {
+		c.SendRawMsg(msg)
+	}
+}
+
+// handleExtensionMessage connects to the peers received through peer exchange
+func (w *worker) handleExtensionMessage(data []byte) error {
+	if len(data) == 0 {
+		return fmt.Errorf("invalid extension message")
+	}
+
+	if data[0] != pex.PexExtensionId || w.dsm.T.Private {
+		return nil
+	}
+
+	msg, err := pex.ParsePexMsg(data[1:])
+
+	if err != nil {
+		// a bad peer list is not worth dropping the peer for
+		return nil
+	}
+
+	w.dsm.AddPeers(msg.AddedPeers())
+
+	return nil
+}
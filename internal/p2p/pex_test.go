@@ -0,0 +1,64 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/extensions"
+	"github.com/OmBudhiraja/torrent-client/internal/extensions/pex"
+	"github.com/OmBudhiraja/torrent-client/internal/mse"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+	"github.com/OmBudhiraja/torrent-client/internal/utp"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
+)
+
+func TestPexPeerFlagsThroughLimitedConn(t *testing.T) {
+	conn := &mse.Conn{Conn: &utp.Conn{}, Encrypted: true}
+
+	c := &client.Client{
+		Conn: ratelimit.NewConn(conn, nil, nil),
+		Peer: peer.Peer{Address: "127.0.0.1:6881"},
+	}
+
+	p, ok := pexPeer(c)
+
+	if !ok {
+		t.Fatal("outbound peer not advertised")
+	}
+
+	want := pex.FlagEncryption | pex.FlagUTP | pex.FlagReachable
+
+	if p.Flags != want {
+		t.Fatalf("flags = %#x, want %#x", p.Flags, want)
+	}
+}
+
+func TestPexPeerInbound(t *testing.T) {
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := client.NewFromHandshake(peer.Peer{Address: "10.0.0.1:51234"}, &peer.HandshakeResponse{Conn: conn}, nil, 0, false, 4)
+	c.Inbound = true
+
+	if _, ok := pexPeer(c); ok {
+		t.Fatal("inbound peer advertised without a listen port")
+	}
+
+	messages := make(chan *client.MessageResult, 1)
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+
+	go c.ParsePeerMessage(messages, closeChan)
+
+	// the peer tells its listen port in its extension handshake
+	go extensions.SendHandshakeMessage(other, 6881, false)
+	<-messages
+
+	p, ok := pexPeer(c)
+
+	if !ok || p.Peer.Address != "10.0.0.1:6881" {
+		t.Fatalf("got %v %v, want the listen port", p.Peer.Address, ok)
+	}
+}
@@ -0,0 +1,363 @@
+package p2p
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+)
+
+const (
+	// number of pieces picked at random before switching to rarest first,
+	// so that we quickly have something to trade with
+	randomFirstPieces = 4
+)
+
+type pieceState int
+
+const (
+	pieceMissing pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+// PiecePicker decides which piece each peer should download next, preferring the pieces of the
+// highest priority and among them the pieces that the fewest connected peers have, or the first
+// ones in sequential mode
+type PiecePicker struct {
+	mu           sync.Mutex
+	pieces       []*PieceWork
+	state        []pieceState
+	priority     []Priority
+	sequential   bool
+	availability []int
+	completed    int
+	changed      chan struct{}
+	// delivered is closed and replaced every time a block arrives for a piece which several peers
+	// work on, so that the others cancel their request for it
+	delivered  chan struct{}
+	random     *rand.Rand
+	inProgress map[int]*pieceDownload
+	// excluded holds the hosts which are not handed a piece again while other peers have it,
+	// because they sent blocks of it which turned out corrupt
+	excluded map[int]map[string]bool
+}
+
+func NewPiecePicker(pieces []*PieceWork) *PiecePicker {
+	priority := make([]Priority, len(pieces))
+
+	for i := range priority {
+		priority[i] = PriorityNormal
+	}
+
+	return &PiecePicker{
+		pieces:       pieces,
+		state:        make([]pieceState, len(pieces)),
+		priority:     priority,
+		availability: make([]int, len(pieces)),
+		changed:      make(chan struct{}),
+		delivered:    make(chan struct{}),
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		inProgress:   make(map[int]*pieceDownload),
+		excluded:     make(map[int]map[string]bool),
+	}
+}
+
+// Changed returns a channel which is closed the next time a piece becomes available to pick again
+func (pp *PiecePicker) Changed() <-chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.changed
+}
+
+// Delivered returns a channel which is closed the next time a block arrives for a piece that
+// several peers work on during endgame
+func (pp *PiecePicker) Delivered() <-chan struct{} {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.delivered
+}
+
+// notify wakes up every worker waiting on Changed, must be called with the lock held
+func (pp *PiecePicker) notify() {
+	close(pp.changed)
+	pp.changed = make(chan struct{})
+}
+
+// SetPriorities changes the priority of every piece and whether they are picked in order, pieces
+// already in progress are finished even if they are skipped now
+func (pp *PiecePicker) SetPriorities(priority []Priority, sequential bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	copy(pp.priority, priority)
+	pp.sequential = sequential
+
+	pp.notify()
+}
+
+// PeerHas records that a peer has a piece
+func (pp *PiecePicker) PeerHas(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if index < 0 || index >= len(pp.availability) {
+		return
+	}
+
+	pp.availability[index]++
+}
+
+// RemovePeer forgets about the pieces of a disconnected peer
+func (pp *PiecePicker) RemovePeer(bf bitfield.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for i := range pp.availability {
+		if bf.HasPiece(i) {
+			pp.availability[i]--
+		}
+	}
+}
+
+// Pick reserves the piece a peer with the given bitfield and host should download next,
+// it returns nil if the peer has nothing we need. Once every piece has been picked
+// the picker enters endgame mode and hands out pieces that are already in progress.
+func (pp *PiecePicker) Pick(bf bitfield.Bitfield, host string) *pieceDownload {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	randomFirst := pp.completed < randomFirstPieces
+
+	picked := -1
+	candidates := 0
+	anyMissing := false
+
+	for i, state := range pp.state {
+		if state != pieceMissing || pp.priority[i] == PrioritySkip {
+			continue
+		}
+
+		anyMissing = true
+
+		if !bf.HasPiece(i) || pp.isExcluded(i, host) {
+			continue
+		}
+
+		if picked != -1 && pp.priority[i] < pp.priority[picked] {
+			continue
+		}
+
+		if picked != -1 && pp.priority[i] > pp.priority[picked] {
+			picked = -1
+			candidates = 0
+		}
+
+		// the first piece of the highest priority
+		if pp.sequential {
+			if picked == -1 {
+				picked = i
+			}
+			continue
+		}
+
+		if !randomFirst && picked != -1 && pp.availability[i] > pp.availability[picked] {
+			continue
+		}
+
+		if !randomFirst && picked != -1 && pp.availability[i] < pp.availability[picked] {
+			candidates = 0
+		}
+
+		// reservoir sampling, so that ties are broken at random
+		candidates++
+		if pp.random.Intn(candidates) == 0 {
+			picked = i
+		}
+	}
+
+	if picked == -1 {
+		if anyMissing {
+			return nil
+		}
+
+		return pp.pickEndgame(bf, host)
+	}
+
+	pp.state[picked] = pieceInProgress
+
+	pd, ok := pp.inProgress[picked]
+
+	if !ok {
+		pd = newPieceDownload(pp.pieces[picked])
+		pp.inProgress[picked] = pd
+	}
+
+	pd.workers++
+
+	if pp.missingCount() == 0 {
+		// wake up idle peers so that they join in on the endgame
+		pp.notify()
+	}
+
+	return pd
+}
+
+// isExcluded tells if a host should leave a piece to the other peers which have it, must be called
+// with the lock held
+func (pp *PiecePicker) isExcluded(index int, host string) bool {
+	excluded := pp.excluded[index]
+
+	return excluded[host] && pp.availability[index] > len(excluded)
+}
+
+// Exclude hands a piece to other peers than the given hosts while other peers have it
+func (pp *PiecePicker) Exclude(index int, hosts []string) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.excluded[index] == nil {
+		pp.excluded[index] = make(map[string]bool)
+	}
+
+	for _, host := range hosts {
+		pp.excluded[index][host] = true
+	}
+}
+
+func (pp *PiecePicker) missingCount() int {
+	count := 0
+
+	for i, state := range pp.state {
+		if state == pieceMissing && pp.priority[i] != PrioritySkip {
+			count++
+		}
+	}
+
+	return count
+}
+
+// Release is called by a peer that stopped working on a piece, the piece goes back up for picking
+// when nobody else is working on it, keeping the blocks received so far
+func (pp *PiecePicker) Release(pd *pieceDownload) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	pd.workers--
+
+	index := pd.work.Index
+
+	if pd.workers > 0 || pd.complete || pp.inProgress[index] != pd {
+		return
+	}
+
+	pp.state[index] = pieceMissing
+	pp.notify()
+}
+
+// AddBlock stores a block received for a piece, it returns true to the single caller
+// whose block completed the piece, who is then responsible for verifying it
+func (pp *PiecePicker) AddBlock(pd *pieceDownload, block int, data []byte, from string) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pd.complete || pd.blocks[block] != nil {
+		return false
+	}
+
+	pd.blocks[block] = data
+	pd.senders[block] = from
+	pd.received++
+
+	if pd.workers > 1 {
+		close(pp.delivered)
+		pp.delivered = make(chan struct{})
+	}
+
+	if pd.received == len(pd.blocks) {
+		pd.complete = true
+		return true
+	}
+
+	return false
+}
+
+// isComplete tells if every block of the piece has arrived
+func (pp *PiecePicker) isComplete(pd *pieceDownload) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pd.complete
+}
+
+func (pp *PiecePicker) hasBlock(pd *pieceDownload, block int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pd.blocks[block] != nil
+}
+
+// missingBlocks returns up to n blocks of the piece that have not been received and are not in skip
+func (pp *PiecePicker) missingBlocks(pd *pieceDownload, skip map[int]bool, n int) []int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	blocks := make([]int, 0, n)
+
+	for i, data := range pd.blocks {
+		if len(blocks) == n {
+			break
+		}
+
+		if data == nil && !skip[i] {
+			blocks = append(blocks, i)
+		}
+	}
+
+	return blocks
+}
+
+// Completed returns the number of verified pieces
+func (pp *PiecePicker) Completed() int {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return pp.completed
+}
+
+// SetDone marks a piece which is already on disk as done without downloading it
+func (pp *PiecePicker) SetDone(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	if pp.state[index] == pieceDone {
+		return
+	}
+
+	pp.state[index] = pieceDone
+	pp.completed++
+}
+
+// Finish is called once a completed piece has been checked, a verified piece is never picked
+// again while a corrupt one is downloaded again from scratch
+func (pp *PiecePicker) Finish(pd *pieceDownload, verified bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	index := pd.work.Index
+
+	delete(pp.inProgress, index)
+
+	if !verified {
+		pp.state[index] = pieceMissing
+		pp.notify()
+		return
+	}
+
+	pp.state[index] = pieceDone
+	pp.completed++
+	delete(pp.excluded, index)
+}
@@ -0,0 +1,292 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+)
+
+// newTestPicker returns a picker of n pieces of two blocks each, which every peer has
+func newTestPicker(n int) (*PiecePicker, bitfield.Bitfield) {
+	pieces := make([]*PieceWork, n)
+
+	for i := range pieces {
+		pieces[i] = &PieceWork{Index: i, Length: 2 * maxBlockSize}
+	}
+
+	pp := NewPiecePicker(pieces)
+
+	all := bitfield.New(n)
+
+	for i := 0; i < n; i++ {
+		all.SetPiece(i)
+		pp.PeerHas(i)
+	}
+
+	return pp, all
+}
+
+func TestEndgameSharesPiecesInProgress(t *testing.T) {
+	pp, all := newTestPicker(2)
+
+	a := pp.Pick(all, "a")
+	b := pp.Pick(all, "b")
+
+	if a == nil || b == nil || a == b {
+		t.Fatal("the two pieces were not handed out")
+	}
+
+	if !pp.inEndgame() {
+		t.Fatal("not in endgame with every piece in progress")
+	}
+
+	c := pp.Pick(all, "c")
+
+	if c == nil || c.workers != 2 {
+		t.Fatal("endgame did not hand out a piece in progress")
+	}
+
+	// the next peer gets the piece with the fewest peers on it
+	d := pp.Pick(all, "d")
+
+	if d == nil || d == c {
+		t.Fatal("endgame did not spread the peers over the pieces")
+	}
+}
+
+func TestEndgameLeavesSkippedPieces(t *testing.T) {
+	pp, all := newTestPicker(2)
+
+	first := pp.Pick(all, "a")
+	pp.Pick(all, "b")
+
+	// the file of the first piece was deselected while it downloads
+	priority := []Priority{PriorityNormal, PriorityNormal}
+	priority[first.work.Index] = PrioritySkip
+	pp.SetPriorities(priority, false)
+
+	for i := 0; i < 3; i++ {
+		if pd := pp.Pick(all, "c"); pd == first {
+			t.Fatal("endgame handed out a skipped piece")
+		}
+	}
+}
+
+func TestEndgameLeavesExcludedPieces(t *testing.T) {
+	pp, all := newTestPicker(1)
+
+	pd := pp.Pick(all, "a")
+	pp.PeerHas(0)
+	pp.Exclude(0, []string{"bad"})
+
+	if pp.Pick(all, "bad") != nil {
+		t.Fatal("endgame handed a piece to an excluded host")
+	}
+
+	if pp.Pick(all, "good") != pd {
+		t.Fatal("endgame did not hand the piece to another host")
+	}
+}
+
+func TestPickRarestFirst(t *testing.T) {
+	pp, all := newTestPicker(8)
+
+	// past the random first pieces
+	for i := 0; i < randomFirstPieces; i++ {
+		pp.Finish(pp.Pick(all, "a"), true)
+	}
+
+	rarest := -1
+
+	// every missing piece but one is on a second peer
+	for i := 0; i < 8; i++ {
+		if pp.state[i] == pieceDone {
+			continue
+		}
+
+		if rarest == -1 {
+			rarest = i
+		} else {
+			pp.PeerHas(i)
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		pd := pp.Pick(all, "a")
+
+		if pd == nil || pd.work.Index != rarest {
+			t.Fatal("did not pick the rarest piece")
+		}
+
+		pp.Release(pd)
+	}
+}
+
+func TestPickPiecesOfThePeer(t *testing.T) {
+	pp, _ := newTestPicker(4)
+
+	bf := bitfield.New(4)
+	bf.SetPiece(2)
+
+	pd := pp.Pick(bf, "a")
+
+	if pd == nil || pd.work.Index != 2 {
+		t.Fatal("did not pick the only piece the peer has")
+	}
+
+	if pp.Pick(bf, "a") != nil {
+		t.Fatal("picked a piece the peer does not have")
+	}
+}
+
+func TestPickPriorities(t *testing.T) {
+	pp, all := newTestPicker(4)
+
+	pp.SetPriorities([]Priority{PrioritySkip, PriorityLow, PriorityHigh, PriorityNormal}, false)
+
+	for _, want := range []int{2, 3, 1} {
+		pd := pp.Pick(all, "a")
+
+		if pd == nil || pd.work.Index != want {
+			t.Fatalf("did not pick piece %d", want)
+		}
+	}
+
+	// endgame has nothing to share as every piece in progress is already ours
+	if pd := pp.Pick(all, "a"); pd != nil && pd.work.Index == 0 {
+		t.Fatal("picked a skipped piece")
+	}
+}
+
+func TestPickSequential(t *testing.T) {
+	pp, all := newTestPicker(4)
+
+	pp.SetPriorities([]Priority{PriorityNormal, PriorityNormal, PriorityHigh, PriorityNormal}, true)
+
+	for _, want := range []int{2, 0, 1, 3} {
+		pd := pp.Pick(all, "a")
+
+		if pd == nil || pd.work.Index != want {
+			t.Fatalf("did not pick piece %d in order", want)
+		}
+	}
+}
+
+func TestReleaseKeepsBlocks(t *testing.T) {
+	pp, all := newTestPicker(1)
+
+	pd := pp.Pick(all, "a")
+
+	if pp.AddBlock(pd, 0, []byte("first"), "a") {
+		t.Fatal("half a piece reported complete")
+	}
+
+	changed := pp.Changed()
+	pp.Release(pd)
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("released piece not notified")
+	}
+
+	again := pp.Pick(all, "b")
+
+	if again != pd || !pp.hasBlock(again, 0) {
+		t.Fatal("released piece lost its blocks")
+	}
+
+	if blocks := pp.missingBlocks(again, nil, 2); len(blocks) != 1 || blocks[0] != 1 {
+		t.Fatalf("missing blocks are %v, want [1]", blocks)
+	}
+}
+
+func TestAddBlockCompletesOnce(t *testing.T) {
+	pp, all := newTestPicker(1)
+
+	pd := pp.Pick(all, "a")
+	pp.AddBlock(pd, 0, []byte("first"), "a")
+
+	if pp.AddBlock(pd, 0, []byte("again"), "b") {
+		t.Fatal("duplicate block completed the piece")
+	}
+
+	if !pp.AddBlock(pd, 1, []byte("second"), "a") {
+		t.Fatal("last block did not complete the piece")
+	}
+
+	if pp.AddBlock(pd, 1, []byte("second"), "b") {
+		t.Fatal("piece completed twice")
+	}
+}
+
+func TestFinish(t *testing.T) {
+	pp, all := newTestPicker(1)
+
+	pd := pp.Pick(all, "a")
+	pp.AddBlock(pd, 0, []byte("first"), "a")
+	pp.AddBlock(pd, 1, []byte("second"), "a")
+
+	// a corrupt piece is downloaded again from scratch
+	pp.Finish(pd, false)
+
+	again := pp.Pick(all, "a")
+
+	if again == nil || again == pd || pp.hasBlock(again, 0) {
+		t.Fatal("corrupt piece not downloaded again from scratch")
+	}
+
+	pp.AddBlock(again, 0, []byte("first"), "a")
+	pp.AddBlock(again, 1, []byte("second"), "a")
+	pp.Finish(again, true)
+
+	if pp.Completed() != 1 {
+		t.Fatalf("%d pieces completed, want 1", pp.Completed())
+	}
+
+	if pp.Pick(all, "b") != nil {
+		t.Fatal("verified piece picked again")
+	}
+}
+
+func TestExcludedHostLeavesPieceToOthers(t *testing.T) {
+	pp, all := newTestPicker(2)
+
+	pp.PeerHas(0)
+	pp.Exclude(0, []string{"bad"})
+
+	for i := 0; i < 2; i++ {
+		if pd := pp.Pick(all, "bad"); pd != nil && pd.work.Index == 0 {
+			t.Fatal("excluded host handed the piece another peer has")
+		}
+	}
+
+	if pd := pp.Pick(all, "good"); pd == nil || pd.work.Index != 0 {
+		t.Fatal("piece not handed to another host")
+	}
+}
+
+func TestExcludedHostKeepsPieceNobodyElseHas(t *testing.T) {
+	pp, _ := newTestPicker(2)
+
+	only := bitfield.New(2)
+	only.SetPiece(0)
+
+	pp.Exclude(0, []string{"bad"})
+
+	if pd := pp.Pick(only, "bad"); pd == nil || pd.work.Index != 0 {
+		t.Fatal("excluded host not handed the piece nobody else has")
+	}
+}
+
+func TestRemovePeer(t *testing.T) {
+	pp, all := newTestPicker(2)
+
+	pp.RemovePeer(all)
+
+	for i, availability := range pp.availability {
+		if availability != 0 {
+			t.Fatalf("piece %d still available from %d peers", i, availability)
+		}
+	}
+}
@@ -1,13 +1,48 @@
 package p2p
 
 import (
+	"bytes"
 	"fmt"
 )
 
 type PieceWork struct {
 	Index  int
 	Length int
-	Hash   [20]byte
+	Hash   PieceHash
+}
+
+// pieceDownload holds the blocks of a piece received so far, it is shared by every
+// peer working on the piece and outlives them so that partial data is not thrown away
+type pieceDownload struct {
+	work   *PieceWork
+	blocks [][]byte
+	// senders holds the address of the peer each block came from, empty for web seeds
+	senders  []string
+	received int
+	workers  int
+	complete bool
+}
+
+func newPieceDownload(work *PieceWork) *pieceDownload {
+	numBlocks := (work.Length + maxBlockSize - 1) / maxBlockSize
+
+	return &pieceDownload{
+		work:    work,
+		blocks:  make([][]byte, numBlocks),
+		senders: make([]string, numBlocks),
+	}
+}
+
+// blockRange returns the offset and length of a block within the piece
+func (pd *pieceDownload) blockRange(block int) (begin, length int) {
+	begin = block * maxBlockSize
+	length = min(maxBlockSize, pd.work.Length-begin)
+
+	return begin, length
+}
+
+func (pd *pieceDownload) data() []byte {
+	return bytes.Join(pd.blocks, nil)
 }
 
 type PieceResult struct {
@@ -28,8 +63,14 @@ func (p *PieceResult) WriteToFiles(files []*OutputFile, pieceLength int) error {
 		fileEnd := min(pieceOffsetEnd, file.endRange)
 		writeoffset := fileStart - file.startRange
 
+		// padding is only zeros which are not stored
+		if file.padding {
+			bytesWritten += fileEnd - fileStart
+			continue
+		}
+
 		// Write the piece data to the file
-		n, err := file.file.WriteAt(p.Data[bytesWritten:bytesWritten+(fileEnd-fileStart)], int64(writeoffset))
+		n, err := file.file.WriteAt(p.Data[bytesWritten:bytesWritten+(fileEnd-fileStart)], int64(writeoffset+file.offset))
 		if err != nil {
 			return err
 		}
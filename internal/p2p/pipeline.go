@@ -0,0 +1,84 @@
+package p2p
+
+import (
+	"time"
+)
+
+const (
+	// number of requests outstanding with a peer before its throughput is known
+	initialQueueDepth = 5
+	minQueueDepth     = 2
+	// the most requests outstanding with a peer, lower when the peer queues fewer of them
+	maxQueueDepth = 250
+	// the queue holds enough requests to keep the peer busy for this long on top of the round trip,
+	// so that it never waits for our next request
+	queueTime = time.Second
+	// the throughput of a peer is measured over this long
+	rateInterval = time.Second
+)
+
+// pipeline decides how many requests to keep outstanding with a peer, enough blocks to cover the
+// round trip to the peer and the queue time at the rate the peer sends them. A queue which is too
+// short lets the rate go up and the queue with it, until the peer cannot send any faster.
+type pipeline struct {
+	depth int
+	// rtt is the lowest latency of a block, the others include the time the request waited in
+	// the queue of the peer
+	rtt time.Duration
+	// rate is the smoothed throughput of the peer in bytes per second, 0 until measured
+	rate float64
+
+	// bytes received since the start of the current measure
+	received int
+	start    time.Time
+}
+
+func newPipeline() *pipeline {
+	return &pipeline{depth: initialQueueDepth}
+}
+
+// restart starts a new measure, when the peer has nothing to send as we have no request
+// outstanding with it, so that the time it spends idle does not count against its rate
+func (p *pipeline) restart() {
+	p.received = 0
+	p.start = time.Now()
+}
+
+// blockReceived accounts for a block which arrived latency after it was requested
+func (p *pipeline) blockReceived(length int, latency time.Duration) {
+	if p.rtt == 0 || latency < p.rtt {
+		p.rtt = latency
+	}
+
+	p.received += length
+
+	elapsed := time.Since(p.start)
+
+	if elapsed < rateInterval {
+		return
+	}
+
+	sample := float64(p.received) / elapsed.Seconds()
+
+	if p.rate == 0 {
+		p.rate = sample
+	} else {
+		p.rate = 0.7*p.rate + 0.3*sample
+	}
+
+	p.restart()
+
+	p.depth = int(p.rate*(p.rtt+queueTime).Seconds())/maxBlockSize + 1
+}
+
+// queueDepth returns the number of requests to keep outstanding with a peer which queues up to
+// reqq of them, 0 when it did not tell
+func (p *pipeline) queueDepth(reqq int) int {
+	limit := maxQueueDepth
+
+	if reqq > 0 && reqq < limit {
+		limit = reqq
+	}
+
+	return max(min(p.depth, limit), min(minQueueDepth, limit))
+}
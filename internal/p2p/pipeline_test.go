@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueueDepthLimits(t *testing.T) {
+	p := newPipeline()
+
+	if got := p.queueDepth(0); got != initialQueueDepth {
+		t.Fatalf("initial depth is %d, want %d", got, initialQueueDepth)
+	}
+
+	// the peer queues fewer requests than we would send
+	if got := p.queueDepth(3); got != 3 {
+		t.Fatalf("depth is %d, want the 3 requests the peer queues", got)
+	}
+
+	p.depth = 1000
+
+	if got := p.queueDepth(0); got != maxQueueDepth {
+		t.Fatalf("depth is %d, want at most %d", got, maxQueueDepth)
+	}
+
+	if got := p.queueDepth(500); got != maxQueueDepth {
+		t.Fatalf("depth is %d, want at most %d", got, maxQueueDepth)
+	}
+
+	p.depth = 0
+
+	if got := p.queueDepth(0); got != minQueueDepth {
+		t.Fatalf("depth is %d, want at least %d", got, minQueueDepth)
+	}
+
+	if got := p.queueDepth(1); got != 1 {
+		t.Fatalf("depth is %d, want the single request the peer queues", got)
+	}
+}
+
+func TestPipelineFollowsRate(t *testing.T) {
+	p := newPipeline()
+	p.restart()
+
+	// within the first interval the rate is not known yet
+	p.blockReceived(maxBlockSize, 50*time.Millisecond)
+
+	if p.rate != 0 || p.depth != initialQueueDepth {
+		t.Fatal("depth changed before the rate was measured")
+	}
+
+	// 100 blocks over the interval with a round trip of 5ms
+	p.start = time.Now().Add(-rateInterval)
+	p.received = 99 * maxBlockSize
+	p.blockReceived(maxBlockSize, 5*time.Millisecond)
+
+	if p.rtt != 5*time.Millisecond {
+		t.Fatalf("rtt is %s, want the lowest latency", p.rtt)
+	}
+
+	if p.received != 0 {
+		t.Fatal("measure not restarted")
+	}
+
+	// the 100.5 blocks sent over the round trip and the queue time, plus one
+	if got := p.queueDepth(0); got != 101 {
+		t.Fatalf("depth is %d, want 101", got)
+	}
+
+	// the peer queues fewer requests
+	if got := p.queueDepth(50); got != 50 {
+		t.Fatalf("depth is %d, want the 50 requests the peer queues", got)
+	}
+
+	// a single block over the next interval brings the smoothed rate down to about 70 blocks
+	p.start = time.Now().Add(-rateInterval)
+	p.blockReceived(maxBlockSize, 20*time.Millisecond)
+
+	if got := p.queueDepth(0); got != 71 {
+		t.Fatalf("depth is %d, want 71", got)
+	}
+}
@@ -0,0 +1,214 @@
+package p2p
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// Priority decides which pieces are downloaded first, pieces of higher priority are always
+// picked before the others and skipped pieces are not downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	default:
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+}
+
+func ParsePriority(s string) (Priority, error) {
+	for _, p := range []Priority{PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh} {
+		if p.String() == s {
+			return p, nil
+		}
+	}
+
+	return PriorityNormal, fmt.Errorf("invalid priority %s, expected skip, low, normal or high", s)
+}
+
+type filePriority struct {
+	selection *FileSelection
+	priority  Priority
+}
+
+// Priorities holds the priorities of the files and pieces of a torrent, and whether its pieces are
+// downloaded in order rather than rarest first. They can be changed while the torrent downloads.
+type Priorities struct {
+	mu sync.Mutex
+	// files are applied in order, a file takes the priority of the last selection matching it
+	files      []filePriority
+	pieces     map[int]Priority
+	sequential bool
+	changed    chan struct{}
+}
+
+func NewPriorities() *Priorities {
+	return &Priorities{
+		pieces:  make(map[int]Priority),
+		changed: make(chan struct{}),
+	}
+}
+
+// SetFiles gives a priority to the selected files, pieces shared by several files take the highest
+// priority of their files
+func (p *Priorities) SetFiles(selection *FileSelection, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.files = append(p.files, filePriority{selection: selection, priority: priority})
+	p.notify()
+}
+
+// SetFile gives a priority to a file, numbered as in a FileSelection
+func (p *Priorities) SetFile(index int, priority Priority) {
+	p.SetFiles(&FileSelection{ranges: [][2]int{{index, index}}}, priority)
+}
+
+// SetPiece gives a priority to a piece, overriding the priority of its files
+func (p *Priorities) SetPiece(index int, priority Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pieces[index] = priority
+	p.notify()
+}
+
+// SetSequential downloads the pieces of the same priority in order, which lets the beginning of
+// the files be used before the download completes
+func (p *Priorities) SetSequential(sequential bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.sequential = sequential
+	p.notify()
+}
+
+// Changed returns a channel which is closed the next time the priorities change
+func (p *Priorities) Changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.changed
+}
+
+// notify must be called with the lock held
+func (p *Priorities) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// file returns the priority of a file, must be called with the lock held
+func (p *Priorities) file(index int, path string) Priority {
+	priority := PriorityNormal
+
+	for _, fp := range p.files {
+		if fp.selection.Selects(index, path) {
+			priority = fp.priority
+		}
+	}
+
+	return priority
+}
+
+// applyPriorities hands the priority of each piece to the picker, unselected files are always
+// skipped. The wanted pieces are the ones which are not skipped.
+func (dsm *DownloadSessionManger) applyPriorities() {
+	t := dsm.T
+
+	filePriorities := make(map[*OutputFile]Priority, len(dsm.Outfiles))
+	index := 0
+
+	var pieceOverrides map[int]Priority
+	sequential := false
+
+	if t.Priorities != nil {
+		t.Priorities.mu.Lock()
+
+		pieceOverrides = t.Priorities.pieces
+		sequential = t.Priorities.sequential
+	}
+
+	for i, outfile := range dsm.Outfiles {
+		if outfile.padding {
+			continue
+		}
+
+		switch {
+		case outfile.unselected:
+			filePriorities[outfile] = PrioritySkip
+		case t.Priorities == nil:
+			filePriorities[outfile] = PriorityNormal
+		case len(t.Files) == 0:
+			filePriorities[outfile] = t.Priorities.file(index, t.Name)
+		default:
+			filePriorities[outfile] = t.Priorities.file(index, filepath.ToSlash(t.Files[i].Path))
+		}
+
+		index++
+	}
+
+	priorities := make([]Priority, len(t.PieceHashes))
+
+	for i := range priorities {
+		if priority, ok := pieceOverrides[i]; ok {
+			priorities[i] = priority
+			continue
+		}
+
+		for _, file := range dsm.PieceToFileMap[i] {
+			if priority, ok := filePriorities[file]; ok && priority > priorities[i] {
+				priorities[i] = priority
+			}
+		}
+	}
+
+	if t.Priorities != nil {
+		t.Priorities.mu.Unlock()
+	}
+
+	dsm.mu.Lock()
+
+	for i, priority := range priorities {
+		if priority == PrioritySkip {
+			dsm.wanted.ClearPiece(i)
+		} else {
+			dsm.wanted.SetPiece(i)
+		}
+	}
+
+	dsm.mu.Unlock()
+
+	dsm.Picker.SetPriorities(priorities, sequential)
+}
+
+// watchPriorities applies the priorities of the torrent whenever they change, until the session
+// is closed
+func (dsm *DownloadSessionManger) watchPriorities() {
+	for {
+		changed := dsm.T.Priorities.Changed()
+
+		dsm.applyPriorities()
+
+		select {
+		case <-changed:
+		case <-dsm.closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+// newPriorityTorrent returns a torrent of pieces of 16 bytes over three files: a.bin spans
+// pieces 0 and 1, which it shares with b.bin, and c.bin spans pieces 2 and 3
+func newPriorityTorrent(t *testing.T, priorities *Priorities) *Torrent {
+	return &Torrent{
+		Name:        "dir",
+		PieceHashes: make([]PieceHash, 4),
+		PieceLength: 16,
+		Length:      64,
+		Files: []File{
+			{Path: "a.bin", Length: 24},
+			{Path: "b.bin", Length: 8},
+			{Path: "c.bin", Length: 32},
+		},
+		Outpath:    t.TempDir(),
+		Config:     &Config{},
+		Priorities: priorities,
+	}
+}
+
+func pickerPriorities(pp *PiecePicker) ([]Priority, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	return append([]Priority(nil), pp.priority...), pp.sequential
+}
+
+func checkPriorities(t *testing.T, dsm *DownloadSessionManger, want []Priority) {
+	t.Helper()
+
+	got, _ := pickerPriorities(dsm.Picker)
+
+	dsm.mu.Lock()
+	defer dsm.mu.Unlock()
+
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("piece priorities are %v, want %v", got, want)
+		}
+
+		if dsm.wanted.HasPiece(i) != (want[i] != PrioritySkip) {
+			t.Fatalf("piece %d wanted is %v with priority %s", i, dsm.wanted.HasPiece(i), want[i])
+		}
+	}
+}
+
+func TestFilePriorities(t *testing.T) {
+	priorities := NewPriorities()
+	priorities.SetFile(0, PriorityHigh)
+	priorities.SetFile(1, PrioritySkip)
+
+	pattern, err := ParseFileSelection("c.*")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	priorities.SetFiles(pattern, PriorityLow)
+	priorities.SetPiece(3, PrioritySkip)
+
+	dsm, err := newPriorityTorrent(t, priorities).Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dsm.Close()
+
+	// the piece shared by a.bin and the skipped b.bin takes the highest priority of the two, and
+	// the priority of a piece overrides the one of its file
+	checkPriorities(t, dsm, []Priority{PriorityHigh, PriorityHigh, PriorityLow, PrioritySkip})
+}
+
+func TestLastFilePriorityWins(t *testing.T) {
+	priorities := NewPriorities()
+
+	all, _ := ParseFileSelection("*")
+	priorities.SetFiles(all, PrioritySkip)
+	priorities.SetFile(2, PriorityNormal)
+
+	dsm, err := newPriorityTorrent(t, priorities).Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dsm.Close()
+
+	checkPriorities(t, dsm, []Priority{PrioritySkip, PrioritySkip, PriorityNormal, PriorityNormal})
+}
+
+func TestWatchPriorities(t *testing.T) {
+	priorities := NewPriorities()
+
+	dsm, err := newPriorityTorrent(t, priorities).Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dsm.Close()
+
+	checkPriorities(t, dsm, []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal})
+
+	changed := dsm.Picker.Changed()
+
+	// the priorities change while the torrent downloads
+	priorities.SetFile(2, PriorityHigh)
+	priorities.SetSequential(true)
+
+	deadline := time.Now().Add(time.Second)
+
+	for {
+		got, sequential := pickerPriorities(dsm.Picker)
+
+		if got[2] == PriorityHigh && got[3] == PriorityHigh && sequential {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("priorities %v and sequential %v not applied", got, sequential)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-changed:
+	default:
+		t.Fatal("picker did not wake up the workers")
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, p := range []Priority{PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh} {
+		if parsed, err := ParsePriority(p.String()); err != nil || parsed != p {
+			t.Fatalf("%s parsed as %s %v", p, parsed, err)
+		}
+	}
+
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Fatal("unknown priority parsed")
+	}
+}
@@ -0,0 +1,192 @@
+package p2p
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+	"github.com/zeebo/bencode"
+)
+
+const (
+	resumeFileExtension = ".resume"
+	resumeSaveInterval  = 10 * time.Second
+)
+
+// resumeState is persisted next to the downloaded data so that an interrupted
+// download only fetches the pieces which are still missing
+type resumeState struct {
+	InfoHash []byte            `bencode:"info hash"`
+	Bitfield []byte            `bencode:"bitfield"`
+	Files    []resumeFileState `bencode:"files"`
+}
+
+type resumeFileState struct {
+	Length int64 `bencode:"length"`
+	Mtime  int64 `bencode:"mtime"`
+}
+
+func (t *Torrent) resumeFilePath() string {
+	return filepath.Join(t.Outpath, t.Name+resumeFileExtension)
+}
+
+// SaveResumeState writes the verified pieces and the current state of the output files to disk
+func (dsm *DownloadSessionManger) SaveResumeState() error {
+	dsm.mu.Lock()
+	bf := make([]byte, len(dsm.Bitfield))
+	copy(bf, dsm.Bitfield)
+	dsm.mu.Unlock()
+
+	files, err := dsm.fileStates()
+
+	if err != nil {
+		return err
+	}
+
+	state := resumeState{
+		InfoHash: dsm.T.InfoHash[:],
+		Bitfield: bf,
+		Files:    files,
+	}
+
+	data, err := bencode.EncodeBytes(state)
+
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that an interruption never leaves a truncated state behind
+	path := dsm.T.resumeFilePath()
+	tmpPath := path + ".tmp"
+
+	err = os.WriteFile(tmpPath, data, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	dsm.lastResumeSave = time.Now()
+
+	return os.Rename(tmpPath, path)
+}
+
+func (dsm *DownloadSessionManger) fileStates() ([]resumeFileState, error) {
+	files := make([]resumeFileState, len(dsm.Outfiles))
+
+	for i, outfile := range dsm.Outfiles {
+		// a missing file never matches the state of the file created on download
+		if outfile.file == nil {
+			continue
+		}
+
+		stat, err := outfile.file.Stat()
+
+		if err != nil {
+			return nil, err
+		}
+
+		files[i] = resumeFileState{
+			Length: stat.Size(),
+			Mtime:  stat.ModTime().UnixNano(),
+		}
+	}
+
+	return files, nil
+}
+
+// resume loads the resume state of a previous run and marks its pieces as done. The pieces are
+// trusted as is when the output files have not changed since the state was saved, otherwise each
+// of them is checked against its hash. Output files are then resized to their expected length.
+func (dsm *DownloadSessionManger) resume() error {
+	state, ok := dsm.loadResumeState()
+
+	if ok {
+		current, err := dsm.fileStates()
+
+		if err != nil {
+			return err
+		}
+
+		unchanged := len(current) == len(state.Files)
+
+		for i := 0; unchanged && i < len(current); i++ {
+			unchanged = current[i] == state.Files[i]
+		}
+
+		bf := bitfield.Bitfield(state.Bitfield)
+
+		for i := range dsm.T.PieceHashes {
+			if !bf.HasPiece(i) {
+				continue
+			}
+
+			if unchanged || dsm.verifyPiece(i) {
+				dsm.Bitfield.SetPiece(i)
+				dsm.Picker.SetDone(i)
+			}
+		}
+	}
+
+	for _, outfile := range dsm.Outfiles {
+		// the parts file is sparse, it is never resized
+		if outfile.padding || outfile.unselected {
+			continue
+		}
+
+		stat, err := outfile.file.Stat()
+
+		if err != nil {
+			return err
+		}
+
+		if stat.Size() == int64(outfile.length) {
+			continue
+		}
+
+		err = outfile.file.Truncate(int64(outfile.length))
+
+		if err != nil {
+			return err
+		}
+	}
+
+	dsm.lastResumeSave = time.Now()
+
+	return nil
+}
+
+// loadResumeState reads the resume state of the torrent, a missing or unusable state is ignored
+func (dsm *DownloadSessionManger) loadResumeState() (*resumeState, bool) {
+	data, err := os.ReadFile(dsm.T.resumeFilePath())
+
+	if err != nil {
+		return nil, false
+	}
+
+	var state resumeState
+
+	err = bencode.DecodeBytes(data, &state)
+
+	if err != nil {
+		return nil, false
+	}
+
+	if !bytes.Equal(state.InfoHash, dsm.T.InfoHash[:]) || len(state.Bitfield) != len(dsm.Bitfield) {
+		return nil, false
+	}
+
+	return &state, true
+}
+
+// verifyPiece reads a piece back from the output files and checks it against its hash
+func (dsm *DownloadSessionManger) verifyPiece(index int) bool {
+	data, err := dsm.ReadBlock(index, 0, dsm.T.getPieceLength(index))
+
+	if err != nil {
+		return false
+	}
+
+	return dsm.T.PieceHashes[index].Verify(data)
+}
@@ -0,0 +1,327 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const resumePieceLength = 16
+
+// newResumeTorrent returns a torrent of 4 pieces over two files, a.bin holds piece 0 and the
+// start of piece 1 while b.bin holds the rest of piece 1 and pieces 2 and 3
+func newResumeTorrent(t *testing.T, content []byte) *Torrent {
+	var hashes [][20]byte
+
+	for begin := 0; begin < len(content); begin += resumePieceLength {
+		hashes = append(hashes, sha1.Sum(content[begin:begin+resumePieceLength]))
+	}
+
+	return &Torrent{
+		Name:        "dir",
+		InfoHash:    [20]byte{1, 2, 3},
+		PieceHashes: V1PieceHashes(hashes),
+		PieceLength: resumePieceLength,
+		Length:      len(content),
+		Files: []File{
+			{Path: "a.bin", Length: 24},
+			{Path: "b.bin", Length: 40},
+		},
+		Outpath: t.TempDir(),
+		Config:  &Config{},
+	}
+}
+
+func resumeContent() []byte {
+	content := make([]byte, 64)
+	rand.Read(content)
+
+	return content
+}
+
+// writeContent puts the content of the torrent on disk, as a previous run downloaded it
+func writeContent(t *testing.T, torrent *Torrent, content []byte) {
+	t.Helper()
+
+	dir := filepath.Join(torrent.Outpath, torrent.Name)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "a.bin"), content[:24], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filepath.Join(dir, "b.bin"), content[24:], 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// saveSession opens the torrent, marks pieces as verified and closes it, which saves the
+// resume state
+func saveSession(t *testing.T, torrent *Torrent, pieces ...int) {
+	t.Helper()
+
+	dsm, err := torrent.Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.mu.Lock()
+	for _, index := range pieces {
+		dsm.Bitfield.SetPiece(index)
+	}
+	dsm.mu.Unlock()
+
+	dsm.Close()
+}
+
+// resumedPieces opens the torrent again and returns the pieces taken from the resume state
+func resumedPieces(t *testing.T, torrent *Torrent) []int {
+	t.Helper()
+
+	dsm, err := torrent.Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dsm.Close()
+
+	var pieces []int
+
+	for i := range torrent.PieceHashes {
+		if dsm.hasPiece(i) {
+			pieces = append(pieces, i)
+		}
+	}
+
+	if dsm.Picker.Completed() != len(pieces) {
+		t.Fatalf("picker has %d pieces done, want %d", dsm.Picker.Completed(), len(pieces))
+	}
+
+	return pieces
+}
+
+func checkPieces(t *testing.T, got []int, want ...int) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("resumed pieces %v, want %v", got, want)
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("resumed pieces %v, want %v", got, want)
+		}
+	}
+}
+
+func TestResumeRoundTrip(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	saveSession(t, torrent, 0, 2)
+
+	checkPieces(t, resumedPieces(t, torrent), 0, 2)
+}
+
+func TestResumeTrustsUnchangedFiles(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	// the state says piece 3 was verified, which the unchanged files are not checked against
+	saveSession(t, torrent, 3)
+
+	path := filepath.Join(torrent.Outpath, torrent.Name, "b.bin")
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupted := append([]byte(nil), content[24:]...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	if err = os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkPieces(t, resumedPieces(t, torrent), 3)
+}
+
+func TestResumeVerifiesChangedFiles(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	saveSession(t, torrent, 0, 1, 2, 3)
+
+	// piece 3 changed on disk since the state was saved
+	path := filepath.Join(torrent.Outpath, torrent.Name, "b.bin")
+	corrupted := append([]byte(nil), content[24:]...)
+	corrupted[len(corrupted)-1] ^= 1
+
+	if err := os.WriteFile(path, corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	later := time.Now().Add(time.Hour)
+
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+
+	checkPieces(t, resumedPieces(t, torrent), 0, 1, 2)
+}
+
+func TestResumeVerifiesResizedFiles(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	saveSession(t, torrent, 0, 1)
+
+	path := filepath.Join(torrent.Outpath, torrent.Name, "a.bin")
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a.bin lost the part of piece 1 it holds, its mtime is kept
+	if err = os.Truncate(path, 16); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.Chtimes(path, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+
+	checkPieces(t, resumedPieces(t, torrent), 0)
+}
+
+func TestResumeIgnoresOtherTorrent(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	saveSession(t, torrent, 0, 1, 2, 3)
+
+	torrent.InfoHash = [20]byte{4, 5, 6}
+
+	checkPieces(t, resumedPieces(t, torrent))
+}
+
+func TestResumeTruncatesLongFiles(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	path := filepath.Join(torrent.Outpath, torrent.Name, "b.bin")
+
+	if err := os.WriteFile(path, append(content[24:], "trailing data"...), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dsm, err := torrent.Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dsm.Close()
+
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Size() != 40 {
+		t.Fatalf("b.bin is %d bytes long, want 40", stat.Size())
+	}
+}
+
+func TestResumeMissingFile(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	saveSession(t, torrent, 0, 1, 2, 3)
+
+	if err := os.Remove(filepath.Join(torrent.Outpath, torrent.Name, "b.bin")); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the piece held by a.bin alone survives
+	checkPieces(t, resumedPieces(t, torrent), 0)
+}
+
+func TestVerifySavesResumeState(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	// piece 1 spans both files
+	corrupted := append([]byte(nil), content[:24]...)
+	corrupted[20] ^= 1
+
+	if err := os.WriteFile(filepath.Join(torrent.Outpath, torrent.Name, "a.bin"), corrupted, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := torrent.Verify()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Verified != 3 || result.ResumeFile != torrent.resumeFilePath() {
+		t.Fatalf("verified %d pieces saved to %q", result.Verified, result.ResumeFile)
+	}
+
+	if result.Files[0].Verified != 16 || result.Files[1].Verified != 32 {
+		t.Fatalf("verified files %+v", result.Files)
+	}
+
+	checkPieces(t, resumedPieces(t, torrent), 0, 2, 3)
+}
+
+func TestVerifyRemovesStaleResumeState(t *testing.T) {
+	content := resumeContent()
+	torrent := newResumeTorrent(t, content)
+	writeContent(t, torrent, content)
+
+	saveSession(t, torrent, 0, 1, 2, 3)
+
+	// every file was replaced by other content of the same size
+	writeContent(t, torrent, resumeContent())
+
+	result, err := torrent.Verify()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Verified != 0 || result.ResumeFile != "" {
+		t.Fatalf("verified %d pieces saved to %q", result.Verified, result.ResumeFile)
+	}
+
+	if _, err := os.Stat(torrent.resumeFilePath()); !os.IsNotExist(err) {
+		t.Fatal("resume state claiming the replaced pieces kept")
+	}
+
+	checkPieces(t, resumedPieces(t, torrent))
+}
@@ -0,0 +1,276 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/message"
+)
+
+const (
+	// requests bigger than this are dropped, as most clients do
+	maxRequestLength   = 131072
+	seedStatusInterval = time.Second
+)
+
+// addClient registers a connected peer so that it is told about newly downloaded pieces,
+// sending it the pieces we already have first. It returns false if we are already
+// connected to the same address.
+func (dsm *DownloadSessionManger) addClient(c *client.Client) bool {
+	dsm.mu.Lock()
+
+	for other := range dsm.clients {
+		if other.Peer.Address == c.Peer.Address {
+			dsm.mu.Unlock()
+			return false
+		}
+	}
+
+	// nothing else is sent to the peer before the pieces we have, which are sent without the
+	// lock as the connection may be slow
+	dsm.clients[c] = false
+
+	hasAll, hasNone := dsm.hasAllPieces(), dsm.hasNoPieces()
+	sent := make(bitfield.Bitfield, len(dsm.Bitfield))
+	copy(sent, dsm.Bitfield)
+
+	dsm.mu.Unlock()
+
+	switch {
+	case c.SupportsFastExtension && hasAll:
+		c.SendHaveAllMsg()
+	case c.SupportsFastExtension && hasNone:
+		c.SendHaveNoneMsg()
+	case !hasNone:
+		c.SendBitfieldMsg(sent)
+	}
+
+	dsm.mu.Lock()
+
+	dsm.clients[c] = true
+
+	// the pieces done in the meantime were not announced to the peer yet
+	var missed []int
+
+	for i := range dsm.T.PieceHashes {
+		if dsm.Bitfield.HasPiece(i) && !sent.HasPiece(i) {
+			missed = append(missed, i)
+		}
+	}
+
+	dsm.mu.Unlock()
+
+	for _, index := range missed {
+		c.SendHaveMsg(index)
+	}
+
+	return true
+}
+
+func (dsm *DownloadSessionManger) removeClient(c *client.Client) {
+	dsm.mu.Lock()
+	defer dsm.mu.Unlock()
+
+	delete(dsm.clients, c)
+	delete(dsm.pexSent, c)
+}
+
+// markPieceDone records a piece as available for upload and announces it to every connected peer
+func (dsm *DownloadSessionManger) markPieceDone(index int) {
+	dsm.mu.Lock()
+	dsm.Bitfield.SetPiece(index)
+	dsm.mu.Unlock()
+
+	for _, c := range dsm.connectedClients() {
+		c.SendHaveMsg(index)
+	}
+}
+
+// hasAllPieces must be called with the lock held
+func (dsm *DownloadSessionManger) hasAllPieces() bool {
+	for i := 0; i < len(dsm.T.PieceHashes); i++ {
+		if !dsm.Bitfield.HasPiece(i) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasNoPieces must be called with the lock held
+func (dsm *DownloadSessionManger) hasNoPieces() bool {
+	for _, b := range dsm.Bitfield {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (dsm *DownloadSessionManger) hasPiece(index int) bool {
+	dsm.mu.Lock()
+	defer dsm.mu.Unlock()
+
+	return dsm.Bitfield.HasPiece(index)
+}
+
+func (dsm *DownloadSessionManger) Uploaded() int64 {
+	return dsm.uploaded.Load()
+}
+
+// seedRatio returns the bytes uploaded over the bytes of the pieces we have, rather than the length
+// of the torrent, as only some of its files may have been downloaded
+func (dsm *DownloadSessionManger) seedRatio() float64 {
+	dsm.mu.Lock()
+
+	length := 0
+
+	for i := range dsm.T.PieceHashes {
+		if dsm.Bitfield.HasPiece(i) {
+			length += dsm.T.getPieceLength(i)
+		}
+	}
+
+	dsm.mu.Unlock()
+
+	if length == 0 {
+		return 0
+	}
+
+	return float64(dsm.Uploaded()) / float64(length)
+}
+
+// ReadBlock reads a block of a downloaded piece back from the output files
+func (dsm *DownloadSessionManger) ReadBlock(index, begin, length int) ([]byte, error) {
+	blockStart := index*dsm.T.PieceLength + begin
+	blockEnd := blockStart + length
+
+	data := make([]byte, length)
+	bytesRead := 0
+
+	for _, file := range dsm.PieceToFileMap[index] {
+		fileStart := max(blockStart, file.startRange)
+		fileEnd := min(blockEnd, file.endRange)
+
+		if fileStart >= fileEnd {
+			continue
+		}
+
+		// padding reads as zeros
+		if file.padding {
+			bytesRead += fileEnd - fileStart
+			continue
+		}
+
+		if file.file == nil {
+			return nil, fmt.Errorf("file for piece %d is missing", index)
+		}
+
+		readOffset := fileStart - file.startRange + file.offset
+
+		n, err := file.file.ReadAt(data[fileStart-blockStart:fileEnd-blockStart], int64(readOffset))
+		if err != nil {
+			return nil, err
+		}
+
+		bytesRead += n
+	}
+
+	if bytesRead != length {
+		return nil, fmt.Errorf("failed to read block from files, piece index: %d, begin: %d, length: %d, bytes read: %d", index, begin, length, bytesRead)
+	}
+
+	return data, nil
+}
+
+// serveRequest answers a block request from a peer with a piece message, requests which
+// are not served are rejected if the peer supports the fast extension
+func (dsm *DownloadSessionManger) serveRequest(c *client.Client, payload []byte) error {
+	index, begin, length, err := message.ParseRequestPayload(payload)
+
+	if err != nil {
+		return err
+	}
+
+	// a choked peer is not allowed to request anything
+	if c.AmChoking() {
+		return rejectRequest(c, index, begin, length)
+	}
+
+	if index >= len(dsm.T.PieceHashes) || length > maxRequestLength || begin+length > dsm.T.getPieceLength(index) {
+		return fmt.Errorf("invalid request for piece %d, begin: %d, length: %d", index, begin, length)
+	}
+
+	if !dsm.hasPiece(index) {
+		return rejectRequest(c, index, begin, length)
+	}
+
+	block, err := dsm.ReadBlock(index, begin, length)
+
+	if err != nil {
+		return err
+	}
+
+	err = c.SendPieceMsg(index, begin, block)
+
+	if err != nil {
+		return err
+	}
+
+	dsm.uploaded.Add(int64(length))
+	c.Uploaded.Add(int64(length))
+
+	return nil
+}
+
+func rejectRequest(c *client.Client, index, begin, length int) error {
+	if !c.SupportsFastExtension {
+		return nil
+	}
+
+	return c.SendRejectRequestMsg(index, begin, length)
+}
+
+// Seed keeps serving the connected peers after the download has completed until
+// the configured ratio or time limit is reached or the context is cancelled, then ends the session
+func (dsm *DownloadSessionManger) Seed(ctx context.Context) {
+	defer dsm.end()
+
+	config := dsm.T.Config
+
+	if !config.shouldSeed() {
+		return
+	}
+
+	start := time.Now()
+	ticker := time.NewTicker(seedStatusInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			fmt.Println()
+			return
+		case <-ticker.C:
+		}
+
+		ratio := dsm.seedRatio()
+		elapsed := time.Since(start)
+
+		fmt.Printf("\rSeeding  uploaded: %d bytes, ratio: %0.2f, elapsed: %s   ", dsm.Uploaded(), ratio, elapsed.Round(time.Second))
+
+		if config.SeedRatio > 0 && ratio >= config.SeedRatio {
+			break
+		}
+
+		if config.SeedTime > 0 && elapsed >= config.SeedTime {
+			break
+		}
+	}
+
+	fmt.Println()
+}
@@ -0,0 +1,144 @@
+package p2p
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/message"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+func newTestSession(numPieces int) *DownloadSessionManger {
+	return &DownloadSessionManger{
+		T:        &Torrent{PieceHashes: make([]PieceHash, numPieces), Config: &Config{}},
+		Bitfield: bitfield.New(numPieces),
+		Done:     make(chan struct{}),
+		closed:   make(chan struct{}),
+		peers:    newPeerManager(),
+		clients:  make(map[*client.Client]bool),
+		pexSent:  make(map[*client.Client]map[string]bool),
+	}
+}
+
+func TestMarkPieceDoneWithSlowPeer(t *testing.T) {
+	dsm := newTestSession(4)
+
+	// nothing reads from the other end, sending to the peer blocks
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	dsm.clients[&client.Client{Conn: conn, Peer: peer.Peer{Address: "a"}}] = true
+
+	go dsm.markPieceDone(0)
+
+	done := make(chan bool)
+
+	go func() {
+		for !dsm.hasPiece(0) {
+			time.Sleep(time.Millisecond)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("the session is locked while a peer is sent a have message")
+	}
+}
+
+func TestAddClientAnnouncesPiecesDoneMeanwhile(t *testing.T) {
+	dsm := newTestSession(4)
+	dsm.Bitfield.SetPiece(0)
+
+	conn, other := net.Pipe()
+	defer conn.Close()
+	defer other.Close()
+
+	c := &client.Client{Conn: conn, Peer: peer.Peer{Address: "a"}}
+
+	added := make(chan bool)
+
+	go func() {
+		added <- dsm.addClient(c)
+	}()
+
+	// the bitfield is being sent, the peer only hears about the new piece after it
+	time.Sleep(20 * time.Millisecond)
+	dsm.markPieceDone(1)
+
+	msg, err := message.Read(other)
+
+	if err != nil || msg.ID != message.BitfieldMessageID {
+		t.Fatalf("first message %v %v, want the bitfield", msg, err)
+	}
+
+	if bf := bitfield.Bitfield(msg.Payload); !bf.HasPiece(0) || bf.HasPiece(1) {
+		t.Fatalf("bitfield %08b", msg.Payload)
+	}
+
+	msg, err = message.Read(other)
+
+	if err != nil || msg.ID != message.HaveMessageID {
+		t.Fatalf("second message %v %v, want have", msg, err)
+	}
+
+	if index, _ := message.ParseHavePayload(msg.Payload); index != 1 {
+		t.Fatalf("have %d, want 1", index)
+	}
+
+	if !<-added {
+		t.Fatal("client not added")
+	}
+
+	if dsm.addClient(&client.Client{Peer: peer.Peer{Address: "a"}}) {
+		t.Fatal("second client with the same address added")
+	}
+}
+
+func TestCloseEndsSession(t *testing.T) {
+	dsm := newTestSession(4)
+	dsm.T.Outpath = t.TempDir()
+	dsm.T.Name = "test"
+
+	// the download failed, Seed is never called
+	dsm.Close()
+
+	select {
+	case <-dsm.Done:
+	default:
+		t.Fatal("Close left the workers running")
+	}
+
+	// and a session which seeded before being closed ends only once
+	dsm = newTestSession(4)
+	dsm.T.Outpath = t.TempDir()
+	dsm.T.Name = "test"
+
+	dsm.Seed(context.Background())
+	dsm.Close()
+}
+
+func TestSeedRatioOfSelectedPieces(t *testing.T) {
+	dsm := newTestSession(4)
+	dsm.T.PieceLength = 10
+	dsm.T.Length = 35
+
+	if ratio := dsm.seedRatio(); ratio != 0 {
+		t.Fatalf("ratio without pieces = %f", ratio)
+	}
+
+	// only the first and the shorter last piece were downloaded
+	dsm.Bitfield.SetPiece(0)
+	dsm.Bitfield.SetPiece(3)
+	dsm.uploaded.Store(30)
+
+	if ratio := dsm.seedRatio(); ratio != 2 {
+		t.Fatalf("ratio = %f, want 2", ratio)
+	}
+}
@@ -0,0 +1,144 @@
+package p2p
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// FileSelection picks the files of a multi-file torrent to download, with a comma separated list
+// of file indices, ranges of indices such as 2-5, and glob patterns matched against the path or
+// the name of the files. Files are numbered from 0 in the order of the torrent, leaving out
+// padding files.
+type FileSelection struct {
+	items    []string
+	ranges   [][2]int
+	patterns []string
+}
+
+// ParseFileSelection parses a list of file indices, ranges and patterns, as given on the command
+// line or in the so parameter of a magnet link described in BEP 53
+func ParseFileSelection(spec string) (*FileSelection, error) {
+	s := &FileSelection{}
+
+	err := s.Set(spec)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileSelection) String() string {
+	if s == nil {
+		return ""
+	}
+
+	return strings.Join(s.items, ",")
+}
+
+// Set adds the items of a list to the selection, so that the flag can be given multiple times
+func (s *FileSelection) Set(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+
+		if item == "" {
+			continue
+		}
+
+		if first, last, ok := parseIndexRange(item); ok {
+			if first > last {
+				return fmt.Errorf("invalid file range %s", item)
+			}
+
+			s.ranges = append(s.ranges, [2]int{first, last})
+		} else {
+			if _, err := path.Match(item, ""); err != nil {
+				return fmt.Errorf("invalid file pattern %s", item)
+			}
+
+			s.patterns = append(s.patterns, item)
+		}
+
+		s.items = append(s.items, item)
+	}
+
+	return nil
+}
+
+// parseIndexRange parses a single index or a range of indices
+func parseIndexRange(item string) (first, last int, ok bool) {
+	firstPart, lastPart, isRange := strings.Cut(item, "-")
+
+	first, err := strconv.Atoi(firstPart)
+
+	if err != nil || first < 0 {
+		return 0, 0, false
+	}
+
+	if !isRange {
+		return first, first, true
+	}
+
+	last, err = strconv.Atoi(lastPart)
+
+	if err != nil || last < 0 {
+		return 0, 0, false
+	}
+
+	return first, last, true
+}
+
+// Selects tells if the file with the given index and path within the torrent is selected
+func (s *FileSelection) Selects(index int, filePath string) bool {
+	for _, r := range s.ranges {
+		if index >= r[0] && index <= r[1] {
+			return true
+		}
+	}
+
+	filePath = filepath.ToSlash(filePath)
+
+	for _, pattern := range s.patterns {
+		if matched, _ := path.Match(pattern, filePath); matched {
+			return true
+		}
+
+		if matched, _ := path.Match(pattern, path.Base(filePath)); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// selectedFiles tells for each file of the torrent whether it is downloaded, it returns nil when
+// every file is
+func (t *Torrent) selectedFiles() ([]bool, error) {
+	if t.Selection == nil || len(t.Files) == 0 {
+		return nil, nil
+	}
+
+	selected := make([]bool, len(t.Files))
+	index := 0
+	anySelected := false
+
+	for i, file := range t.Files {
+		if file.Padding {
+			continue
+		}
+
+		selected[i] = t.Selection.Selects(index, file.Path)
+		anySelected = anySelected || selected[i]
+		index++
+	}
+
+	if !anySelected {
+		return nil, fmt.Errorf("no file of the torrent matches the selection %s", t.Selection.String())
+	}
+
+	return selected, nil
+}
@@ -0,0 +1,167 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFileSelection(t *testing.T) {
+	selection, err := ParseFileSelection("0, 3-4,*.txt,docs/*.md,")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if selection.String() != "0,3-4,*.txt,docs/*.md" {
+		t.Fatalf("selection is %q", selection.String())
+	}
+
+	tests := []struct {
+		index int
+		path  string
+		want  bool
+	}{
+		{0, "a.bin", true},
+		{1, "b.bin", false},
+		{3, "c.bin", true},
+		{4, "d.bin", true},
+		{5, "e.bin", false},
+		// patterns match the name of a file as well as its whole path
+		{6, filepath.Join("sub", "notes.txt"), true},
+		{7, filepath.Join("docs", "readme.md"), true},
+		{8, filepath.Join("other", "readme.md"), false},
+	}
+
+	for _, test := range tests {
+		if got := selection.Selects(test.index, test.path); got != test.want {
+			t.Errorf("selects file %d %s is %v, want %v", test.index, test.path, got, test.want)
+		}
+	}
+}
+
+func TestParseFileSelectionInvalid(t *testing.T) {
+	for _, spec := range []string{"5-2", "[a-"} {
+		if _, err := ParseFileSelection(spec); err == nil {
+			t.Errorf("parsed invalid selection %q", spec)
+		}
+	}
+
+	// items which are not indices are patterns
+	selection, err := ParseFileSelection("1-x")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if selection.Selects(1, "a.bin") || !selection.Selects(0, "1-x") {
+		t.Fatal("1-x not taken as a pattern")
+	}
+}
+
+func TestSelectedFilesSkipPadding(t *testing.T) {
+	selection, err := ParseFileSelection("1")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrent := &Torrent{
+		Files: []File{
+			{Path: "a.bin", Length: 10},
+			{Path: filepath.Join(".pad", "6"), Length: 6, Padding: true},
+			{Path: "b.bin", Length: 16},
+		},
+		Selection: selection,
+	}
+
+	selected, err := torrent.selectedFiles()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// padding files are not numbered, so index 1 is b.bin
+	want := []bool{false, false, true}
+
+	for i := range want {
+		if selected[i] != want[i] {
+			t.Fatalf("selected files are %v, want %v", selected, want)
+		}
+	}
+
+	torrent.Selection, _ = ParseFileSelection("2,*.iso")
+
+	if _, err := torrent.selectedFiles(); err == nil {
+		t.Fatal("selection matching no file accepted")
+	}
+
+	torrent.Selection = nil
+
+	if selected, _ := torrent.selectedFiles(); selected != nil {
+		t.Fatal("files selected without a selection")
+	}
+}
+
+func TestBoundaryPieceGoesToPartsFile(t *testing.T) {
+	selection, err := ParseFileSelection("a.bin")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// piece 1 holds the end of a.bin and the whole of b.bin
+	torrent := newPriorityTorrent(t, nil)
+	torrent.Selection = selection
+
+	dsm, err := torrent.Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 16)
+	rand.Read(data)
+
+	piece := &PieceResult{Index: 1, Length: 16, Data: data}
+
+	if err := piece.WriteToFiles(dsm.PieceToFileMap[1], torrent.PieceLength); err != nil {
+		t.Fatal(err)
+	}
+
+	// b.bin and c.bin share the parts file, which is closed once
+	if err := dsm.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(torrent.Outpath, torrent.Name)
+
+	for _, name := range []string{"b.bin", "c.bin"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Fatalf("unselected file %s created", name)
+		}
+	}
+
+	a, err := os.ReadFile(filepath.Join(dir, "a.bin"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(a[16:24], data[:8]) {
+		t.Fatal("end of the piece not written to a.bin")
+	}
+
+	parts, err := os.ReadFile(torrent.partsFilePath())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parts file holds b.bin at the position it has in the torrent
+	if len(parts) < 32 || !bytes.Equal(parts[24:32], data[8:]) {
+		t.Fatal("part of b.bin not written to the parts file")
+	}
+}
@@ -0,0 +1,121 @@
+package p2p
+
+import (
+	"os"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+)
+
+type VerifyResult struct {
+	Bitfield bitfield.Bitfield
+	Pieces   int
+	Verified int
+	Files    []FileVerifyResult
+	// ResumeFile is where the verified pieces were saved, empty if none were found
+	ResumeFile string
+}
+
+type FileVerifyResult struct {
+	Path   string
+	Length int
+	// Verified is the number of bytes of the file covered by pieces matching their hash
+	Verified int
+}
+
+// Verify hash checks the data already present in the output path against the piece hashes,
+// and saves the verified pieces as resume state so that a download only fetches the rest
+func (t *Torrent) Verify() (*VerifyResult, error) {
+	outfiles, err := t.openOutputFiles(openExistingFile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	dsm := &DownloadSessionManger{
+		Outfiles:       outfiles,
+		PieceToFileMap: t.mapPiecesToFiles(outfiles),
+		T:              t,
+		Bitfield:       bitfield.New(len(t.PieceHashes)),
+	}
+
+	defer dsm.CloseFiles()
+
+	result := &VerifyResult{
+		Bitfield: dsm.Bitfield,
+		Pieces:   len(t.PieceHashes),
+	}
+
+	// index of the result of each output file, padding files are left out
+	resultIndex := make([]int, len(outfiles))
+
+	for i, outfile := range outfiles {
+		if outfile.padding {
+			resultIndex[i] = -1
+			continue
+		}
+
+		path := t.Name
+
+		if len(t.Files) > 0 {
+			path = t.Files[i].Path
+		}
+
+		resultIndex[i] = len(result.Files)
+		result.Files = append(result.Files, FileVerifyResult{
+			Path:   path,
+			Length: outfile.length,
+		})
+	}
+
+	for i := range t.PieceHashes {
+		if !dsm.verifyPiece(i) {
+			continue
+		}
+
+		dsm.Bitfield.SetPiece(i)
+		result.Verified++
+
+		pieceStart := i * t.PieceLength
+		pieceEnd := pieceStart + t.getPieceLength(i)
+
+		for fileIndex, outfile := range outfiles {
+			overlap := min(pieceEnd, outfile.endRange) - max(pieceStart, outfile.startRange)
+
+			if overlap > 0 && resultIndex[fileIndex] >= 0 {
+				result.Files[resultIndex[fileIndex]].Verified += overlap
+			}
+		}
+	}
+
+	if result.Verified == 0 {
+		// a state left by an earlier run would claim pieces which are not there anymore
+		err = os.Remove(t.resumeFilePath())
+
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+
+		return result, nil
+	}
+
+	err = dsm.SaveResumeState()
+
+	if err != nil {
+		return nil, err
+	}
+
+	result.ResumeFile = t.resumeFilePath()
+
+	return result, nil
+}
+
+// openExistingFile opens a file for reading, a missing file is reported as nil rather than an error
+func openExistingFile(path string) (*os.File, error) {
+	file, err := os.Open(path)
+
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	return file, err
+}
@@ -0,0 +1,258 @@
+package p2p
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+)
+
+const (
+	// pieces downloaded at the same time from each web seed
+	webSeedConnections = 2
+	webSeedTimeout     = time.Minute
+	// a web seed is retried after this long when it fails, doubling up to the maximum
+	webSeedRetryInterval    = 15 * time.Second
+	maxWebSeedRetryInterval = 10 * time.Minute
+	// consecutive failures after which a web seed is given up on
+	maxWebSeedFailures = 8
+)
+
+var webSeedClient = &http.Client{Timeout: webSeedTimeout}
+
+// StartWebSeeds downloads pieces from the http mirrors of the torrent, as described in BEP 19,
+// alongside the peers. The returned function stops them.
+func (dsm *DownloadSessionManger) StartWebSeeds(ctx context.Context) (stop func()) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	for _, webSeed := range dsm.T.WebSeeds {
+		for i := 0; i < webSeedConnections; i++ {
+			wg.Add(1)
+
+			go func(webSeed string) {
+				defer wg.Done()
+				dsm.runWebSeed(ctx, webSeed)
+			}(webSeed)
+		}
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// runWebSeed competes with the peers for pieces, fetching each one with http range requests
+// until the download completes or the web seed keeps failing
+func (dsm *DownloadSessionManger) runWebSeed(ctx context.Context, webSeed string) {
+	all := bitfield.New(len(dsm.T.PieceHashes))
+
+	for i := range dsm.T.PieceHashes {
+		all.SetPiece(i)
+	}
+
+	failures := 0
+	retryInterval := webSeedRetryInterval
+
+	for {
+		changed := dsm.Picker.Changed()
+
+		pd := dsm.Picker.Pick(all, "")
+
+		if pd == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-dsm.downloadComplete:
+				return
+			case <-changed:
+			}
+			continue
+		}
+
+		buffer, err := dsm.fetchPiece(ctx, webSeed, pd)
+
+		if err != nil {
+			dsm.Picker.Release(pd)
+
+			failures++
+
+			if failures >= maxWebSeedFailures {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-dsm.downloadComplete:
+				return
+			case <-time.After(retryInterval):
+			}
+
+			retryInterval = minDuration(retryInterval*2, maxWebSeedRetryInterval)
+			continue
+		}
+
+		failures = 0
+		retryInterval = webSeedRetryInterval
+
+		if buffer == nil {
+			// peers completed the piece first during endgame
+			dsm.Picker.Release(pd)
+			continue
+		}
+
+		work := pd.work
+
+		verified := work.Hash.Verify(buffer)
+
+		dsm.Picker.Finish(pd, verified)
+		dsm.Picker.Release(pd)
+
+		if !verified {
+			// peers may have sent some of the blocks during endgame
+			dsm.pieceFailed(pd)
+
+			// a mirror serving other content is of no use
+			failures++
+
+			if failures >= maxWebSeedFailures {
+				return
+			}
+
+			continue
+		}
+
+		dsm.pieceVerified(pd)
+
+		select {
+		case dsm.Results <- &PieceResult{Index: work.Index, Length: work.Length, Data: buffer}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchPiece downloads a piece from a web seed, it returns the piece data if the blocks it
+// brought completed the piece, or nil if the peers did
+func (dsm *DownloadSessionManger) fetchPiece(ctx context.Context, webSeed string, pd *pieceDownload) ([]byte, error) {
+	index := pd.work.Index
+
+	pieceStart := index * dsm.T.PieceLength
+	pieceEnd := pieceStart + pd.work.Length
+
+	data := make([]byte, 0, pd.work.Length)
+
+	for _, file := range dsm.PieceToFileMap[index] {
+		fileStart := max(pieceStart, file.startRange)
+		fileEnd := min(pieceEnd, file.endRange)
+
+		if fileStart >= fileEnd {
+			continue
+		}
+
+		// web seeds do not serve padding files
+		if file.padding {
+			data = append(data, make([]byte, fileEnd-fileStart)...)
+			continue
+		}
+
+		fileData, err := fetchRange(ctx, dsm.T.webSeedURL(webSeed, file.path), fileStart-file.startRange, fileEnd-fileStart, file.length)
+
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, fileData...)
+	}
+
+	for block := range pd.blocks {
+		begin, length := pd.blockRange(block)
+
+		if dsm.Picker.AddBlock(pd, block, data[begin:begin+length], "") {
+			return pd.data(), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// webSeedURL returns the url of a file of the torrent on a web seed. A url ending with a slash
+// is the directory holding the torrent, otherwise it is the file itself for single file torrents.
+func (t *Torrent) webSeedURL(webSeed string, path string) string {
+	if len(t.Files) == 0 {
+		if strings.HasSuffix(webSeed, "/") {
+			return webSeed + url.PathEscape(t.Name)
+		}
+
+		return webSeed
+	}
+
+	if !strings.HasSuffix(webSeed, "/") {
+		webSeed += "/"
+	}
+
+	segments := []string{url.PathEscape(t.Name)}
+
+	for _, segment := range strings.Split(filepath.ToSlash(path), "/") {
+		segments = append(segments, url.PathEscape(segment))
+	}
+
+	return webSeed + strings.Join(segments, "/")
+}
+
+// fetchRange downloads length bytes of a file starting at offset
+func fetchRange(ctx context.Context, fileURL string, offset, length, fileLength int) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	res, err := webSeedClient.Do(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+		if !strings.HasPrefix(res.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return nil, fmt.Errorf("web seed responded with the wrong range for %s", fileURL)
+		}
+	case res.StatusCode == http.StatusOK && offset == 0 && length == fileLength:
+		// servers ignoring the range send the whole file, which is fine if that is what we asked for
+	default:
+		return nil, fmt.Errorf("web seed responded with status %s for %s", res.Status, fileURL)
+	}
+
+	data := make([]byte, length)
+
+	_, err = io.ReadFull(res.Body, data)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from web seed: %s", err.Error())
+	}
+
+	return data, nil
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
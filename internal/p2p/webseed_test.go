@@ -0,0 +1,198 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newWebSeedServer serves the given files with range support, keyed by their unescaped path,
+// and records the escaped paths it was asked for
+func newWebSeedServer(t *testing.T, files map[string][]byte) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var requested []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.EscapedPath())
+		mu.Unlock()
+
+		content, ok := files[r.URL.Path]
+
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+	}))
+
+	t.Cleanup(server.Close)
+
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]string(nil), requested...)
+	}
+}
+
+func TestFetchRange(t *testing.T) {
+	content := []byte("0123456789abcdef")
+
+	server, _ := newWebSeedServer(t, map[string][]byte{"/file": content})
+
+	data, err := fetchRange(context.Background(), server.URL+"/file", 4, 6, len(content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "456789" {
+		t.Fatalf("fetched %q, want %q", data, "456789")
+	}
+}
+
+func TestFetchRangeWrongContentRange(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a partial response for another range than the one asked for
+		w.Header().Set("Content-Range", "bytes 0-5/16")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte("012345"))
+	}))
+	defer server.Close()
+
+	if _, err := fetchRange(context.Background(), server.URL, 4, 6, 16); err == nil {
+		t.Fatal("accepted a response for the wrong range")
+	}
+}
+
+func TestFetchRangeWholeFile(t *testing.T) {
+	content := []byte("0123456789abcdef")
+
+	// a server ignoring the range header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	data, err := fetchRange(context.Background(), server.URL, 0, len(content), len(content))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, content) {
+		t.Fatalf("fetched %q, want %q", data, content)
+	}
+
+	tests := []struct {
+		offset, length int
+	}{
+		{0, 6},
+		{4, 12},
+	}
+
+	for _, test := range tests {
+		if _, err := fetchRange(context.Background(), server.URL, test.offset, test.length, len(content)); err == nil {
+			t.Fatalf("accepted the whole file for %d bytes at %d", test.length, test.offset)
+		}
+	}
+}
+
+func TestWebSeedURL(t *testing.T) {
+	single := &Torrent{Name: "a file?.iso"}
+	multi := &Torrent{Name: "my dir", Files: []File{{Path: filepath.Join("sub #1", "b c.bin"), Length: 1}}}
+
+	tests := []struct {
+		torrent *Torrent
+		webSeed string
+		path    string
+		want    string
+	}{
+		{single, "http://seed/files/", "", "http://seed/files/a%20file%3F.iso"},
+		{single, "http://seed/mirror.iso", "", "http://seed/mirror.iso"},
+		{multi, "http://seed/files/", multi.Files[0].Path, "http://seed/files/my%20dir/sub%20%231/b%20c.bin"},
+		{multi, "http://seed/files", multi.Files[0].Path, "http://seed/files/my%20dir/sub%20%231/b%20c.bin"},
+	}
+
+	for _, test := range tests {
+		got := test.torrent.webSeedURL(test.webSeed, test.path)
+
+		if got != test.want {
+			t.Errorf("web seed url of %q with %q is %q, want %q", test.webSeed, test.path, got, test.want)
+		}
+	}
+}
+
+func TestFetchPieceAcrossFilesAndPadding(t *testing.T) {
+	content := make([]byte, 64)
+	rand.Read(content)
+
+	// the padding file aligns d.bin on the second piece and is made of zeros
+	copy(content[24:32], make([]byte, 8))
+
+	torrent := &Torrent{
+		Name: "my dir",
+		PieceHashes: V1PieceHashes([][20]byte{
+			sha1.Sum(content[:32]),
+			sha1.Sum(content[32:]),
+		}),
+		PieceLength: 32,
+		Length:      len(content),
+		Files: []File{
+			{Path: "a.bin", Length: 8},
+			{Path: filepath.Join("sub", "b c.bin"), Length: 16},
+			{Path: filepath.Join(".pad", "8"), Length: 8, Padding: true},
+			{Path: "d.bin", Length: 32},
+		},
+		Outpath: t.TempDir(),
+		Config:  &Config{},
+	}
+
+	server, requested := newWebSeedServer(t, map[string][]byte{
+		"/seed/my dir/a.bin":       content[:8],
+		"/seed/my dir/sub/b c.bin": content[8:24],
+		"/seed/my dir/d.bin":       content[32:],
+	})
+
+	dsm, err := torrent.Initiate()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer dsm.Close()
+
+	pd := dsm.Picker.Pick(onlyPiece(2, 0), "")
+
+	data, err := dsm.fetchPiece(context.Background(), server.URL+"/seed/", pd)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, content[:32]) {
+		t.Fatal("fetched piece does not match the content of the torrent")
+	}
+
+	if !torrent.PieceHashes[0].Verify(data) {
+		t.Fatal("fetched piece does not verify")
+	}
+
+	// the padding file is never asked for
+	want := []string{"/seed/my%20dir/a.bin", "/seed/my%20dir/sub/b%20c.bin"}
+	got := requested()
+
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("requested %v, want %v", got, want)
+	}
+}
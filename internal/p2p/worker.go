@@ -1,24 +1,74 @@
 package p2p
 
 import (
-	"bytes"
-	"crypto/sha1"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
 
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
 	"github.com/OmBudhiraja/torrent-client/internal/client"
 	"github.com/OmBudhiraja/torrent-client/internal/message"
 	"github.com/OmBudhiraja/torrent-client/internal/peer"
 )
 
-func (t *Torrent) StartWorker(peer peer.Peer, workQueue chan *PieceWork, resultsChan chan *PieceResult) {
-	peerClient, err := client.New(peer, t.InfoHash, t.PeerId, len(t.PieceHashes))
+const (
+	// requests the peer does not answer within this time are given up on, along with the peer
+	requestTimeout = time.Minute
+	// how often the worker looks for requests which timed out
+	timeoutCheckInterval = 5 * time.Second
+	// the peer is sent a keep alive this often, so that it does not drop us while we have nothing
+	// to send
+	keepAliveInterval = time.Minute
+)
+
+// errPeerTimeout stops the worker of a peer which left our requests unanswered or went silent
+var errPeerTimeout = errors.New("peer timed out")
+
+func (t *Torrent) StartWorker(peer peer.Peer, dsm *DownloadSessionManger) {
+	peerClient, err := client.New(peer, t.InfoHash, t.Config.PeerId, t.Config.Dialer(), t.Config.AnnouncedPort(), t.Private, len(t.PieceHashes))
 
 	if err != nil {
 		// fmt.Printf("Failed to create client for peer %s: %s\n", peer.Address, err.Error())
+		dsm.peerDisconnected(peer.Address, false)
 		return
 	}
+
+	err = t.runClient(peerClient, dsm)
+
+	dsm.peerDisconnected(peer.Address, isUseful(peerClient, err))
+}
+
+// isUseful tells if a peer was worth connecting to, peers which did not exchange any block or
+// timed out are retried later, in case they were busy
+func isUseful(c *client.Client, err error) bool {
+	if errors.Is(err, errPeerTimeout) {
+		return false
+	}
+
+	return c.Downloaded.Load() > 0 || c.Uploaded.Load() > 0
+}
+
+// AdoptWorker works with a peer connected before the session started, such as a peer the metadata
+// of a magnet link was downloaded from. The peer manager accounts for it like for the peers it
+// connects to itself, the worker does not start when the peer is banned or there is no room for it.
+func (t *Torrent) AdoptWorker(c *client.Client, dsm *DownloadSessionManger, messageChan chan *client.MessageResult, closeChan chan struct{}) {
+	if !dsm.adoptPeer(c.Peer) {
+		return
+	}
+
+	err := t.ResumeWorker(c, dsm, messageChan, closeChan)
+
+	dsm.peerDisconnected(c.Peer.Address, isUseful(c, err))
+}
+
+// runClient reads the peer messages in the background and works with the peer until either side is done
+func (t *Torrent) runClient(peerClient *client.Client, dsm *DownloadSessionManger) error {
 	defer peerClient.Conn.Close()
 
+	peerClient.Conn = t.Config.LimitConn(peerClient.Conn, t.DownloadLimit, t.UploadLimit)
+
 	closeChan := make(chan struct{})
 	defer close(closeChan)
 
@@ -27,95 +77,522 @@ func (t *Torrent) StartWorker(peer peer.Peer, workQueue chan *PieceWork, results
 
 	go peerClient.ParsePeerMessage(messageChan, closeChan)
 
-	t.ResumeWorker(peerClient, workQueue, resultsChan, messageChan, closeChan)
+	return t.ResumeWorker(peerClient, dsm, messageChan, closeChan)
 }
 
-func (t *Torrent) ResumeWorker(c *client.Client, workQueue chan *PieceWork, resultsChan chan *PieceResult, messageChan chan *client.MessageResult, closeChan chan struct{}) {
-	c.SendUnchokeMsg()
+// worker holds the state of the download from a single peer
+type worker struct {
+	c           *client.Client
+	dsm         *DownloadSessionManger
+	messageChan chan *client.MessageResult
+
+	// pieces the peer has told us about, as accounted for by the piece picker
+	pieces bitfield.Bitfield
+	// pieces the peer allows us to download while it is choking us
+	allowedFast bitfield.Bitfield
+	// pieces the peer rejected our requests for since it last unchoked us
+	rejected bitfield.Bitfield
+
+	// active holds the pieces downloaded from the peer, in the order they were picked, so that
+	// requests stay outstanding across piece boundaries
+	active []*activePiece
+	// outstanding is the number of requests the peer has not answered yet
+	outstanding int
+	pipeline    *pipeline
+	// lastBlock is when the last block we requested arrived from the peer
+	lastBlock time.Time
+}
+
+// activePiece is a piece downloaded from the peer along with the state of its requests
+type activePiece struct {
+	pd *pieceDownload
+	// requested holds when each block requested from the peer which has not arrived was sent
+	requested map[int]time.Time
+	// rejected holds the blocks the peer rejected, they are left to other peers
+	rejected map[int]bool
+}
+
+// ResumeWorker works with a peer whose messages are read into messageChan until either side is
+// done, it returns why the peer was left, nil once the session is over
+func (t *Torrent) ResumeWorker(c *client.Client, dsm *DownloadSessionManger, messageChan chan *client.MessageResult, closeChan chan struct{}) error {
+	w := &worker{
+		c:           c,
+		dsm:         dsm,
+		messageChan: messageChan,
+		pieces:      bitfield.New(len(t.PieceHashes)),
+		allowedFast: bitfield.New(len(t.PieceHashes)),
+		rejected:    bitfield.New(len(t.PieceHashes)),
+		pipeline:    newPipeline(),
+	}
+
+	// messages read before the worker started have already been applied to the client
+	w.updatePieces(c.BitField())
+
+	if c.HaveAll() {
+		w.addAllPieces()
+	}
+
+	defer dsm.Picker.RemovePeer(w.pieces)
+
+	if !dsm.addClient(c) {
+		return nil
+	}
+	defer dsm.removeClient(c)
+
+	// the choker decides when to upload to the peer
+	dsm.wakeChoker()
 	c.SendInterestedMsg()
 
-	for work := range workQueue {
-		if !c.BitField.HasPiece(work.Index) {
-			workQueue <- work
-			continue
+	defer w.releaseAll()
+
+	timeoutCheck := time.NewTicker(timeoutCheckInterval)
+	defer timeoutCheck.Stop()
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		// grab the channels before picking so that no release of a piece or delivered block is missed
+		changed := dsm.Picker.Changed()
+		delivered := dsm.Picker.Delivered()
+
+		err := w.fillPipeline()
+
+		if err != nil {
+			// fmt.Printf("Failed to request blocks from peer %s: %s\n", c.Peer.Address, err.Error())
+			return err
 		}
 
-		buffer, err := DownloadPiece(c, work, messageChan)
+		select {
+		case <-dsm.Done:
+			return nil
+		case <-changed:
+		case <-delivered:
+			err = w.cancelReceived()
+		case now := <-timeoutCheck.C:
+			err = w.checkRequests(now)
+		case <-keepAlive.C:
+			err = c.SendKeepAliveMsg()
+		case msg := <-messageChan:
+			err = msg.Err
+
+			// the peer sent nothing, not even a keep alive, for too long
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = errPeerTimeout
+			}
+
+			if err == nil {
+				err = w.handleDownloadMessage(msg)
+			}
+		}
 
 		if err != nil {
-			// fmt.Printf("Failed to download piece %d from peer %s: %s\n", work.Index, c.Peer.Address, err.Error())
-			workQueue <- work
-			closeChan <- struct{}{}
-			return
+			return err
 		}
+	}
+}
 
-		// check if hashes are same
-		hash := sha1.Sum(buffer)
+// checkRequests fails with errPeerTimeout once the peer has sent none of the blocks we requested
+// for too long, the pieces of the peer are then released for other peers to download. A peer
+// slowly working through a long queue of requests keeps sending blocks and does not time out.
+func (w *worker) checkRequests(now time.Time) error {
+	for _, a := range w.active {
+		for _, sent := range a.requested {
+			if now.Sub(sent) > requestTimeout && now.Sub(w.lastBlock) > requestTimeout {
+				return errPeerTimeout
+			}
+		}
+	}
 
-		if !bytes.Equal(hash[:], work.Hash[:]) {
-			// fmt.Printf("Piece %d from %s has incorrect hash\n", work.Index, c.Peer.Address)
-			workQueue <- work
-			continue
+	return nil
+}
+
+// updatePieces accounts for every piece of bf the peer had not told us about yet
+func (w *worker) updatePieces(bf bitfield.Bitfield) {
+	for i := 0; i < len(w.dsm.T.PieceHashes); i++ {
+		if bf.HasPiece(i) {
+			w.addPiece(i)
 		}
+	}
+}
+
+func (w *worker) addAllPieces() {
+	for i := 0; i < len(w.dsm.T.PieceHashes); i++ {
+		w.addPiece(i)
+	}
+}
+
+func (w *worker) addPiece(index int) {
+	if index >= len(w.dsm.T.PieceHashes) || w.pieces.HasPiece(index) {
+		return
+	}
+
+	w.pieces.SetPiece(index)
+	w.dsm.Picker.PeerHas(index)
+}
+
+// pickable returns the pieces we can request from the peer, only the allowed fast ones while
+// it is choking us and none that it rejected
+func (w *worker) pickable() bitfield.Bitfield {
+	if w.c.Choked() && !w.c.SupportsFastExtension {
+		return nil
+	}
+
+	bf := bitfield.New(len(w.dsm.T.PieceHashes))
 
-		c.SendHaveMsg(work.Index)
+	for i := range bf {
+		bf[i] = w.pieces[i] &^ w.rejected[i]
 
-		resultsChan <- &PieceResult{
-			Index:  work.Index,
-			Length: work.Length,
-			Data:   buffer,
+		if w.c.Choked() {
+			bf[i] &= w.allowedFast[i]
 		}
 	}
+
+	return bf
+}
+
+// unpicked returns the pickable pieces which the peer is not downloading already, as endgame hands
+// out pieces in progress
+func (w *worker) unpicked() bitfield.Bitfield {
+	bf := w.pickable()
+
+	if bf == nil {
+		return nil
+	}
+
+	for _, a := range w.active {
+		bf.ClearPiece(a.pd.work.Index)
+	}
+
+	return bf
 }
 
-func DownloadPiece(c *client.Client, work *PieceWork, messageChan chan *client.MessageResult) ([]byte, error) {
+// canRequest tells if blocks of a piece can be requested from the peer right now
+func (w *worker) canRequest(index int) bool {
+	return !w.c.Choked() || (w.c.SupportsFastExtension && w.allowedFast.HasPiece(index))
+}
+
+// handleMessage processes the messages that are not part of downloading a piece
+func (w *worker) handleMessage(msg *client.MessageResult) error {
+	if isFastMessage(msg.Id) && !w.c.SupportsFastExtension {
+		return fmt.Errorf("fast extension message from a peer which does not support it")
+	}
+
+	switch msg.Id {
+	case message.UnchokeMessageID:
+		// give the pieces the peer rejected another chance
+		w.rejected = bitfield.New(len(w.dsm.T.PieceHashes))
+	case message.HaveAllMessageID:
+		w.addAllPieces()
+	case message.AllowedFastMessageID:
+		index, err := message.ParseHavePayload(msg.Data)
+
+		if err != nil {
+			return err
+		}
+
+		// allowed fast pieces we already have are of no use
+		if !w.dsm.hasPiece(index) {
+			w.allowedFast.SetPiece(index)
+		}
+	case message.SuggestPieceMessageID:
+		// suggestions are only hints, pieces are still picked rarest first
+		_, err := message.ParseHavePayload(msg.Data)
+
+		if err != nil {
+			return err
+		}
+	case message.HaveMessageID:
+		index, err := message.ParseHavePayload(msg.Data)
 
-	var numBlocks, numBlockRecieved, backlog, requested int
+		if err != nil {
+			return err
+		}
 
-	if work.Length%maxBlockSize == 0 {
-		numBlocks = work.Length / maxBlockSize
-	} else {
-		numBlocks = work.Length/maxBlockSize + 1
+		w.addPiece(index)
+	case message.BitfieldMessageID:
+		w.updatePieces(msg.Data)
+	case message.InterestedMessageID:
+		w.dsm.wakeChoker()
+	case message.RequestMessageID:
+		return w.dsm.serveRequest(w.c, msg.Data)
+	case message.ExtensionMessageId:
+		return w.handleExtensionMessage(msg.Data)
 	}
 
-	blocksData := make([][]byte, numBlocks)
+	return nil
+}
 
-	for numBlockRecieved < numBlocks {
+func isFastMessage(id byte) bool {
+	switch id {
+	case message.SuggestPieceMessageID, message.HaveAllMessageID, message.HaveNoneMessageID,
+		message.RejectRequestMessageID, message.AllowedFastMessageID:
+		return true
+	}
 
-		if !c.Choked {
-			for backlog < maxBacklog && requested < work.Length {
-				blockSize := maxBlockSize
+	return false
+}
 
-				if work.Length-requested < maxBlockSize {
-					blockSize = work.Length - requested
-				}
+// fillPipeline drops the pieces which other peers completed and requests blocks until the queue
+// of the peer is full, picking more pieces once every block of the current ones is requested
+func (w *worker) fillPipeline() error {
+	picker := w.dsm.Picker
+
+	for _, a := range append([]*activePiece(nil), w.active...) {
+		if !picker.isComplete(a.pd) {
+			continue
+		}
+
+		// another peer completed the piece during endgame
+		for block := range a.requested {
+			w.cancelBlock(a.pd, block)
+		}
+
+		w.remove(a)
+		picker.Release(a.pd)
+	}
 
-				err := c.SendRequestMsg(work.Index, requested, blockSize)
+	depth := w.pipeline.queueDepth(w.c.RequestQueue())
+
+	for w.outstanding < depth {
+		for _, a := range w.active {
+			if w.outstanding >= depth || !w.canRequest(a.pd.work.Index) {
+				continue
+			}
+
+			for _, block := range picker.missingBlocks(a.pd, a.skip(), depth-w.outstanding) {
+				err := w.request(a, block)
 
 				if err != nil {
-					return nil, err
+					return err
 				}
+			}
+		}
+
+		// endgame pieces are downloaded one at a time, as other peers download them as well
+		if w.outstanding >= depth || (len(w.active) > 0 && picker.inEndgame()) {
+			break
+		}
+
+		pd := picker.Pick(w.unpicked(), peerHost(w.c.Peer.Address))
+
+		if pd == nil {
+			break
+		}
+
+		w.active = append(w.active, &activePiece{
+			pd:        pd,
+			requested: make(map[int]time.Time),
+			rejected:  make(map[int]bool),
+		})
+	}
+
+	for _, a := range append([]*activePiece(nil), w.active...) {
+		// the peer rejected the rest of the piece, give it back right away
+		// instead of waiting for blocks that will never arrive
+		if len(a.requested) == 0 && len(a.rejected) > 0 {
+			w.remove(a)
+			picker.Release(a.pd)
+		}
+	}
+
+	return nil
+}
+
+// request asks the peer for a block of an active piece
+func (w *worker) request(a *activePiece, block int) error {
+	begin, length := a.pd.blockRange(block)
+
+	err := w.c.SendRequestMsg(a.pd.work.Index, begin, length)
+
+	if err != nil {
+		return err
+	}
+
+	// the peer was idle until now
+	if w.outstanding == 0 {
+		w.pipeline.restart()
+	}
+
+	a.requested[block] = time.Now()
+	w.outstanding++
+
+	return nil
+}
+
+// skip returns the blocks of the piece which must not be requested again
+func (a *activePiece) skip() map[int]bool {
+	skip := make(map[int]bool, len(a.requested)+len(a.rejected))
+
+	for block := range a.requested {
+		skip[block] = true
+	}
+
+	for block := range a.rejected {
+		skip[block] = true
+	}
+
+	return skip
+}
+
+// activePiece returns the active piece of the given index, nil if the peer is not downloading it
+func (w *worker) activePiece(index int) *activePiece {
+	for _, a := range w.active {
+		if a.pd.work.Index == index {
+			return a
+		}
+	}
+
+	return nil
+}
 
-				requested += blockSize
-				backlog++
+// remove stops downloading a piece from the peer, forgetting about its outstanding requests
+func (w *worker) remove(a *activePiece) {
+	for i, active := range w.active {
+		if active == a {
+			w.active = append(w.active[:i], w.active[i+1:]...)
+			break
+		}
+	}
+
+	w.outstanding -= len(a.requested)
+}
+
+// releaseAll gives back the pieces the peer was downloading when the worker stops
+func (w *worker) releaseAll() {
+	for _, a := range w.active {
+		w.dsm.Picker.Release(a.pd)
+	}
+
+	w.active = nil
+	w.outstanding = 0
+}
+
+// handleDownloadMessage processes the messages answering our requests, and hands the others to
+// handleMessage
+func (w *worker) handleDownloadMessage(msg *client.MessageResult) error {
+	c := w.c
+	picker := w.dsm.Picker
+
+	switch msg.Id {
+	case message.PieceMessageID:
+		if len(msg.Data) < 8 {
+			return fmt.Errorf("invalid piece message")
+		}
+
+		index := int(binary.BigEndian.Uint32(msg.Data[0:4]))
+		begin := int(binary.BigEndian.Uint32(msg.Data[4:8]))
+		block := begin / maxBlockSize
+
+		a := w.activePiece(index)
+
+		// late block of a piece we moved on from, or one we never asked for
+		if a == nil {
+			return nil
+		}
+
+		sent, ok := a.requested[block]
+
+		if !ok {
+			return nil
+		}
+
+		_, length := a.pd.blockRange(block)
+
+		if begin%maxBlockSize != 0 || len(msg.Data[8:]) != length {
+			return fmt.Errorf("invalid block for piece %d at %d", index, begin)
+		}
+
+		delete(a.requested, block)
+		w.outstanding--
+		w.pipeline.blockReceived(length, time.Since(sent))
+		w.lastBlock = time.Now()
+		c.Downloaded.Add(int64(length))
+		w.dsm.lastProgress.Store(time.Now().UnixNano())
+
+		if picker.AddBlock(a.pd, block, msg.Data[8:], c.Peer.Address) {
+			w.completePiece(a)
+		}
+	case message.ChokeMessageID:
+		for _, a := range append([]*activePiece(nil), w.active...) {
+			// a peer supporting the fast extension keeps serving allowed fast pieces
+			// and rejects each request it discards
+			if w.canRequest(a.pd.work.Index) {
+				continue
 			}
+
+			// the peer discards our outstanding requests when it chokes us,
+			// give the piece back so that other peers can carry on with it
+			w.remove(a)
+			picker.Release(a.pd)
+		}
+	case message.RejectRequestMessageID:
+		if !c.SupportsFastExtension {
+			return fmt.Errorf("fast extension message from a peer which does not support it")
 		}
 
-		msg := <-messageChan
+		index, begin, _, err := message.ParseRequestPayload(msg.Data)
 
-		if msg.Err != nil {
-			return nil, msg.Err
+		if err != nil {
+			return err
 		}
 
-		if msg.Id == message.PieceMessageID {
-			blockIndex := int(binary.BigEndian.Uint32(msg.Data[4:8])) / maxBlockSize
-			blocksData[blockIndex] = msg.Data[8:]
+		block := begin / maxBlockSize
+
+		a := w.activePiece(index)
 
-			numBlockRecieved++
-			backlog--
+		// late reject of a piece we moved on from
+		if a == nil {
+			return nil
 		}
 
+		if _, ok := a.requested[block]; !ok {
+			return nil
+		}
+
+		delete(a.requested, block)
+		w.outstanding--
+		a.rejected[block] = true
+		w.rejected.SetPiece(index)
+	default:
+		return w.handleMessage(msg)
+	}
+
+	return nil
+}
+
+// completePiece checks a piece completed by a block from the peer and hands it over to be
+// written to disk
+func (w *worker) completePiece(a *activePiece) {
+	dsm := w.dsm
+	pd := a.pd
+
+	// the blocks other peers delivered first during endgame
+	for block := range a.requested {
+		w.cancelBlock(pd, block)
 	}
 
-	return bytes.Join(blocksData, nil), nil
+	w.remove(a)
+
+	work := pd.work
+	buffer := pd.data()
+
+	// check if hashes are same
+	verified := work.Hash.Verify(buffer)
+
+	dsm.Picker.Finish(pd, verified)
+	dsm.Picker.Release(pd)
+
+	if !verified {
+		// fmt.Printf("Piece %d from %s has incorrect hash\n", work.Index, w.c.Peer.Address)
+		dsm.pieceFailed(pd)
+		return
+	}
+
+	dsm.pieceVerified(pd)
+
+	select {
+	case dsm.Results <- &PieceResult{Index: work.Index, Length: work.Length, Data: buffer}:
+	case <-dsm.Done:
+	}
 }
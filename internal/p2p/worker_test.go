@@ -0,0 +1,150 @@
+package p2p
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/bitfield"
+	"github.com/OmBudhiraja/torrent-client/internal/client"
+	"github.com/OmBudhiraja/torrent-client/internal/message"
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+func TestAllowedFastIgnoresPiecesWeHave(t *testing.T) {
+	dsm := newTestSession(4)
+	dsm.Bitfield.SetPiece(1)
+
+	w := &worker{
+		c:           &client.Client{SupportsFastExtension: true},
+		dsm:         dsm,
+		allowedFast: bitfield.New(4),
+	}
+
+	for _, index := range []int{1, 2} {
+		err := w.handleMessage(&client.MessageResult{Id: message.AllowedFastMessageID, Data: message.FormatHavePayload(index)})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if w.allowedFast.HasPiece(1) || !w.allowedFast.HasPiece(2) {
+		t.Fatalf("allowed fast %08b, want only piece 2", w.allowedFast)
+	}
+}
+
+func TestCheckRequests(t *testing.T) {
+	now := time.Now()
+	a := &activePiece{requested: map[int]time.Time{0: now.Add(-2 * requestTimeout)}}
+	w := &worker{active: []*activePiece{a}}
+
+	if w.checkRequests(now) != errPeerTimeout {
+		t.Fatal("request left unanswered did not time out")
+	}
+
+	// the peer is still working through our requests
+	w.lastBlock = now.Add(-time.Second)
+
+	if w.checkRequests(now) != nil {
+		t.Fatal("peer sending blocks timed out")
+	}
+
+	w.lastBlock = time.Time{}
+	a.requested[0] = now.Add(-time.Second)
+
+	if w.checkRequests(now) != nil {
+		t.Fatal("recent request timed out")
+	}
+}
+
+func TestSilentPeerReleasesPiecesAndFails(t *testing.T) {
+	dsm := newTestSession(2)
+	dsm.choker = newChoker()
+	dsm.Picker = NewPiecePicker([]*PieceWork{
+		{Index: 0, Length: 2 * maxBlockSize},
+		{Index: 1, Length: 2 * maxBlockSize},
+	})
+
+	conn, other := net.Pipe()
+	defer other.Close()
+
+	p := peer.Peer{Address: "10.0.0.1:6881"}
+	c := client.NewFromHandshake(p, &peer.HandshakeResponse{Conn: conn}, nil, 0, false, 2)
+
+	messageChan := make(chan *client.MessageResult)
+	closeChan := make(chan struct{})
+	defer close(closeChan)
+
+	go c.ParsePeerMessage(messageChan, closeChan)
+
+	// the peer has every piece, answers our first request and then goes silent
+	go func() {
+		bf := bitfield.New(2)
+		bf.SetPiece(0)
+		bf.SetPiece(1)
+
+		other.Write((&message.Message{ID: message.BitfieldMessageID, Payload: bf}).Encode())
+		other.Write((&message.Message{ID: message.UnchokeMessageID}).Encode())
+	}()
+
+	go func() {
+		answered := false
+
+		for {
+			msg, err := message.Read(other)
+
+			if err != nil {
+				return
+			}
+
+			if msg == nil || msg.ID != message.RequestMessageID || answered {
+				continue
+			}
+
+			index, begin, length, _ := message.ParseRequestPayload(msg.Payload)
+			other.Write((&message.Message{ID: message.PieceMessageID, Payload: message.FormatPiecePayload(index, begin, make([]byte, length))}).Encode())
+			answered = true
+
+			// the read of the next message times out
+			go func() {
+				for c.Downloaded.Load() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+
+				conn.SetReadDeadline(time.Now())
+			}()
+		}
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		dsm.T.AdoptWorker(c, dsm, messageChan, closeChan)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("worker of a silent peer did not stop")
+	}
+
+	if c.Downloaded.Load() == 0 {
+		t.Fatal("peer did not send its block")
+	}
+
+	// the pieces of the peer are left to the others
+	all := bitfield.New(2)
+	all.SetPiece(0)
+	all.SetPiece(1)
+
+	if pd := dsm.Picker.Pick(all, "10.0.0.2"); pd == nil || pd.workers != 1 {
+		t.Fatal("pieces of the silent peer not released")
+	}
+
+	// a peer which timed out failed, even though it sent data before
+	if candidate := dsm.peers.candidates[p.Address]; candidate == nil || candidate.failures != 1 {
+		t.Fatal("silent peer not reported as failed")
+	}
+}
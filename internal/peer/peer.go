@@ -1,44 +1,179 @@
 package peer
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
 	"time"
 
+	"github.com/OmBudhiraja/torrent-client/internal/mse"
+	"github.com/OmBudhiraja/torrent-client/internal/utp"
 	"github.com/zeebo/bencode"
 )
 
 const (
 	PROTOCOL_NAME_HEADER = "BitTorrent protocol"
+
+	encryptedHandshakeTimeout = 10 * time.Second
+	// peers which accept the connection but do not complete the handshake within this time are
+	// given up on
+	handshakeTimeout = 10 * time.Second
+	// peers which do not answer over utp within this time are connected to over tcp
+	utpDialTimeout = 3 * time.Second
 )
 
 type Peer struct {
 	Address string
 }
 
+// Dialer decides how connections to peers are made
+type Dialer struct {
+	// Encryption decides which connections go through the encrypted handshake
+	Encryption mse.Policy
+	// UTP connects to peers over utp before trying tcp, nil only uses tcp
+	UTP *utp.Socket
+}
+
 type HandshakeResponse struct {
 	Conn                      net.Conn
+	InfoHash                  [20]byte
+	PeerId                    [20]byte
 	SupportsExtensionProtocol bool
+	SupportsFastExtension     bool
 }
 
-func (p Peer) CompleteHandshake(infoHash []byte, peerId []byte) (*HandshakeResponse, error) {
-	conn, err := net.DialTimeout("tcp", p.Address, 5*time.Second)
+func (p Peer) CompleteHandshake(infoHash []byte, peerId []byte, dialer Dialer) (*HandshakeResponse, error) {
+	// asert that info hash and peer id are of the correct length
+	if len(infoHash) != 20 {
+		return nil, fmt.Errorf("invalid info hash length")
+	}
+
+	if len(peerId) != 20 {
+		return nil, fmt.Errorf("invalid peer id length")
+	}
+
+	conn, err := dialer.dial(p.Address, infoHash)
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to peer: %s", err.Error())
+		return nil, err
 	}
 
-	// asert that info hash and peer id are of the correct length
-	if len(infoHash) != 20 {
-		return nil, fmt.Errorf("invalid info hash length")
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	_, err = conn.Write(buildHandshake(infoHash, peerId))
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send handshake message: %s", err.Error())
+	}
+
+	handshakeRes, err := readHandshake(conn)
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if !bytes.Equal(handshakeRes.InfoHash[:], infoHash) {
+		conn.Close()
+		return nil, fmt.Errorf("peer responded with a different info hash")
+	}
+
+	if bytes.Equal(handshakeRes.PeerId[:], peerId) {
+		conn.Close()
+		return nil, fmt.Errorf("connected to ourselves")
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	return handshakeRes, nil
+}
+
+// dial connects to the peer and goes through the encrypted handshake unless encryption is
+// disabled, peers which do not support it are connected to again in plaintext if encryption
+// is only preferred
+func (d Dialer) dial(address string, infoHash []byte) (net.Conn, error) {
+	conn, err := d.dialTransport(address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Encryption == mse.Disabled {
+		return conn, nil
+	}
+
+	conn.SetDeadline(time.Now().Add(encryptedHandshakeTimeout))
+
+	encryptedConn, err := mse.Initiate(conn, infoHash, d.Encryption)
+
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return encryptedConn, nil
 	}
 
+	conn.Close()
+
+	if d.Encryption == mse.Require {
+		return nil, fmt.Errorf("encrypted handshake failed: %s", err.Error())
+	}
+
+	return d.dialTransport(address)
+}
+
+// dialTransport connects to the peer over utp if enabled, falling back to tcp
+func (d Dialer) dialTransport(address string) (net.Conn, error) {
+	if d.UTP != nil {
+		conn, err := d.UTP.Dial(address, utpDialTimeout)
+
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to peer: %s", err.Error())
+	}
+
+	return conn, nil
+}
+
+// AcceptHandshake completes the handshake of an incoming connection, replying only if
+// isKnown reports that we are serving the requested info hash
+func AcceptHandshake(conn net.Conn, peerId []byte, isKnown func(infoHash [20]byte) bool) (*HandshakeResponse, error) {
 	if len(peerId) != 20 {
 		return nil, fmt.Errorf("invalid peer id length")
 	}
 
+	handshakeRes, err := readHandshake(conn)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !isKnown(handshakeRes.InfoHash) {
+		return nil, fmt.Errorf("unknown info hash %x", handshakeRes.InfoHash)
+	}
+
+	// our own address can be handed to us by trackers or other peers
+	if bytes.Equal(handshakeRes.PeerId[:], peerId) {
+		return nil, fmt.Errorf("connected to ourselves")
+	}
+
+	_, err = conn.Write(buildHandshake(handshakeRes.InfoHash[:], peerId))
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to send handshake message: %s", err.Error())
+	}
+
+	return handshakeRes, nil
+}
+
+func buildHandshake(infoHash, peerId []byte) []byte {
 	handshakeMsgSent := make([]byte, 0)
 
 	handshakeMsgSent = append(handshakeMsgSent, 19) // Length of the protocol string
@@ -48,18 +183,18 @@ func (p Peer) CompleteHandshake(infoHash []byte, peerId []byte) (*HandshakeRespo
 
 	// set the 20th bit to 1 to indicate that we support the extension protocol
 	reservedByes[5] = 0x10
+	// and the third least significant bit for the fast extension
+	reservedByes[7] = 0x04
 
 	handshakeMsgSent = append(handshakeMsgSent, reservedByes...) // 8 reserved bytes
 
 	handshakeMsgSent = append(handshakeMsgSent, infoHash...) // Info hash
 	handshakeMsgSent = append(handshakeMsgSent, peerId...)   // Peer ID
 
-	_, err = conn.Write(handshakeMsgSent)
-
-	if err != nil {
-		return nil, fmt.Errorf("failed to send handshake message: %s", err.Error())
-	}
+	return handshakeMsgSent
+}
 
+func readHandshake(conn net.Conn) (*HandshakeResponse, error) {
 	handshakeMsgRecieved := make([]byte, 68)
 
 	n, err := io.ReadFull(conn, handshakeMsgRecieved)
@@ -77,13 +212,17 @@ func (p Peer) CompleteHandshake(infoHash []byte, peerId []byte) (*HandshakeRespo
 		return nil, fmt.Errorf("invalid handshake message")
 	}
 
-	// check if the peer supports the extension protocol
-	supportsExtensionProtocol := handshakeMsgRecieved[25]&0x10 == 0x10
+	res := &HandshakeResponse{
+		Conn: conn,
+		// check if the peer supports the extension protocol
+		SupportsExtensionProtocol: handshakeMsgRecieved[25]&0x10 == 0x10,
+		SupportsFastExtension:     handshakeMsgRecieved[27]&0x04 == 0x04,
+	}
+
+	copy(res.InfoHash[:], handshakeMsgRecieved[28:48])
+	copy(res.PeerId[:], handshakeMsgRecieved[48:68])
 
-	return &HandshakeResponse{
-		Conn:                      conn,
-		SupportsExtensionProtocol: supportsExtensionProtocol,
-	}, nil
+	return res, nil
 }
 
 type uncompactPeer struct {
@@ -103,14 +242,24 @@ func Unmarshal(data []byte) ([]Peer, error) {
 	err := bencode.DecodeBytes(data, &decodedPeers)
 
 	if err != nil {
-		return unmarshalCompact(data)
+		// peers are in compact format, a bencoded string of 6 bytes per peer
+		var compactPeers string
+
+		err = bencode.DecodeBytes(data, &compactPeers)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid peer data")
+		}
+
+		return UnmarshalCompact([]byte(compactPeers))
 	}
 
 	return unmarshalNonCompact(decodedPeers)
 
 }
 
-func unmarshalCompact(data []byte) ([]Peer, error) {
+// UnmarshalCompact parses peers in compact format, 4 bytes of ip followed by 2 bytes of port
+func UnmarshalCompact(data []byte) ([]Peer, error) {
 	peerSize := 6
 	numPeers := len(data) / peerSize
 
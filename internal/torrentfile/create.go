@@ -0,0 +1,234 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	// piece length is doubled until the torrent has at most this many pieces
+	targetPieceCount = 1500
+)
+
+type CreateOptions struct {
+	// Announce holds the tracker urls, each one in its own tier
+	Announce  []string
+	Comment   string
+	CreatedBy string
+	Private   bool
+	// PieceLength is picked from the size of the content when 0
+	PieceLength int
+}
+
+type createFile struct {
+	path    string
+	length  int
+	relPath []string
+}
+
+// Create builds a bencoded metainfo file for the file or directory at path
+func Create(path string, opts CreateOptions) ([]byte, error) {
+	if opts.PieceLength != 0 && (opts.PieceLength < minPieceLength || opts.PieceLength&(opts.PieceLength-1) != 0) {
+		return nil, fmt.Errorf("piece length must be a power of two of at least %d", minPieceLength)
+	}
+
+	path = filepath.Clean(path)
+
+	stat, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := collectFiles(path, stat)
+
+	if err != nil {
+		return nil, err
+	}
+
+	totalLength := 0
+
+	for _, f := range files {
+		totalLength += f.length
+	}
+
+	if totalLength == 0 {
+		return nil, fmt.Errorf("cannot create a torrent without any content")
+	}
+
+	pieceLength := opts.PieceLength
+
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(totalLength)
+	}
+
+	pieces, err := hashPieces(files, pieceLength)
+
+	if err != nil {
+		return nil, err
+	}
+
+	info := BencodeInfo{
+		Name:        stat.Name(),
+		Pieces:      string(pieces),
+		PieceLength: pieceLength,
+	}
+
+	if stat.IsDir() {
+		for _, f := range files {
+			info.Files = append(info.Files, file{
+				Length: f.length,
+				Path:   f.relPath,
+			})
+		}
+	} else {
+		info.Length = totalLength
+	}
+
+	if opts.Private {
+		info.Private = 1
+	}
+
+	infoBytes, err := bencode.EncodeBytes(info)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode info dictionary: %s", err.Error())
+	}
+
+	metainfo := bencodeTorrent{
+		Comment:      opts.Comment,
+		CreatedBy:    opts.CreatedBy,
+		CreationDate: time.Now().Unix(),
+		Info:         infoBytes,
+	}
+
+	if len(opts.Announce) > 0 {
+		metainfo.Announce = opts.Announce[0]
+	}
+
+	if len(opts.Announce) > 1 {
+		for _, announce := range opts.Announce {
+			metainfo.AnnounceList = append(metainfo.AnnounceList, []string{announce})
+		}
+	}
+
+	return bencode.EncodeBytes(metainfo)
+}
+
+// collectFiles lists the regular files to include, in the lexical order of their paths
+func collectFiles(root string, stat fs.FileInfo) ([]createFile, error) {
+	if !stat.IsDir() {
+		return []createFile{{path: root, length: int(stat.Size())}}, nil
+	}
+
+	var files []createFile
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		info, err := d.Info()
+
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+
+		if err != nil {
+			return err
+		}
+
+		files = append(files, createFile{
+			path:    path,
+			length:  int(info.Size()),
+			relPath: strings.Split(filepath.ToSlash(rel), "/"),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func choosePieceLength(totalLength int) int {
+	pieceLength := minPieceLength
+
+	for pieceLength < maxPieceLength && totalLength/pieceLength > targetPieceCount {
+		pieceLength *= 2
+	}
+
+	return pieceLength
+}
+
+// hashPieces reads the files one after the other as a single stream and hashes every piece,
+// pieces span file boundaries the same way they are written back when downloading
+func hashPieces(files []createFile, pieceLength int) ([]byte, error) {
+	var pieces []byte
+
+	buffer := make([]byte, pieceLength)
+	filled := 0
+
+	for _, f := range files {
+		file, err := os.Open(f.path)
+
+		if err != nil {
+			return nil, err
+		}
+
+		read := 0
+
+		for {
+			n, err := io.ReadFull(file, buffer[filled:])
+			filled += n
+			read += n
+
+			if filled == pieceLength {
+				hash := sha1.Sum(buffer)
+				pieces = append(pieces, hash[:]...)
+				filled = 0
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+
+		file.Close()
+
+		if read != f.length {
+			return nil, fmt.Errorf("%s changed while creating the torrent", f.path)
+		}
+	}
+
+	if filled > 0 {
+		hash := sha1.Sum(buffer[:filled])
+		pieces = append(pieces, hash[:]...)
+	}
+
+	return pieces, nil
+}
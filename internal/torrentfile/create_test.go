@@ -0,0 +1,156 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+)
+
+func TestCreateRoundTrip(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "content")
+
+	// files of odd lengths so that pieces span file boundaries, listed in lexical order
+	files := []struct {
+		path   string
+		length int
+	}{
+		{"a.bin", minPieceLength + 100},
+		{filepath.Join("sub", "b.bin"), 3},
+		{filepath.Join("sub", "c.bin"), 2*minPieceLength - 50},
+	}
+
+	var content []byte
+
+	for _, f := range files {
+		data := make([]byte, f.length)
+		rand.Read(data)
+		content = append(content, data...)
+
+		path := filepath.Join(root, f.path)
+
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := Create(root, CreateOptions{
+		Announce:    []string{"http://tracker.example/announce", "udp://tracker.example:6969"},
+		PieceLength: minPieceLength,
+		Private:     true,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrentPath := filepath.Join(t.TempDir(), "content.torrent")
+
+	if err = os.WriteFile(torrentPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := New(torrentPath, &p2p.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.Name != "content" || !tf.IsMultiFile || !tf.IsPrivate || tf.Length != len(content) {
+		t.Fatalf("torrent %s of %d bytes, multi file %v, private %v", tf.Name, tf.Length, tf.IsMultiFile, tf.IsPrivate)
+	}
+
+	if len(tf.Files) != len(files) {
+		t.Fatalf("got %d files, want %d", len(tf.Files), len(files))
+	}
+
+	for i, f := range files {
+		if tf.Files[i].Path != f.path || tf.Files[i].Length != f.length {
+			t.Fatalf("file %d is %s of %d bytes, want %s of %d", i, tf.Files[i].Path, tf.Files[i].Length, f.path, f.length)
+		}
+	}
+
+	if tf.Announce != "http://tracker.example/announce" || len(tf.AnnounceList) != 2 {
+		t.Fatalf("announce %s and list %v", tf.Announce, tf.AnnounceList)
+	}
+
+	pieces := (len(content) + minPieceLength - 1) / minPieceLength
+
+	if tf.PieceLength != minPieceLength || len(tf.PieceHashes) != pieces {
+		t.Fatalf("got %d pieces of %d bytes, want %d", len(tf.PieceHashes), tf.PieceLength, pieces)
+	}
+
+	for i, hash := range tf.PieceHashes {
+		end := min((i+1)*minPieceLength, len(content))
+		piece := content[i*minPieceLength : end]
+
+		if !hash.Verify(piece) {
+			t.Fatalf("piece %d does not match the content", i)
+		}
+	}
+
+	if tf.PieceHashes[0].Verify(bytes.Repeat([]byte{0}, minPieceLength)) {
+		t.Fatal("piece matches other content")
+	}
+}
+
+func TestCreateSingleFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	if err := os.WriteFile(path, []byte("single file content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := Create(path, CreateOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	torrentPath := filepath.Join(t.TempDir(), "file.torrent")
+
+	if err = os.WriteFile(torrentPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tf, err := New(torrentPath, &p2p.Config{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tf.Name != "file.bin" || tf.IsMultiFile || tf.Length != 19 || len(tf.PieceHashes) != 1 {
+		t.Fatalf("torrent %s of %d bytes in %d pieces, multi file %v", tf.Name, tf.Length, len(tf.PieceHashes), tf.IsMultiFile)
+	}
+
+	if tf.PieceLength != minPieceLength || !tf.PieceHashes[0].Verify([]byte("single file content")) {
+		t.Fatal("piece does not match the content")
+	}
+}
+
+func TestCreateInvalidPieceLength(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.bin")
+
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, pieceLength := range []int{-minPieceLength, 1, minPieceLength / 2, minPieceLength + 1, 3 * minPieceLength} {
+		if _, err := Create(path, CreateOptions{PieceLength: pieceLength}); err == nil {
+			t.Fatalf("torrent created with a piece length of %d", pieceLength)
+		}
+	}
+}
+
+func TestCreateEmpty(t *testing.T) {
+	if _, err := Create(t.TempDir(), CreateOptions{}); err == nil {
+		t.Fatal("torrent created without content")
+	}
+}
@@ -8,14 +8,19 @@ import (
 	"unicode"
 
 	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+	"github.com/zeebo/bencode"
 )
 
 type BencodeInfo struct {
 	Name        string `bencode:"name"`
 	Pieces      string `bencode:"pieces"`
 	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Files       []file `bencode:"files"`
+	Length      int    `bencode:"length,omitempty"`
+	Files       []file `bencode:"files,omitempty"`
+	Private     int    `bencode:"private,omitempty"`
+	// MetaVersion is 2 for v2 and hybrid torrents, whose files are described by FileTree
+	MetaVersion int                `bencode:"meta version,omitempty"`
+	FileTree    bencode.RawMessage `bencode:"file tree,omitempty"`
 }
 
 func (info *BencodeInfo) PieceHashes() ([][20]byte, error) {
@@ -49,8 +54,9 @@ func (info *BencodeInfo) IsMultiFile() (isMultiFile bool, files []p2p.File) {
 			}
 
 			files = append(files, p2p.File{
-				Length: file.Length,
-				Path:   filepath.Join(fileParts...),
+				Length:  file.Length,
+				Path:    filepath.Join(fileParts...),
+				Padding: file.isPadding(),
 			})
 
 		}
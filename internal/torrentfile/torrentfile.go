@@ -1,41 +1,75 @@
 package torrentfile
 
 import (
+	"context"
 	"crypto/sha1"
+	"crypto/sha256"
 	"fmt"
 	"os"
+	"strings"
 
 	"io"
 
 	"github.com/OmBudhiraja/torrent-client/internal/p2p"
 	"github.com/OmBudhiraja/torrent-client/internal/tracker"
+	"github.com/OmBudhiraja/torrent-client/pkg/ratelimit"
 	"github.com/zeebo/bencode"
 )
 
 type TorrentFile struct {
-	Announce    string
-	InfoHash    [20]byte
-	PieceHashes [][20]byte
-	PieceLength int
-	Length      int
-	Name        string
-	Files       []p2p.File
-	IsMultiFile bool
-	PeerId      []byte
+	Announce     string
+	AnnounceList [][]string
+	// InfoHash identifies the torrent in its swarm, for v2 only torrents it is the sha256 hash of
+	// the info dictionary truncated to 20 bytes
+	InfoHash [20]byte
+	// InfoHashV2 is the full sha256 hash of the info dictionary of v2 and hybrid torrents
+	InfoHashV2   [32]byte
+	IsV2         bool
+	PieceHashes  []p2p.PieceHash
+	PieceLength  int
+	PieceLengths []int
+	Length       int
+	Name         string
+	Files        []p2p.File
+	IsMultiFile  bool
+	IsPrivate    bool
+	// WebSeeds are the urls of http mirrors of the torrent, from url-list
+	WebSeeds []string
+	Config   *p2p.Config
+	// DownloadLimit and UploadLimit cap the transfer rates of the torrent, they do not limit
+	// anything until their rate is set, which can be done while it runs
+	DownloadLimit *ratelimit.Limiter
+	UploadLimit   *ratelimit.Limiter
+
+	trackers *tracker.TrackerList
 }
 
 type file struct {
 	Length int      `bencode:"length"`
 	Path   []string `bencode:"path"`
+	// Attr holds a 'p' for padding files, as described in BEP 47
+	Attr string `bencode:"attr,omitempty"`
+}
+
+func (f file) isPadding() bool {
+	return strings.ContainsRune(f.Attr, 'p')
 }
 
 type bencodeTorrent struct {
-	Announce string             `bencode:"announce"`
-	Info     bencode.RawMessage `bencode:"info"`
-	info     BencodeInfo
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	CreationDate int64              `bencode:"creation date,omitempty"`
+	Info         bencode.RawMessage `bencode:"info"`
+	// URLList is either a single url or a list of urls
+	URLList bencode.RawMessage `bencode:"url-list,omitempty"`
+	// PieceLayers maps the pieces root of each v2 file larger than a piece to its piece hashes
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
+	info        BencodeInfo
 }
 
-func New(path string, peerId []byte) (*TorrentFile, error) {
+func New(path string, config *p2p.Config) (*TorrentFile, error) {
 	file, err := os.Open(path)
 
 	if err != nil {
@@ -70,60 +104,153 @@ func New(path string, peerId []byte) (*TorrentFile, error) {
 
 	bencodeTo.info = infoDict
 
+	webSeeds, err := parseURLList(bencodeTo.URLList)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TorrentFile{
+		Announce:     bencodeTo.Announce,
+		AnnounceList: bencodeTo.AnnounceList,
+		trackers:     tracker.NewTrackerList(bencodeTo.Announce, bencodeTo.AnnounceList),
+		InfoHash:     infoHash,
+		PieceLength:  bencodeTo.info.PieceLength,
+		Name:         bencodeTo.info.Name,
+		IsPrivate:    bencodeTo.info.Private == 1,
+		WebSeeds:     webSeeds,
+		Config:       config,
+		// the limiters are there from the start, so that a limit can be set while downloading
+		DownloadLimit: ratelimit.New(0),
+		UploadLimit:   ratelimit.New(0),
+	}
+
+	switch bencodeTo.info.MetaVersion {
+	case 0, 1:
+	case metaVersion2:
+		t.IsV2 = true
+		t.InfoHashV2 = sha256.Sum256(bencodeTo.Info)
+	default:
+		return nil, fmt.Errorf("unsupported meta version %d", bencodeTo.info.MetaVersion)
+	}
+
+	if bencodeTo.info.IsV2Only() {
+		// peers of v2 only torrents handshake with the truncated v2 info hash
+		copy(t.InfoHash[:], t.InfoHashV2[:])
+
+		layout, err := bencodeTo.info.v2Layout(bencodeTo.PieceLayers)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.PieceHashes = layout.pieceHashes
+		t.PieceLengths = layout.pieceLengths
+		t.Length = layout.length
+		t.Files = layout.files
+		t.IsMultiFile = layout.isMultiFile
+
+		return t, nil
+	}
+
+	// hybrid torrents are downloaded in the v1 swarm, with the v1 piece hashes
+	if t.IsV2 {
+		err = bencodeTo.info.checkHybrid()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	pieceHashes, err := bencodeTo.info.PieceHashes()
 
 	if err != nil {
 		return nil, err
 	}
 
-	isMultiFile, files := bencodeTo.info.IsMultiFile()
+	t.PieceHashes = p2p.V1PieceHashes(pieceHashes)
+	t.IsMultiFile, t.Files = bencodeTo.info.IsMultiFile()
+	t.Length = bencodeTo.info.Length
 
-	return &TorrentFile{
-		Announce:    bencodeTo.Announce,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bencodeTo.info.PieceLength,
-		Length:      bencodeTo.info.Length,
-		Name:        bencodeTo.info.Name,
-		Files:       files,
-		IsMultiFile: isMultiFile,
-		PeerId:      peerId,
-	}, nil
+	return t, nil
 }
 
-func (t *TorrentFile) Download(outpath string) error {
+// parseURLList reads the web seeds of a torrent, url-list holds either a single url or a list
+func parseURLList(data bencode.RawMessage) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
 
-	fmt.Printf("Waiting for peers...")
-	peers, err := tracker.GetPeers(t.Announce, t.InfoHash, t.PeerId, t.Length)
+	var single string
+
+	if bencode.DecodeBytes(data, &single) == nil {
+		if single == "" {
+			return nil, nil
+		}
+
+		return []string{single}, nil
+	}
+
+	var list []string
+
+	err := bencode.DecodeBytes(data, &list)
 
 	if err != nil {
-		fmt.Println()
-		return err
+		return nil, fmt.Errorf("invalid url-list: %s", err.Error())
 	}
 
-	fmt.Printf("\rFound %d peers           \n", len(peers))
+	webSeeds := make([]string, 0, len(list))
 
-	if len(peers) == 0 {
-		return fmt.Errorf("no peers found")
+	for _, webSeed := range list {
+		if webSeed != "" {
+			webSeeds = append(webSeeds, webSeed)
+		}
 	}
 
-	torrent := p2p.Torrent{
-		Name:        t.Name,
-		Peers:       peers,
-		InfoHash:    t.InfoHash,
-		PieceHashes: t.PieceHashes,
-		PieceLength: t.PieceLength,
-		Length:      t.Length,
-		PeerId:      t.PeerId,
-		Files:       t.Files,
-		Outpath:     outpath,
+	return webSeeds, nil
+}
+
+func (t *TorrentFile) Download(ctx context.Context, outpath string) error {
+	torrent := t.torrent(outpath)
+
+	if t.trackers.Len() > 0 {
+		torrent.Announcer = tracker.NewAnnouncer(t.trackers, t.InfoHash, t.Config.PeerId, t.Config.Port)
 	}
 
-	err = torrent.Download()
+	return torrent.Download(ctx)
+}
 
-	if err != nil {
-		return err
+// Scrape asks the trackers of the torrent for the swarm statistics
+func (t *TorrentFile) Scrape() ([]tracker.ScrapeResult, error) {
+	if t.trackers.Len() == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
 	}
 
-	return nil
+	return t.trackers.Scrape(t.InfoHash), nil
+}
+
+// Verify hash checks the data already present in outpath
+func (t *TorrentFile) Verify(outpath string) (*p2p.VerifyResult, error) {
+	return t.torrent(outpath).Verify()
+}
+
+func (t *TorrentFile) torrent(outpath string) *p2p.Torrent {
+	return &p2p.Torrent{
+		Name:         t.Name,
+		InfoHash:     t.InfoHash,
+		PieceHashes:  t.PieceHashes,
+		PieceLength:  t.PieceLength,
+		PieceLengths: t.PieceLengths,
+		Length:       t.Length,
+		Files:        t.Files,
+		Outpath:      outpath,
+		Config:       t.Config,
+		Private:      t.IsPrivate,
+		WebSeeds:     t.WebSeeds,
+		Selection:    t.Config.Files,
+		Priorities:   t.Config.Priorities,
+
+		DownloadLimit: t.DownloadLimit,
+		UploadLimit:   t.UploadLimit,
+	}
 }
@@ -0,0 +1,260 @@
+package torrentfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+	"github.com/zeebo/bencode"
+)
+
+// metaVersion2 marks the info dictionaries of v2 and hybrid torrents, as described in BEP 52
+const metaVersion2 = 2
+
+type fileTreeEntry struct {
+	Length     int    `bencode:"length"`
+	PiecesRoot string `bencode:"pieces root,omitempty"`
+}
+
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot [32]byte
+}
+
+// v2Layout is how the content of a v2 torrent is split into pieces, each file starts on a piece
+// boundary so its last piece is usually shorter than the piece length
+type v2Layout struct {
+	isMultiFile  bool
+	files        []p2p.File
+	length       int
+	pieceHashes  []p2p.PieceHash
+	pieceLengths []int
+}
+
+// IsV2Only tells if the info dictionary only describes the content with v2 hashes
+func (info *BencodeInfo) IsV2Only() bool {
+	return info.MetaVersion == metaVersion2 && len(info.Pieces) == 0
+}
+
+// v2Files lists the files of the file tree in order, the keys of each directory being sorted
+func (info *BencodeInfo) v2Files() ([]v2File, error) {
+	if len(info.FileTree) == 0 {
+		return nil, fmt.Errorf("missing file tree")
+	}
+
+	return walkFileTree(info.FileTree, nil, nil)
+}
+
+func walkFileTree(data bencode.RawMessage, path []string, files []v2File) ([]v2File, error) {
+	var node map[string]bencode.RawMessage
+
+	err := bencode.DecodeBytes(data, &node)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid file tree: %s", err.Error())
+	}
+
+	// files are dictionaries with a single empty key
+	if leaf, ok := node[""]; ok {
+		if len(path) == 0 || len(node) != 1 {
+			return nil, fmt.Errorf("invalid file tree")
+		}
+
+		var entry fileTreeEntry
+
+		err = bencode.DecodeBytes(leaf, &entry)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid file tree: %s", err.Error())
+		}
+
+		file := v2File{path: path, length: entry.Length}
+
+		if entry.Length < 0 {
+			return nil, fmt.Errorf("invalid length for file %s", strings.Join(path, "/"))
+		}
+
+		if entry.Length > 0 {
+			if len(entry.PiecesRoot) != len(file.piecesRoot) {
+				return nil, fmt.Errorf("invalid pieces root for file %s", strings.Join(path, "/"))
+			}
+
+			copy(file.piecesRoot[:], entry.PiecesRoot)
+		}
+
+		return append(files, file), nil
+	}
+
+	names := make([]string, 0, len(node))
+
+	for name := range node {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		files, err = walkFileTree(node[name], append(path[:len(path):len(path)], name), files)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, nil
+}
+
+// v2Layout builds the files and the piece hashes of a v2 only torrent. Files larger than a piece
+// have their piece hashes in the piece layers, which are checked against the pieces root of the
+// file, while the pieces root of smaller files is the hash of their only piece.
+func (info *BencodeInfo) v2Layout(pieceLayers map[string]string) (*v2Layout, error) {
+	if info.PieceLength < p2p.MerkleBlockSize || info.PieceLength&(info.PieceLength-1) != 0 {
+		return nil, fmt.Errorf("invalid piece length %d", info.PieceLength)
+	}
+
+	v2files, err := info.v2Files()
+
+	if err != nil {
+		return nil, err
+	}
+
+	layout := &v2Layout{
+		// a torrent of a single file has it at the root of the tree, under the name of the torrent
+		isMultiFile: len(v2files) != 1 || len(v2files[0].path) != 1 || v2files[0].path[0] != info.Name,
+	}
+
+	blocksPerPiece := info.PieceLength / p2p.MerkleBlockSize
+	padding := 0
+
+	for i, file := range v2files {
+		fileParts := make([]string, len(file.path))
+
+		for j, p := range file.path {
+			fileParts[j] = cleanName(p)
+		}
+
+		layout.files = append(layout.files, p2p.File{
+			Length: file.length,
+			Path:   filepath.Join(fileParts...),
+		})
+		layout.length += file.length
+
+		if file.length == 0 {
+			continue
+		}
+
+		pieces := (file.length + info.PieceLength - 1) / info.PieceLength
+
+		if file.length <= info.PieceLength {
+			blocks := (file.length + p2p.MerkleBlockSize - 1) / p2p.MerkleBlockSize
+
+			layout.pieceHashes = append(layout.pieceHashes, p2p.PieceHash{
+				Root: &p2p.MerkleRoot{Hash: file.piecesRoot, Leaves: nextPowerOfTwo(blocks)},
+			})
+		} else {
+			layer, ok := pieceLayers[string(file.piecesRoot[:])]
+
+			if !ok || len(layer) != pieces*32 {
+				return nil, fmt.Errorf("missing piece layer for file %s", strings.Join(file.path, "/"))
+			}
+
+			hashes := make([][32]byte, pieces)
+
+			for j := range hashes {
+				copy(hashes[j][:], layer[j*32:])
+			}
+
+			root := p2p.MerkleRootOfHashes(hashes, nextPowerOfTwo(pieces), p2p.ZeroSubtreeRoot(blocksPerPiece))
+
+			if root != file.piecesRoot {
+				return nil, fmt.Errorf("piece layer does not match pieces root for file %s", strings.Join(file.path, "/"))
+			}
+
+			for _, hash := range hashes {
+				layout.pieceHashes = append(layout.pieceHashes, p2p.PieceHash{
+					Root: &p2p.MerkleRoot{Hash: hash, Leaves: blocksPerPiece},
+				})
+			}
+		}
+
+		for j := 0; j < pieces; j++ {
+			layout.pieceLengths = append(layout.pieceLengths, min(info.PieceLength, file.length-j*info.PieceLength))
+		}
+
+		// the next file starts on a piece boundary
+		if rest := file.length % info.PieceLength; rest != 0 && i < len(v2files)-1 {
+			layout.files = append(layout.files, p2p.File{
+				Length:  info.PieceLength - rest,
+				Path:    filepath.Join(".pad", strconv.Itoa(padding)),
+				Padding: true,
+			})
+			layout.length += info.PieceLength - rest
+			padding++
+		}
+	}
+
+	if !layout.isMultiFile {
+		layout.files = nil
+	}
+
+	return layout, nil
+}
+
+// checkHybrid makes sure the v1 and v2 parts of a hybrid torrent describe the same files, so that
+// the content downloaded with the v1 hashes is also the one of the v2 torrent
+func (info *BencodeInfo) checkHybrid() error {
+	v2files, err := info.v2Files()
+
+	if err != nil {
+		return err
+	}
+
+	if len(info.Files) == 0 {
+		if len(v2files) != 1 || len(v2files[0].path) != 1 || v2files[0].path[0] != info.Name || v2files[0].length != info.Length {
+			return fmt.Errorf("v1 and v2 files of hybrid torrent do not match")
+		}
+
+		return nil
+	}
+
+	i := 0
+
+	for _, file := range info.Files {
+		if file.isPadding() {
+			continue
+		}
+
+		if i >= len(v2files) || v2files[i].length != file.Length || strings.Join(v2files[i].path, "/") != strings.Join(file.Path, "/") {
+			return fmt.Errorf("v1 and v2 files of hybrid torrent do not match")
+		}
+
+		i++
+	}
+
+	if i != len(v2files) {
+		return fmt.Errorf("v1 and v2 files of hybrid torrent do not match")
+	}
+
+	return nil
+}
+
+func nextPowerOfTwo(n int) int {
+	power := 1
+
+	for power < n {
+		power *= 2
+	}
+
+	return power
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,290 @@
+package torrentfile
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	"github.com/OmBudhiraja/torrent-client/internal/p2p"
+	"github.com/zeebo/bencode"
+)
+
+const testPieceLength = 2 * p2p.MerkleBlockSize
+
+type testFile struct {
+	path []string
+	data []byte
+}
+
+// testV2Info builds the info dictionary and the piece layers of a v2 torrent of the files
+func testV2Info(t *testing.T, name string, files []testFile) (*BencodeInfo, map[string]string) {
+	t.Helper()
+
+	tree := map[string]interface{}{}
+	layers := map[string]string{}
+	blocksPerPiece := testPieceLength / p2p.MerkleBlockSize
+
+	for _, file := range files {
+		node := tree
+
+		for _, part := range file.path {
+			child, ok := node[part].(map[string]interface{})
+
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+
+			node = child
+		}
+
+		entry := map[string]interface{}{"length": len(file.data)}
+
+		if len(file.data) > 0 {
+			var root [32]byte
+
+			if len(file.data) <= testPieceLength {
+				blocks := (len(file.data) + p2p.MerkleBlockSize - 1) / p2p.MerkleBlockSize
+				root = p2p.MerkleRootOf(file.data, nextPowerOfTwo(blocks))
+			} else {
+				var layer []byte
+				var hashes [][32]byte
+
+				for begin := 0; begin < len(file.data); begin += testPieceLength {
+					hash := p2p.MerkleRootOf(file.data[begin:min(begin+testPieceLength, len(file.data))], blocksPerPiece)
+					hashes = append(hashes, hash)
+					layer = append(layer, hash[:]...)
+				}
+
+				root = p2p.MerkleRootOfHashes(hashes, nextPowerOfTwo(len(hashes)), p2p.ZeroSubtreeRoot(blocksPerPiece))
+				layers[string(root[:])] = string(layer)
+			}
+
+			entry["pieces root"] = string(root[:])
+		}
+
+		node[""] = entry
+	}
+
+	fileTree, err := bencode.EncodeBytes(tree)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &BencodeInfo{
+		Name:        name,
+		PieceLength: testPieceLength,
+		MetaVersion: metaVersion2,
+		FileTree:    fileTree,
+	}, layers
+}
+
+func testData(length int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, length)
+}
+
+func TestV2LayoutSingleFile(t *testing.T) {
+	data := testData(3*testPieceLength+100, 'a')
+	info, layers := testV2Info(t, "file.bin", []testFile{{path: []string{"file.bin"}, data: data}})
+
+	if !info.IsV2Only() {
+		t.Fatal("torrent without v1 pieces is not v2 only")
+	}
+
+	layout, err := info.v2Layout(layers)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if layout.isMultiFile || layout.files != nil {
+		t.Fatalf("single file torrent has files %v", layout.files)
+	}
+
+	if layout.length != len(data) {
+		t.Fatalf("length is %d, want %d", layout.length, len(data))
+	}
+
+	wantLengths := []int{testPieceLength, testPieceLength, testPieceLength, 100}
+
+	if len(layout.pieceLengths) != len(wantLengths) || len(layout.pieceHashes) != len(wantLengths) {
+		t.Fatalf("got %d piece lengths and %d hashes, want %d", len(layout.pieceLengths), len(layout.pieceHashes), len(wantLengths))
+	}
+
+	for i, length := range wantLengths {
+		if layout.pieceLengths[i] != length {
+			t.Fatalf("piece %d has length %d, want %d", i, layout.pieceLengths[i], length)
+		}
+
+		piece := data[i*testPieceLength : i*testPieceLength+length]
+
+		if !layout.pieceHashes[i].Verify(piece) {
+			t.Fatalf("piece %d does not verify", i)
+		}
+	}
+}
+
+func TestV2LayoutMultiFile(t *testing.T) {
+	large := testData(testPieceLength+10, 'l')
+	small := testData(100, 's')
+	last := testData(p2p.MerkleBlockSize+1, 'z')
+
+	info, layers := testV2Info(t, "dir", []testFile{
+		// listed out of order, the file tree is walked in sorted order
+		{path: []string{"sub", "last.bin"}, data: last},
+		{path: []string{"a.bin"}, data: large},
+		{path: []string{"empty"}, data: nil},
+		{path: []string{"b.txt"}, data: small},
+	})
+
+	layout, err := info.v2Layout(layers)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !layout.isMultiFile {
+		t.Fatal("torrent of several files is not multi file")
+	}
+
+	wantFiles := []p2p.File{
+		{Path: "a.bin", Length: len(large)},
+		{Path: filepath.Join(".pad", "0"), Length: testPieceLength - 10, Padding: true},
+		{Path: "b.txt", Length: len(small)},
+		{Path: filepath.Join(".pad", "1"), Length: testPieceLength - 100, Padding: true},
+		{Path: "empty"},
+		{Path: filepath.Join("sub", "last.bin"), Length: len(last)},
+	}
+
+	if len(layout.files) != len(wantFiles) {
+		t.Fatalf("got files %v, want %v", layout.files, wantFiles)
+	}
+
+	length := 0
+
+	for i, file := range wantFiles {
+		if layout.files[i] != file {
+			t.Fatalf("file %d is %v, want %v", i, layout.files[i], file)
+		}
+
+		length += file.Length
+	}
+
+	if layout.length != length {
+		t.Fatalf("length is %d, want %d", layout.length, length)
+	}
+
+	pieces := [][]byte{large[:testPieceLength], large[testPieceLength:], small, last}
+
+	if len(layout.pieceHashes) != len(pieces) {
+		t.Fatalf("got %d piece hashes, want %d", len(layout.pieceHashes), len(pieces))
+	}
+
+	for i, piece := range pieces {
+		if layout.pieceLengths[i] != len(piece) {
+			t.Fatalf("piece %d has length %d, want %d", i, layout.pieceLengths[i], len(piece))
+		}
+
+		if !layout.pieceHashes[i].Verify(piece) {
+			t.Fatalf("piece %d does not verify", i)
+		}
+	}
+
+	if layout.pieceHashes[0].Verify(pieces[1]) {
+		t.Fatal("piece verifies against the hash of another piece")
+	}
+}
+
+func TestV2LayoutPieceLayers(t *testing.T) {
+	data := testData(2*testPieceLength+1, 'p')
+	info, layers := testV2Info(t, "file.bin", []testFile{{path: []string{"file.bin"}, data: data}})
+
+	_, err := info.v2Layout(nil)
+
+	if err == nil {
+		t.Fatal("layout without the piece layer of a large file succeeded")
+	}
+
+	for root, layer := range layers {
+		corrupted := []byte(layer)
+		corrupted[0] ^= 1
+		layers[root] = string(corrupted)
+	}
+
+	_, err = info.v2Layout(layers)
+
+	if err == nil {
+		t.Fatal("layout with a piece layer not matching the pieces root succeeded")
+	}
+}
+
+func TestV2LayoutInvalid(t *testing.T) {
+	info, layers := testV2Info(t, "file.bin", []testFile{{path: []string{"file.bin"}, data: testData(10, 'x')}})
+
+	info.PieceLength = 3 * p2p.MerkleBlockSize
+
+	if _, err := info.v2Layout(layers); err == nil {
+		t.Fatal("layout with a piece length which is not a power of two succeeded")
+	}
+
+	info.PieceLength = testPieceLength
+	info.FileTree = nil
+
+	if _, err := info.v2Layout(layers); err == nil {
+		t.Fatal("layout without file tree succeeded")
+	}
+}
+
+func TestCheckHybrid(t *testing.T) {
+	info, _ := testV2Info(t, "dir", []testFile{
+		{path: []string{"a.bin"}, data: testData(10, 'a')},
+		{path: []string{"sub", "b.bin"}, data: testData(20, 'b')},
+	})
+
+	info.Files = []file{
+		{Length: 10, Path: []string{"a.bin"}},
+		{Length: testPieceLength - 10, Path: []string{".pad", "0"}, Attr: "p"},
+		{Length: 20, Path: []string{"sub", "b.bin"}},
+	}
+
+	if err := info.checkHybrid(); err != nil {
+		t.Fatal(err)
+	}
+
+	info.Files[2].Length = 21
+
+	if err := info.checkHybrid(); err == nil {
+		t.Fatal("hybrid torrent with different file lengths passed")
+	}
+
+	info.Files = info.Files[:2]
+
+	if err := info.checkHybrid(); err == nil {
+		t.Fatal("hybrid torrent with missing v1 file passed")
+	}
+}
+
+func TestCheckHybridSingleFile(t *testing.T) {
+	info, _ := testV2Info(t, "file.bin", []testFile{{path: []string{"file.bin"}, data: testData(10, 'a')}})
+
+	info.Length = 10
+
+	if err := info.checkHybrid(); err != nil {
+		t.Fatal(err)
+	}
+
+	info.Name = "other.bin"
+
+	if err := info.checkHybrid(); err == nil {
+		t.Fatal("hybrid torrent with a different name passed")
+	}
+}
+
+func TestNextPowerOfTwo(t *testing.T) {
+	for n, want := range map[int]int{0: 1, 1: 1, 2: 2, 3: 4, 4: 4, 5: 8, 1000: 1024} {
+		if got := nextPowerOfTwo(n); got != want {
+			t.Fatalf("nextPowerOfTwo(%d) is %d, want %d", n, got, want)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package tracker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	minAnnounceInterval     = time.Minute
+	// how long to wait before trying again when no tracker answered
+	retryAnnounceInterval = 2 * time.Minute
+	// the stopped event is sent on the way out, so it is not waited on for long
+	stoppedAnnounceTimeout = 5 * time.Second
+)
+
+// Stats are the transfer counters reported to the trackers
+type Stats struct {
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+}
+
+// Announcer keeps the trackers of a torrent informed for as long as the torrent is running
+type Announcer struct {
+	trackers *TrackerList
+	infoHash [20]byte
+	peerId   []byte
+	port     int
+
+	mu          sync.Mutex
+	started     bool
+	failed      bool
+	interval    time.Duration
+	minInterval time.Duration
+	// wantsPeers is set when the session runs out of peers, to announce again early
+	wantsPeers   bool
+	lastAnnounce time.Time
+	wake         chan struct{}
+}
+
+func NewAnnouncer(trackers *TrackerList, infoHash [20]byte, peerId []byte, port int) *Announcer {
+	return &Announcer{
+		trackers: trackers,
+		infoHash: infoHash,
+		peerId:   peerId,
+		port:     port,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// RequestPeers asks Run to announce again as soon as the trackers allow it, when more peers
+// are needed
+func (a *Announcer) RequestPeers() {
+	a.mu.Lock()
+	a.wantsPeers = true
+	a.mu.Unlock()
+
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Started tells if the started event has been sent successfully
+func (a *Announcer) Started() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.started
+}
+
+// Announce sends a single announce to the trackers and returns the peers they know of
+func (a *Announcer) Announce(event Event, stats Stats) ([]peer.Peer, error) {
+	resp, err := a.trackers.Announce(&AnnounceRequest{
+		InfoHash:   a.infoHash,
+		PeerId:     a.peerId,
+		Port:       a.port,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Left:       stats.Left,
+		Event:      event,
+	})
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.lastAnnounce = time.Now()
+	a.wantsPeers = false
+
+	if err != nil {
+		a.failed = true
+		return nil, err
+	}
+
+	a.failed = false
+	a.interval = resp.Interval
+	a.minInterval = resp.MinInterval
+
+	if event == EventStarted {
+		a.started = true
+	}
+
+	return resp.Peers, nil
+}
+
+// nextAnnounce returns how long to wait before announcing again
+func (a *Announcer) nextAnnounce() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	// the wait is counted from the last announce, as Run works it out again when peers are asked for
+	if a.failed {
+		return retryAnnounceInterval - time.Since(a.lastAnnounce)
+	}
+
+	interval := a.interval
+
+	if interval == 0 {
+		interval = defaultAnnounceInterval
+	}
+
+	if interval < a.minInterval {
+		interval = a.minInterval
+	}
+
+	if interval < minAnnounceInterval {
+		interval = minAnnounceInterval
+	}
+
+	// peers are asked for early, though not more often than the trackers allow
+	if a.wantsPeers {
+		interval = a.minInterval
+
+		if interval < minAnnounceInterval {
+			interval = minAnnounceInterval
+		}
+	}
+
+	return interval - time.Since(a.lastAnnounce)
+}
+
+// Run re-announces at the interval asked by the trackers until the context is cancelled, at
+// which point the stopped event is sent. The started event is sent first if it has not been
+// yet, and the completed event is sent as soon as completed is closed. Peers received from
+// the trackers are handed to onPeers.
+func (a *Announcer) Run(ctx context.Context, stats func() Stats, completed <-chan struct{}, onPeers func([]peer.Peer)) {
+	for {
+		event := EventNone
+		wait := a.nextAnnounce()
+
+		// the first started announce goes out at once, as nothing was announced yet, while a
+		// failed one waits for the retry interval like any other
+		if !a.Started() {
+			event = EventStarted
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			a.stop(stats())
+			return
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			if event == EventNone {
+				event = EventCompleted
+			}
+		case <-a.wake:
+			// peers were asked for, the time to the next announce is worked out again
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		peers, err := a.Announce(event, stats())
+
+		if err == nil && len(peers) > 0 {
+			onPeers(peers)
+		}
+	}
+}
+
+// stop sends the stopped event without waiting too long for the trackers
+func (a *Announcer) stop(stats Stats) {
+	if !a.Started() {
+		return
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		a.Announce(EventStopped, stats)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stoppedAnnounceTimeout):
+	}
+}
@@ -0,0 +1,61 @@
+package tracker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OmBudhiraja/torrent-client/internal/peer"
+)
+
+func TestAnnouncerBacksOffAfterFailedStart(t *testing.T) {
+	var requests atomic.Int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	trackers := NewTrackerList(server.URL+"/announce", nil)
+	a := NewAnnouncer(trackers, [20]byte{1}, []byte("-TC0001-000000000000"), 6881)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	a.Run(ctx, func() Stats { return Stats{} }, nil, func([]peer.Peer) {})
+
+	if n := requests.Load(); n != 1 {
+		t.Fatalf("tracker got %d announces, want 1 before the retry interval", n)
+	}
+
+	if a.Started() {
+		t.Fatal("started is set after a failed announce")
+	}
+}
+
+func TestNextAnnounce(t *testing.T) {
+	a := NewAnnouncer(NewTrackerList("", nil), [20]byte{}, nil, 0)
+
+	if wait := a.nextAnnounce(); wait > 0 {
+		t.Fatalf("first announce waits %s", wait)
+	}
+
+	a.lastAnnounce = time.Now()
+	a.failed = true
+
+	if wait := a.nextAnnounce(); wait <= retryAnnounceInterval-time.Second {
+		t.Fatalf("failed announce retried after %s, want %s", wait, retryAnnounceInterval)
+	}
+
+	a.failed = false
+	a.interval = 10 * time.Second
+	a.minInterval = 0
+
+	if wait := a.nextAnnounce(); wait <= minAnnounceInterval-time.Second {
+		t.Fatalf("interval below the minimum gave %s", wait)
+	}
+}
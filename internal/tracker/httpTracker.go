@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"github.com/zeebo/bencode"
 
@@ -13,22 +14,32 @@ import (
 
 type bencodeTrackerResponse struct {
 	Interval      int                `bencode:"interval"`
+	MinInterval   int                `bencode:"min interval"`
 	Peers         bencode.RawMessage `bencode:"peers"`
 	FailureReason string             `bencode:"failure reason"`
 }
 
-func getPeersFromHTTPTracker(baseUrl *url.URL, infoHash, peerId []byte, length int) ([]peer.Peer, error) {
+func announceToHTTPTracker(baseUrl *url.URL, req *AnnounceRequest) (*AnnounceResponse, error) {
 	params := url.Values{}
 
-	params.Add("info_hash", string(infoHash))
-	params.Add("peer_id", string(peerId))
-	params.Add("port", "6881")
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
-	params.Add("left", fmt.Sprintf("%d", length))
+	params.Add("info_hash", string(req.InfoHash[:]))
+	params.Add("peer_id", string(req.PeerId))
+	params.Add("port", fmt.Sprintf("%d", req.Port))
+	params.Add("uploaded", fmt.Sprintf("%d", req.Uploaded))
+	params.Add("downloaded", fmt.Sprintf("%d", req.Downloaded))
+	params.Add("left", fmt.Sprintf("%d", req.Left))
 	params.Add("compact", "1")
 
-	baseUrl.RawQuery = params.Encode()
+	if req.Event != EventNone {
+		params.Add("event", req.Event.String())
+	}
+
+	// keep the parameters of the announce url, private trackers put the passkey there
+	if baseUrl.RawQuery != "" {
+		baseUrl.RawQuery += "&" + params.Encode()
+	} else {
+		baseUrl.RawQuery = params.Encode()
+	}
 
 	resp, err := http.Get(baseUrl.String())
 
@@ -56,5 +67,75 @@ func getPeersFromHTTPTracker(baseUrl *url.URL, infoHash, peerId []byte, length i
 		return nil, fmt.Errorf("tracker failed: %s", trackerResp.FailureReason)
 	}
 
-	return peer.Unmarshal(trackerResp.Peers)
+	peers, err := peer.Unmarshal(trackerResp.Peers)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &AnnounceResponse{
+		Peers:       peers,
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+	}, nil
+}
+
+type bencodeScrapeResponse struct {
+	Files         map[string]bencodeScrapeFile `bencode:"files"`
+	FailureReason string                       `bencode:"failure reason"`
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+func scrapeHTTPTracker(scrapeUrl *url.URL, infoHash [20]byte) (*ScrapeResponse, error) {
+	params := url.Values{}
+	params.Add("info_hash", string(infoHash[:]))
+
+	if scrapeUrl.RawQuery != "" {
+		scrapeUrl.RawQuery += "&" + params.Encode()
+	} else {
+		scrapeUrl.RawQuery = params.Encode()
+	}
+
+	resp, err := http.Get(scrapeUrl.String())
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape tracker: %s", err.Error())
+	}
+
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %s", err.Error())
+	}
+
+	scrapeResp := bencodeScrapeResponse{}
+
+	err = bencode.DecodeBytes(respBody, &scrapeResp)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode scrape response: %s", err.Error())
+	}
+
+	if scrapeResp.FailureReason != "" {
+		return nil, fmt.Errorf("tracker failed: %s", scrapeResp.FailureReason)
+	}
+
+	file, ok := scrapeResp.Files[string(infoHash[:])]
+
+	if !ok {
+		return nil, fmt.Errorf("torrent is not known to the tracker")
+	}
+
+	return &ScrapeResponse{
+		Complete:   file.Complete,
+		Incomplete: file.Incomplete,
+		Downloaded: file.Downloaded,
+	}, nil
 }
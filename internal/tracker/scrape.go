@@ -0,0 +1,107 @@
+package tracker
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ScrapeResponse struct {
+	// Complete is the number of seeders
+	Complete int
+	// Incomplete is the number of leechers
+	Incomplete int
+	// Downloaded is the number of times the torrent has been downloaded
+	Downloaded int
+}
+
+type ScrapeResult struct {
+	Tracker string
+	Resp    *ScrapeResponse
+	Err     error
+}
+
+// Scrape asks a single tracker for the swarm statistics of a torrent
+func Scrape(announce string, infoHash [20]byte) (*ScrapeResponse, error) {
+	baseUrl, err := url.Parse(announce)
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse tracker url: %s", err.Error())
+	}
+
+	if baseUrl.Scheme == "udp" {
+		return scrapeUDPTracker(baseUrl, infoHash)
+	}
+
+	scrapeUrl, err := scrapeURL(baseUrl)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return scrapeHTTPTracker(scrapeUrl, infoHash)
+}
+
+// scrapeURL derives the scrape url of an http tracker from its announce url, by convention
+// it is only available when the last path component starts with "announce"
+func scrapeURL(announceUrl *url.URL) (*url.URL, error) {
+	index := strings.LastIndex(announceUrl.Path, "/")
+	last := announceUrl.Path[index+1:]
+
+	if !strings.HasPrefix(last, "announce") {
+		return nil, fmt.Errorf("tracker does not support scrape")
+	}
+
+	scrapeUrl := *announceUrl
+	scrapeUrl.Path = announceUrl.Path[:index+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	scrapeUrl.RawPath = ""
+
+	return &scrapeUrl, nil
+}
+
+// Scrape asks every tracker of the list for the swarm statistics of a torrent
+func (tl *TrackerList) Scrape(infoHash [20]byte) []ScrapeResult {
+	tl.mu.Lock()
+	var urls []string
+	for _, tier := range tl.tiers {
+		urls = append(urls, tier...)
+	}
+	tl.mu.Unlock()
+
+	results := make([]ScrapeResult, len(urls))
+
+	var wg sync.WaitGroup
+
+	for i, announce := range urls {
+		results[i].Tracker = announce
+
+		wg.Add(1)
+
+		go func(result *ScrapeResult) {
+			defer wg.Done()
+
+			done := make(chan struct{})
+
+			var resp *ScrapeResponse
+			var err error
+
+			go func() {
+				resp, err = Scrape(result.Tracker, infoHash)
+				close(done)
+			}()
+
+			select {
+			case <-done:
+				result.Resp, result.Err = resp, err
+			case <-time.After(announceTimeout):
+				result.Err = fmt.Errorf("tracker did not respond in %s", announceTimeout)
+			}
+		}(&results[i])
+	}
+
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,89 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	tests := []struct {
+		announce string
+		want     string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?passkey=abc%2F1", "http://example.com/scrape?passkey=abc%2F1"},
+		{"http://example.com/abc123/announce?passkey=x", "http://example.com/abc123/scrape?passkey=x"},
+		// scrape is only available when the last component starts with announce
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+		{"http://example.com/x_announce", ""},
+		{"http://example.com/", ""},
+	}
+
+	for _, test := range tests {
+		announceUrl, err := url.Parse(test.announce)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scrapeUrl, err := scrapeURL(announceUrl)
+
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("scrape url of %s is %s, want none", test.announce, scrapeUrl)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("no scrape url for %s: %s", test.announce, err)
+			continue
+		}
+
+		if scrapeUrl.String() != test.want {
+			t.Errorf("scrape url of %s is %s, want %s", test.announce, scrapeUrl, test.want)
+		}
+	}
+}
+
+func TestScrapeHTTPTracker(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+
+	var query url.Values
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+
+		query = r.URL.Query()
+
+		w.Write([]byte("d5:filesd20:" + string(infoHash[:]) + "d8:completei5e10:downloadedi7e10:incompletei3eeee"))
+	}))
+	defer server.Close()
+
+	resp, err := Scrape(server.URL+"/announce?passkey=abc", infoHash)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.Complete != 5 || resp.Incomplete != 3 || resp.Downloaded != 7 {
+		t.Fatalf("scrape response is %+v", resp)
+	}
+
+	// the passkey is kept next to the info hash
+	if query.Get("passkey") != "abc" || query.Get("info_hash") != string(infoHash[:]) {
+		t.Fatalf("scrape query is %v", query)
+	}
+
+	if _, err := Scrape(server.URL+"/announce", [20]byte{9}); err == nil {
+		t.Fatal("scraped a torrent unknown to the tracker")
+	}
+}
@@ -3,11 +3,52 @@ package tracker
 import (
 	"fmt"
 	"net/url"
+	"time"
 
 	"github.com/OmBudhiraja/torrent-client/internal/peer"
 )
 
-func GetPeers(announce string, infohash [20]byte, peerId []byte, length int) ([]peer.Peer, error) {
+// Event tells the tracker why we are announcing, the values are the ones used by UDP trackers
+type Event int
+
+const (
+	EventNone Event = iota
+	EventCompleted
+	EventStarted
+	EventStopped
+)
+
+func (e Event) String() string {
+	switch e {
+	case EventCompleted:
+		return "completed"
+	case EventStarted:
+		return "started"
+	case EventStopped:
+		return "stopped"
+	default:
+		return ""
+	}
+}
+
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerId     []byte
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+}
+
+type AnnounceResponse struct {
+	Peers       []peer.Peer
+	Interval    time.Duration
+	MinInterval time.Duration
+}
+
+// Announce sends an announce request to a single tracker
+func Announce(announce string, req *AnnounceRequest) (*AnnounceResponse, error) {
 
 	baseUrl, err := url.Parse(announce)
 
@@ -16,9 +57,9 @@ func GetPeers(announce string, infohash [20]byte, peerId []byte, length int) ([]
 	}
 
 	if baseUrl.Scheme == "udp" {
-		return getPeersFromUDPTracker(baseUrl, infohash[:], peerId, length)
+		return announceToUDPTracker(baseUrl, req)
 	} else {
-		return getPeersFromHTTPTracker(baseUrl, infohash[:], peerId, length)
+		return announceToHTTPTracker(baseUrl, req)
 	}
 
 }
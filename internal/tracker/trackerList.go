@@ -0,0 +1,190 @@
+package tracker
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// how long to wait for the trackers of every tier to answer before
+	// going ahead with the peers received so far
+	announceTimeout = 30 * time.Second
+)
+
+// TrackerList holds the trackers of a torrent grouped in tiers as described in BEP 12.
+// Trackers are shuffled within their tier and the one that answers is moved to the front
+// of its tier, so that it is tried first on the next announce.
+type TrackerList struct {
+	mu    sync.Mutex
+	tiers [][]string
+}
+
+// NewTrackerList creates the tracker list of a torrent, the announce-list takes precedence
+// over the single announce url when present
+func NewTrackerList(announce string, announceList [][]string) *TrackerList {
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	var tiers [][]string
+
+	for _, tier := range announceList {
+		urls := make([]string, 0, len(tier))
+
+		for _, url := range tier {
+			if url != "" {
+				urls = append(urls, url)
+			}
+		}
+
+		if len(urls) == 0 {
+			continue
+		}
+
+		random.Shuffle(len(urls), func(i, j int) {
+			urls[i], urls[j] = urls[j], urls[i]
+		})
+
+		tiers = append(tiers, urls)
+	}
+
+	if len(tiers) == 0 && announce != "" {
+		tiers = append(tiers, []string{announce})
+	}
+
+	return &TrackerList{tiers: tiers}
+}
+
+// Len returns the total number of trackers in the list
+func (tl *TrackerList) Len() int {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	count := 0
+
+	for _, tier := range tl.tiers {
+		count += len(tier)
+	}
+
+	return count
+}
+
+type tierResult struct {
+	resp *AnnounceResponse
+	err  error
+}
+
+// Announce announces to every tier at once, trying the trackers of a tier in order until one
+// answers, and merges the peers of all tiers. The shortest interval of the tiers is returned.
+func (tl *TrackerList) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	tl.mu.Lock()
+	numTiers := len(tl.tiers)
+	tl.mu.Unlock()
+
+	if numTiers == 0 {
+		return nil, fmt.Errorf("no trackers")
+	}
+
+	results := make(chan tierResult, numTiers)
+
+	for tier := 0; tier < numTiers; tier++ {
+		go func(tier int) {
+			resp, err := tl.announceTier(tier, req)
+			results <- tierResult{resp: resp, err: err}
+		}(tier)
+	}
+
+	timeout := time.NewTimer(announceTimeout)
+	defer timeout.Stop()
+
+	merged := &AnnounceResponse{}
+	answered := false
+
+	var lastErr error
+
+	seen := make(map[string]bool)
+
+	for received := 0; received < numTiers; received++ {
+		var result tierResult
+
+		select {
+		case result = <-results:
+		case <-timeout.C:
+			if answered {
+				return merged, nil
+			}
+			return nil, fmt.Errorf("trackers did not respond in %s", announceTimeout)
+		}
+
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+
+		resp := result.resp
+
+		if !answered || (resp.Interval > 0 && resp.Interval < merged.Interval) {
+			merged.Interval = resp.Interval
+		}
+
+		if resp.MinInterval > merged.MinInterval {
+			merged.MinInterval = resp.MinInterval
+		}
+
+		answered = true
+
+		for _, p := range resp.Peers {
+			if !seen[p.Address] {
+				seen[p.Address] = true
+				merged.Peers = append(merged.Peers, p)
+			}
+		}
+	}
+
+	if !answered {
+		return nil, lastErr
+	}
+
+	return merged, nil
+}
+
+// announceTier tries the trackers of a tier in order until one of them answers
+func (tl *TrackerList) announceTier(tier int, req *AnnounceRequest) (*AnnounceResponse, error) {
+	tl.mu.Lock()
+	urls := make([]string, len(tl.tiers[tier]))
+	copy(urls, tl.tiers[tier])
+	tl.mu.Unlock()
+
+	var lastErr error
+
+	for _, url := range urls {
+		resp, err := Announce(url, req)
+
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		tl.promote(tier, url)
+
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// promote moves a tracker which answered to the front of its tier
+func (tl *TrackerList) promote(tier int, url string) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	urls := tl.tiers[tier]
+
+	for i, u := range urls {
+		if u == url {
+			copy(urls[1:i+1], urls[:i])
+			urls[0] = url
+			return
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func tiers(tl *TrackerList) [][]string {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	var copied [][]string
+
+	for _, tier := range tl.tiers {
+		copied = append(copied, append([]string(nil), tier...))
+	}
+
+	return copied
+}
+
+func TestNewTrackerList(t *testing.T) {
+	tl := NewTrackerList("http://announce", [][]string{
+		{"http://a", "", "http://b"},
+		{""},
+		{"udp://c"},
+	})
+
+	got := tiers(tl)
+
+	if len(got) != 2 || tl.Len() != 3 {
+		t.Fatalf("tiers are %v, want the empty urls and tiers left out", got)
+	}
+
+	sort.Strings(got[0])
+
+	if strings.Join(got[0], " ") != "http://a http://b" || got[1][0] != "udp://c" {
+		t.Fatalf("tiers are %v", got)
+	}
+
+	// the announce url is only used without an announce-list
+	tl = NewTrackerList("http://announce", nil)
+
+	if got := tiers(tl); len(got) != 1 || got[0][0] != "http://announce" {
+		t.Fatalf("tiers are %v, want the announce url", got)
+	}
+
+	if NewTrackerList("", nil).Len() != 0 {
+		t.Fatal("trackers without an announce url")
+	}
+}
+
+func TestTrackerListShufflesTiers(t *testing.T) {
+	tier := []string{"http://a", "http://b", "http://c"}
+	orders := make(map[string]bool)
+
+	for i := 0; i < 50; i++ {
+		got := tiers(NewTrackerList("", [][]string{tier}))[0]
+		orders[strings.Join(got, " ")] = true
+	}
+
+	if len(orders) < 2 {
+		t.Fatalf("trackers of a tier are not shuffled, always %v", orders)
+	}
+
+	if strings.Join(tier, " ") != "http://a http://b http://c" {
+		t.Fatal("shuffling changed the announce-list of the torrent")
+	}
+}
+
+func TestTrackerListPromotesAnsweringTracker(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	answering := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer answering.Close()
+
+	tl := NewTrackerList("", nil)
+	tl.tiers = [][]string{{failing.URL + "/announce", answering.URL + "/announce"}}
+
+	resp, err := tl.Announce(&AnnounceRequest{PeerId: []byte("-TC0001-000000000000"), Port: 6881})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Peers) != 1 || resp.Peers[0].Address != "127.0.0.1:6881" {
+		t.Fatalf("peers are %v", resp.Peers)
+	}
+
+	got := tiers(tl)[0]
+
+	if got[0] != answering.URL+"/announce" || got[1] != failing.URL+"/announce" {
+		t.Fatalf("tier is %v, want the answering tracker first", got)
+	}
+}
+
+func TestPromote(t *testing.T) {
+	tl := &TrackerList{tiers: [][]string{{"a", "b", "c", "d"}}}
+
+	tl.promote(0, "c")
+
+	if got := strings.Join(tiers(tl)[0], " "); got != "c a b d" {
+		t.Fatalf("tier is %s, want c a b d", got)
+	}
+
+	tl.promote(0, "e")
+
+	if got := strings.Join(tiers(tl)[0], " "); got != "c a b d" {
+		t.Fatalf("unknown tracker changed the tier to %s", got)
+	}
+}
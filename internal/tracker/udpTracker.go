@@ -16,13 +16,14 @@ type UPD_TRACKER_ACTION int
 const (
 	UPD_CONNECT_ACTION UPD_TRACKER_ACTION = iota
 	UPD_ANNOUNCE_ACTION
+	UPD_SCRAPE_ACTION
 
 	PROTOCOL_ID         uint64 = 0x41727101980
 	MAX_RETRIES                = 8
 	INITIAL_RETRY_DELAY        = 15 * time.Second
 )
 
-func getPeersFromUDPTracker(baseUrl *url.URL, infoHash, peerId []byte, length int) ([]peer.Peer, error) {
+func announceToUDPTracker(baseUrl *url.URL, req *AnnounceRequest) (*AnnounceResponse, error) {
 	socket, err := net.Dial("udp", baseUrl.Host)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to tracker: %s", err.Error())
@@ -43,14 +44,14 @@ func getPeersFromUDPTracker(baseUrl *url.URL, infoHash, peerId []byte, length in
 
 	// Send announce request with retries
 	transactionID = createTransactionId()
-	announceReq := buildAnnounceRequest(connectionId, transactionID, infoHash, peerId, length)
+	announceReq := buildAnnounceRequest(connectionId, transactionID, req)
 
-	peers, err := sendAnnounceRequestWithRetry(socket, announceReq, transactionID)
+	resp, err := sendAnnounceRequestWithRetry(socket, announceReq, transactionID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get peers from tracker: %s", err.Error())
 	}
 
-	return peers, nil
+	return resp, nil
 }
 
 func sendConnectRequestWithRetry(socket net.Conn) (uint64, error) {
@@ -97,7 +98,7 @@ func sendConnectRequestWithRetry(socket net.Conn) (uint64, error) {
 	return 0, fmt.Errorf("failed to establish connection after %d retries", MAX_RETRIES)
 }
 
-func sendAnnounceRequestWithRetry(socket net.Conn, announceReq []byte, transactionID uint32) ([]peer.Peer, error) {
+func sendAnnounceRequestWithRetry(socket net.Conn, announceReq []byte, transactionID uint32) (*AnnounceResponse, error) {
 	for retry := 0; retry <= MAX_RETRIES; retry++ {
 		_, err := socket.Write(announceReq)
 		if err != nil {
@@ -125,51 +126,139 @@ func sendAnnounceRequestWithRetry(socket net.Conn, announceReq []byte, transacti
 			continue // Wrong response type, retry
 		}
 
-		peersBytes, err := parseAnnounceResponse(response[:n], transactionID)
+		interval, peersBytes, err := parseAnnounceResponse(response[:n], transactionID)
 		if err != nil {
 			continue // Invalid response, retry
 		}
 
-		return peer.Unmarshal(peersBytes)
+		peers, err := peer.UnmarshalCompact(peersBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		return &AnnounceResponse{
+			Peers:    peers,
+			Interval: time.Duration(interval) * time.Second,
+		}, nil
 	}
 
 	return nil, fmt.Errorf("failed to get peers after %d retries", MAX_RETRIES)
 }
 
-func buildAnnounceRequest(connectionId uint64, transactionId uint32, infoHash, peerId []byte, length int) []byte {
+func scrapeUDPTracker(baseUrl *url.URL, infoHash [20]byte) (*ScrapeResponse, error) {
+	socket, err := net.Dial("udp", baseUrl.Host)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to tracker: %s", err.Error())
+	}
+	defer socket.Close()
+
+	// Set a deadline for the entire operation
+	socket.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	connectionId, err := sendConnectRequestWithRetry(socket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish connection with tracker: %s", err.Error())
+	}
+
+	transactionID := createTransactionId()
+	scrapeReq := buildScrapeRequest(connectionId, transactionID, infoHash)
+
+	resp, err := sendScrapeRequestWithRetry(socket, scrapeReq, transactionID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scrape tracker: %s", err.Error())
+	}
+
+	return resp, nil
+}
+
+func sendScrapeRequestWithRetry(socket net.Conn, scrapeReq []byte, transactionID uint32) (*ScrapeResponse, error) {
+	for retry := 0; retry <= MAX_RETRIES; retry++ {
+		_, err := socket.Write(scrapeReq)
+		if err != nil {
+			return nil, err
+		}
+
+		// Wait for response with timeout
+		response := make([]byte, 1024)
+		socket.SetReadDeadline(time.Now().Add(INITIAL_RETRY_DELAY * time.Duration(1<<retry)))
+
+		n, err := socket.Read(response)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue // Retry on timeout
+			}
+			return nil, err
+		}
+
+		// action, transaction id and the seeders, completed and leechers of a single torrent
+		if n < 20 {
+			continue // Invalid response, retry
+		}
+
+		if respType(response[:n]) != UPD_SCRAPE_ACTION {
+			continue // Wrong response type, retry
+		}
+
+		if binary.BigEndian.Uint32(response[4:8]) != transactionID {
+			continue // Transaction ID mismatch, retry
+		}
+
+		return &ScrapeResponse{
+			Complete:   int(binary.BigEndian.Uint32(response[8:12])),
+			Downloaded: int(binary.BigEndian.Uint32(response[12:16])),
+			Incomplete: int(binary.BigEndian.Uint32(response[16:20])),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("failed to scrape after %d retries", MAX_RETRIES)
+}
+
+func buildScrapeRequest(connectionId uint64, transactionId uint32, infoHash [20]byte) []byte {
+	buffer := make([]byte, 36)
+
+	binary.BigEndian.PutUint64(buffer[0:8], connectionId)               // connection_id
+	binary.BigEndian.PutUint32(buffer[8:12], uint32(UPD_SCRAPE_ACTION)) // action
+	binary.BigEndian.PutUint32(buffer[12:16], transactionId)            // transaction_id
+	copy(buffer[16:36], infoHash[:])                                    // info_hash
+
+	return buffer
+}
+
+func buildAnnounceRequest(connectionId uint64, transactionId uint32, req *AnnounceRequest) []byte {
 	buffer := make([]byte, 98)
 
 	binary.BigEndian.PutUint64(buffer[0:8], connectionId)                 // connection_id
 	binary.BigEndian.PutUint32(buffer[8:12], uint32(UPD_ANNOUNCE_ACTION)) // action
 	binary.BigEndian.PutUint32(buffer[12:16], transactionId)              // transaction_id
-	copy(buffer[16:36], infoHash)                                         // info_hash
-	copy(buffer[36:56], peerId)                                           // peer_id
-	binary.BigEndian.PutUint64(buffer[56:64], 0)                          // downloaded
-	binary.BigEndian.PutUint64(buffer[64:72], uint64(length))             // left
-	binary.BigEndian.PutUint64(buffer[72:80], 0)                          // uploaded
-	binary.BigEndian.PutUint32(buffer[80:84], 0)                          // event
+	copy(buffer[16:36], req.InfoHash[:])                                  // info_hash
+	copy(buffer[36:56], req.PeerId)                                       // peer_id
+	binary.BigEndian.PutUint64(buffer[56:64], uint64(req.Downloaded))     // downloaded
+	binary.BigEndian.PutUint64(buffer[64:72], uint64(req.Left))           // left
+	binary.BigEndian.PutUint64(buffer[72:80], uint64(req.Uploaded))       // uploaded
+	binary.BigEndian.PutUint32(buffer[80:84], uint32(req.Event))          // event
 	binary.BigEndian.PutUint32(buffer[84:88], 0)                          // ip
 	binary.BigEndian.PutUint32(buffer[88:92], 0)                          // key
 	binary.BigEndian.PutUint32(buffer[92:96], uint32(0xFFFFFFFF))         // num_want
-	binary.BigEndian.PutUint16(buffer[96:98], 6881)                       // port
+	binary.BigEndian.PutUint16(buffer[96:98], uint16(req.Port))           // port
 
 	return buffer
 }
 
-func parseAnnounceResponse(buffer []byte, tranactionId uint32) ([]byte, error) {
+func parseAnnounceResponse(buffer []byte, tranactionId uint32) (uint32, []byte, error) {
 	if len(buffer) < 20 {
-		return nil, fmt.Errorf("invalid response")
+		return 0, nil, fmt.Errorf("invalid response")
 	}
 
 	tranactionIdResponse := binary.BigEndian.Uint32(buffer[4:8])
 
 	if tranactionIdResponse != tranactionId {
-		return nil, fmt.Errorf("transaction id mismatch")
+		return 0, nil, fmt.Errorf("transaction id mismatch")
 	}
 
+	interval := binary.BigEndian.Uint32(buffer[8:12])
 	peerBytes := buffer[20:]
 
-	return peerBytes, nil
+	return interval, peerBytes, nil
 }
 
 func sendConnectRequest(socket net.Conn, transactionID uint32) error {
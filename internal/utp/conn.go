@@ -0,0 +1,702 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// payload of a data packet, small enough to avoid fragmentation on common links
+	maxPayload = 1382
+	// receive buffer advertised as our window
+	recvBufferSize = 1 << 20
+	// out of order packets further ahead than this are dropped
+	maxReorder = 1024
+
+	// ledbat aims for this much extra one way delay caused by our own traffic
+	targetDelay = 100 * time.Millisecond
+	// maximum growth of the congestion window per round trip
+	maxCwndIncrease = 3000
+	minCwnd         = 2 * maxPayload
+	maxCwnd         = recvBufferSize
+	// the base delay is the minimum delay seen over the last few minutes
+	delayHistory = 2
+
+	initialRTO = time.Second
+	minRTO     = 500 * time.Millisecond
+	maxRTO     = 60 * time.Second
+	// consecutive timeouts after which the peer is considered gone
+	maxTimeouts = 6
+	// how long a closed connection waits for its fin to be acknowledged
+	finTimeout = 10 * time.Second
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	stateFinSent
+	stateClosed
+)
+
+type outPacket struct {
+	h             header
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a uTP connection, a reliable ordered stream whose congestion control backs off
+// when other traffic makes the delay grow
+type Conn struct {
+	s      *Socket
+	addr   *net.UDPAddr
+	recvId uint16
+	sendId uint16
+
+	// connected is closed once the handshake completes, done once the connection is closed
+	connected chan struct{}
+	done      chan struct{}
+	readable  chan struct{}
+	writable  chan struct{}
+	writeMu   sync.Mutex
+
+	mu    sync.Mutex
+	state connState
+	err   error
+
+	seqNr uint16
+	ackNr uint16
+
+	readBuf    bytes.Buffer
+	outOfOrder map[uint16][]byte
+	gotFin     bool
+	finSeq     uint16
+	eof        bool
+
+	outstanding []*outPacket
+	inFlight    int
+	cwnd        int
+	peerWnd     int
+	lastAck     uint16
+	dupAcks     int
+	// while recovering from a loss, every ack below recoverSeq which leaves packets outstanding
+	// points at the next lost one
+	recovering bool
+	recoverSeq uint16
+
+	rtt        time.Duration
+	rttVar     time.Duration
+	rto        time.Duration
+	resendAt   time.Time
+	timeouts   int
+	closeAt    time.Time
+	replyMicro uint32
+
+	baseDelays  []uint32
+	bucketStart time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, addr *net.UDPAddr, recvId, sendId uint16) *Conn {
+	return &Conn{
+		s:          s,
+		addr:       addr,
+		recvId:     recvId,
+		sendId:     sendId,
+		connected:  make(chan struct{}),
+		done:       make(chan struct{}),
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+		outOfOrder: make(map[uint16][]byte),
+		cwnd:       minCwnd,
+		peerWnd:    maxPayload,
+		rto:        initialRTO,
+	}
+}
+
+// connect sends the syn of an outbound connection
+func (c *Conn) connect() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateSynSent
+	c.seqNr = 1
+
+	c.sendPacket(stSyn, nil)
+}
+
+// accept answers the syn of an inbound connection
+func (c *Conn) accept(syn *header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = stateConnected
+	c.ackNr = syn.seqNr
+	c.seqNr = uint16(rand.Intn(0x10000))
+	c.peerWnd = int(syn.wndSize)
+	c.replyMicro = timestampMicros() - syn.timestamp
+
+	close(c.connected)
+
+	c.sendState()
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+
+		if c.readBuf.Len() > 0 {
+			// the peer stops sending once our window is full, tell it when it opens again
+			wasFull := c.recvWindow() < maxPayload
+			n, _ := c.readBuf.Read(b)
+
+			if wasFull && c.recvWindow() >= maxPayload && c.state != stateClosed {
+				c.sendState()
+			}
+
+			c.mu.Unlock()
+			return n, nil
+		}
+
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		err := wait(c.readable, deadline)
+
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+
+	for written < len(b) {
+		c.mu.Lock()
+
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return written, err
+		}
+
+		if c.state != stateConnected {
+			c.mu.Unlock()
+			return written, net.ErrClosed
+		}
+
+		// at least one packet is always allowed so that a closed window is probed
+		for written < len(b) && (c.inFlight == 0 || c.inFlight+maxPayload <= c.window()) {
+			size := min(maxPayload, len(b)-written)
+			payload := make([]byte, size)
+			copy(payload, b[written:written+size])
+
+			c.sendPacket(stData, payload)
+			written += size
+		}
+
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+
+		if written < len(b) {
+			err := wait(c.writable, deadline)
+
+			if err != nil {
+				return written, err
+			}
+		}
+	}
+
+	return written, nil
+}
+
+// Close sends a fin after the data written so far, the connection is released once the peer
+// acknowledges it
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case stateClosed, stateFinSent:
+		return nil
+	case stateSynSent:
+		c.teardown(net.ErrClosed)
+		return nil
+	}
+
+	if c.err != nil {
+		c.teardown(c.err)
+		return nil
+	}
+
+	c.sendPacket(stFin, nil)
+	c.state = stateFinSent
+	c.closeAt = time.Now().Add(finTimeout)
+
+	// local reads and writes are over
+	c.err = net.ErrClosed
+	signal(c.readable)
+	signal(c.writable)
+
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+
+	// wake a blocked read so that it waits for the new deadline
+	signal(c.readable)
+
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+
+	signal(c.writable)
+
+	return nil
+}
+
+// reset aborts the connection, telling the peer
+func (c *Conn) reset(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.sendPacket(stReset, nil)
+	c.teardown(err)
+}
+
+func (c *Conn) closeErr() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// teardown releases the connection, it must be called with the lock held
+func (c *Conn) teardown(err error) {
+	if c.state == stateClosed {
+		return
+	}
+
+	c.state = stateClosed
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	close(c.done)
+	signal(c.readable)
+	signal(c.writable)
+
+	c.s.remove(c)
+}
+
+// handle processes a packet of the peer
+func (c *Conn) handle(h *header, payload []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	c.replyMicro = timestampMicros() - h.timestamp
+	c.peerWnd = int(h.wndSize)
+
+	switch h.typ {
+	case stReset:
+		c.teardown(errors.New("connection reset by peer"))
+		return
+	case stSyn:
+		c.sendState()
+		return
+	}
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+
+		// the state packet carries the sequence number of the first data packet
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+		close(c.connected)
+	}
+
+	c.handleAck(h)
+
+	switch h.typ {
+	case stData:
+		c.receive(h.seqNr, payload)
+		c.sendState()
+	case stFin:
+		if !c.gotFin {
+			c.gotFin = true
+			c.finSeq = h.seqNr
+			c.deliver()
+		}
+		c.sendState()
+	}
+
+	if c.state == stateFinSent && len(c.outstanding) == 0 {
+		c.teardown(net.ErrClosed)
+	}
+}
+
+// handleAck releases the packets acknowledged by the peer and adjusts the congestion window
+func (c *Conn) handleAck(h *header) {
+	now := time.Now()
+	acked := 0
+
+	for len(c.outstanding) > 0 && !seqLess(h.ackNr, c.outstanding[0].h.seqNr) {
+		p := c.outstanding[0]
+
+		// retransmitted packets give ambiguous round trip times
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+
+		acked += len(p.payload)
+		c.inFlight -= len(p.payload)
+		c.outstanding = c.outstanding[1:]
+	}
+
+	if acked > 0 || (len(c.outstanding) == 0 && c.timeouts > 0) {
+		c.dupAcks = 0
+		c.timeouts = 0
+		c.resendAt = now.Add(c.rto)
+
+		if acked > 0 {
+			c.updateCwnd(acked, h.timestampDif)
+		}
+
+		if c.recovering {
+			if len(c.outstanding) > 0 && seqLess(h.ackNr, c.recoverSeq) {
+				c.resend(c.outstanding[0])
+			} else {
+				c.recovering = false
+			}
+		}
+
+		signal(c.writable)
+	} else if h.typ == stState && h.ackNr == c.lastAck && len(c.outstanding) > 0 {
+		c.dupAcks++
+
+		// the packet after the acknowledged one was most likely lost
+		if c.dupAcks == 3 && !c.recovering {
+			c.cwnd = max(c.cwnd/2, minCwnd)
+			c.startRecovery()
+		}
+	}
+
+	c.lastAck = h.ackNr
+}
+
+// receive buffers a data packet, delivering the packets which are now in order
+func (c *Conn) receive(seqNr uint16, payload []byte) {
+	ahead := seqNr - c.ackNr
+
+	// duplicates are only acknowledged again
+	if ahead == 0 || ahead >= 0x8000 || ahead > maxReorder {
+		return
+	}
+
+	if _, ok := c.outOfOrder[seqNr]; !ok {
+		data := make([]byte, len(payload))
+		copy(data, payload)
+		c.outOfOrder[seqNr] = data
+	}
+
+	c.deliver()
+}
+
+func (c *Conn) deliver() {
+	for {
+		data, ok := c.outOfOrder[c.ackNr+1]
+
+		if !ok {
+			break
+		}
+
+		delete(c.outOfOrder, c.ackNr+1)
+		c.ackNr++
+		c.readBuf.Write(data)
+		signal(c.readable)
+	}
+
+	if c.gotFin && c.ackNr+1 == c.finSeq {
+		c.ackNr = c.finSeq
+		c.eof = true
+		signal(c.readable)
+	}
+}
+
+func (c *Conn) recvWindow() int {
+	buffered := c.readBuf.Len()
+
+	for _, data := range c.outOfOrder {
+		buffered += len(data)
+	}
+
+	return max(recvBufferSize-buffered, 0)
+}
+
+func (c *Conn) window() int {
+	return min(c.cwnd, c.peerWnd)
+}
+
+// sendPacket sends a new packet, keeping it for retransmission unless it is a bare state or reset
+func (c *Conn) sendPacket(typ byte, payload []byte) {
+	p := &outPacket{
+		h: header{
+			typ:          typ,
+			connectionId: c.sendId,
+			seqNr:        c.seqNr,
+		},
+		payload: payload,
+	}
+
+	if typ == stSyn {
+		p.h.connectionId = c.recvId
+	}
+
+	if typ == stReset {
+		c.transmit(p)
+		return
+	}
+
+	c.seqNr++
+
+	if len(c.outstanding) == 0 {
+		c.resendAt = time.Now().Add(c.rto)
+	}
+
+	c.outstanding = append(c.outstanding, p)
+	c.inFlight += len(payload)
+
+	c.transmit(p)
+}
+
+// sendState acknowledges the packets received so far
+func (c *Conn) sendState() {
+	c.transmit(&outPacket{h: header{typ: stState, connectionId: c.sendId, seqNr: c.seqNr}})
+}
+
+func (c *Conn) resend(p *outPacket) {
+	c.transmit(p)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.h.timestamp = timestampMicros()
+	p.h.timestampDif = c.replyMicro
+	p.h.wndSize = uint32(c.recvWindow())
+	p.h.ackNr = c.ackNr
+	p.sentAt = time.Now()
+	p.transmissions++
+
+	// lost packets are retransmitted
+	c.s.send(p.h.encode(p.payload), c.addr)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+
+		if delta < 0 {
+			delta = -delta
+		}
+
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+
+	c.rto = c.rtt + 4*c.rttVar
+
+	if c.rto < minRTO {
+		c.rto = minRTO
+	} else if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+}
+
+// updateCwnd grows the congestion window while the delay our traffic adds stays below the
+// target and shrinks it once it goes above, as ledbat does
+func (c *Conn) updateCwnd(acked int, delayMicros uint32) {
+	if delayMicros == 0 {
+		c.cwnd = min(c.cwnd+acked, maxCwnd)
+		return
+	}
+
+	now := time.Now()
+
+	if len(c.baseDelays) == 0 || now.Sub(c.bucketStart) > time.Minute {
+		c.baseDelays = append(c.baseDelays, delayMicros)
+		c.bucketStart = now
+
+		if len(c.baseDelays) > delayHistory {
+			c.baseDelays = c.baseDelays[1:]
+		}
+	}
+
+	last := len(c.baseDelays) - 1
+
+	if delayMicros < c.baseDelays[last] {
+		c.baseDelays[last] = delayMicros
+	}
+
+	base := c.baseDelays[0]
+
+	for _, d := range c.baseDelays {
+		if d < base {
+			base = d
+		}
+	}
+
+	ourDelay := time.Duration(delayMicros-base) * time.Microsecond
+	offTarget := float64(targetDelay-ourDelay) / float64(targetDelay)
+	windowFactor := float64(acked) / float64(max(c.cwnd, acked))
+
+	c.cwnd += int(maxCwndIncrease * offTarget * windowFactor)
+	c.cwnd = min(max(c.cwnd, minCwnd), maxCwnd)
+}
+
+// tick retransmits the oldest packet once it is overdue and gives up on a peer that stopped
+// answering
+func (c *Conn) tick(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	if c.state == stateFinSent && now.After(c.closeAt) {
+		c.teardown(net.ErrClosed)
+		return
+	}
+
+	if len(c.outstanding) == 0 || now.Before(c.resendAt) {
+		return
+	}
+
+	c.timeouts++
+
+	if c.timeouts > maxTimeouts {
+		c.teardown(errors.New("connection timed out"))
+		return
+	}
+
+	c.cwnd = minCwnd
+	c.rto *= 2
+
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	c.resendAt = now.Add(c.rto)
+
+	c.startRecovery()
+}
+
+// startRecovery retransmits the oldest outstanding packet, the packets lost after it are
+// retransmitted as the acks come in
+func (c *Conn) startRecovery() {
+	c.recovering = true
+	c.recoverSeq = c.seqNr
+	c.resend(c.outstanding[0])
+}
+
+// wait blocks until ch is signalled or the deadline passes
+func wait(ch chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+
+	timeout := time.Until(deadline)
+
+	if timeout <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
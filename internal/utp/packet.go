@@ -0,0 +1,93 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	stData  byte = 0
+	stFin   byte = 1
+	stState byte = 2
+	stReset byte = 3
+	stSyn   byte = 4
+
+	version byte = 1
+
+	headerLen = 20
+)
+
+type header struct {
+	typ          byte
+	extension    byte
+	connectionId uint16
+	timestamp    uint32
+	timestampDif uint32
+	wndSize      uint32
+	seqNr        uint16
+	ackNr        uint16
+}
+
+// isPacket tells if a datagram looks like a uTP packet, other protocols such as the dht share
+// the same socket
+func isPacket(data []byte) bool {
+	return len(data) >= headerLen && data[0]&0x0f == version && data[0]>>4 <= stSyn
+}
+
+func (h *header) encode(payload []byte) []byte {
+	packet := make([]byte, headerLen, headerLen+len(payload))
+
+	packet[0] = h.typ<<4 | version
+	packet[1] = h.extension
+	binary.BigEndian.PutUint16(packet[2:4], h.connectionId)
+	binary.BigEndian.PutUint32(packet[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(packet[8:12], h.timestampDif)
+	binary.BigEndian.PutUint32(packet[12:16], h.wndSize)
+	binary.BigEndian.PutUint16(packet[16:18], h.seqNr)
+	binary.BigEndian.PutUint16(packet[18:20], h.ackNr)
+
+	return append(packet, payload...)
+}
+
+// decodePacket parses the header of a packet and returns its payload, the extensions such as
+// selective acks are skipped
+func decodePacket(data []byte) (*header, []byte, error) {
+	if !isPacket(data) {
+		return nil, nil, fmt.Errorf("not a utp packet")
+	}
+
+	h := &header{
+		typ:          data[0] >> 4,
+		extension:    data[1],
+		connectionId: binary.BigEndian.Uint16(data[2:4]),
+		timestamp:    binary.BigEndian.Uint32(data[4:8]),
+		timestampDif: binary.BigEndian.Uint32(data[8:12]),
+		wndSize:      binary.BigEndian.Uint32(data[12:16]),
+		seqNr:        binary.BigEndian.Uint16(data[16:18]),
+		ackNr:        binary.BigEndian.Uint16(data[18:20]),
+	}
+
+	payload := data[headerLen:]
+
+	for extension := h.extension; extension != 0; {
+		if len(payload) < 2 || len(payload) < 2+int(payload[1]) {
+			return nil, nil, fmt.Errorf("invalid utp extension")
+		}
+
+		extension = payload[0]
+		payload = payload[2+int(payload[1]):]
+	}
+
+	return h, payload, nil
+}
+
+// timestampMicros returns the current time in microseconds, as carried by the packets
+func timestampMicros() uint32 {
+	return uint32(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// seqLess compares two sequence numbers, which wrap around
+func seqLess(a, b uint16) bool {
+	return a != b && b-a < 0x8000
+}
@@ -0,0 +1,341 @@
+package utp
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// how often the connections check for lost packets
+	tickInterval = 50 * time.Millisecond
+	// incoming connections waiting to be accepted, others are reset
+	acceptBacklog = 32
+	// datagrams of other protocols waiting to be read
+	otherBacklog = 256
+	// larger socket buffers, bursts of packets are lost once they fill up
+	socketBufferSize = 4 << 20
+)
+
+type connKey struct {
+	addr   string
+	recvId uint16
+}
+
+type datagram struct {
+	data []byte
+	addr net.Addr
+}
+
+// Socket carries uTP connections over a single udp socket, as described in BEP 29. It dials
+// connections and accepts incoming ones as a net.Listener. Datagrams which are not uTP packets
+// are handed to PacketConn, so that the dht can share the same port.
+type Socket struct {
+	conn   *net.UDPConn
+	accept chan *Conn
+	other  chan datagram
+	closed chan struct{}
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+}
+
+// Listen opens a socket on the given udp port, 0 picks a free port
+func Listen(port int) (*Socket, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for utp peers: %s", err.Error())
+	}
+
+	conn.SetReadBuffer(socketBufferSize)
+	conn.SetWriteBuffer(socketBufferSize)
+
+	s := &Socket{
+		conn:   conn,
+		accept: make(chan *Conn, acceptBacklog),
+		other:  make(chan datagram, otherBacklog),
+		closed: make(chan struct{}),
+		conns:  make(map[connKey]*Conn),
+	}
+
+	go s.serve()
+	go s.tick()
+
+	return s, nil
+}
+
+// Accept waits for the next incoming connection
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Close resets every connection and closes the socket
+func (s *Socket) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+
+	close(s.closed)
+
+	s.mu.Lock()
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range conns {
+		c.reset(net.ErrClosed)
+	}
+
+	return s.conn.Close()
+}
+
+// Dial opens a connection to a peer, failing if it does not answer within timeout
+func (s *Socket) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+
+	var recvId uint16
+
+	for {
+		recvId = uint16(rand.Intn(0x10000))
+
+		if _, ok := s.conns[connKey{addr.String(), recvId}]; !ok {
+			break
+		}
+	}
+
+	c := newConn(s, addr, recvId, recvId+1)
+	s.conns[connKey{addr.String(), recvId}] = c
+
+	s.mu.Unlock()
+
+	c.connect()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.connected:
+		return c, nil
+	case <-c.done:
+		return nil, fmt.Errorf("failed to connect to peer over utp: %s", c.closeErr().Error())
+	case <-timer.C:
+		c.reset(errors.New("connection timed out"))
+		return nil, fmt.Errorf("failed to connect to peer over utp: connection timed out")
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *Socket) serve() {
+	buf := make([]byte, 65536)
+
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+
+		if err != nil {
+			select {
+			case <-s.closed:
+				return
+			default:
+			}
+
+			continue
+		}
+
+		if !isPacket(buf[:n]) {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+
+			// dropped if nobody reads them, like a full socket buffer would
+			select {
+			case s.other <- datagram{data: data, addr: addr}:
+			default:
+			}
+
+			continue
+		}
+
+		h, payload, err := decodePacket(buf[:n])
+
+		if err != nil {
+			continue
+		}
+
+		s.handlePacket(h, payload, addr)
+	}
+}
+
+func (s *Socket) handlePacket(h *header, payload []byte, addr *net.UDPAddr) {
+	if h.typ == stSyn {
+		s.handleSyn(h, addr)
+		return
+	}
+
+	s.mu.Lock()
+	c := s.conns[connKey{addr.String(), h.connectionId}]
+	s.mu.Unlock()
+
+	if c == nil {
+		if h.typ != stReset {
+			s.sendReset(h, addr)
+		}
+		return
+	}
+
+	c.handle(h, payload)
+}
+
+func (s *Socket) handleSyn(h *header, addr *net.UDPAddr) {
+	key := connKey{addr.String(), h.connectionId + 1}
+
+	s.mu.Lock()
+	c, ok := s.conns[key]
+
+	if !ok {
+		c = newConn(s, addr, h.connectionId+1, h.connectionId)
+		s.conns[key] = c
+	}
+	s.mu.Unlock()
+
+	// a retransmitted syn only needs to be acknowledged again
+	if ok {
+		c.handle(h, nil)
+		return
+	}
+
+	c.accept(h)
+
+	select {
+	case s.accept <- c:
+	default:
+		c.reset(errors.New("too many pending connections"))
+	}
+}
+
+func (s *Socket) sendReset(h *header, addr *net.UDPAddr) {
+	reset := &header{
+		typ:          stReset,
+		connectionId: h.connectionId,
+		timestamp:    timestampMicros(),
+		seqNr:        uint16(rand.Intn(0x10000)),
+		ackNr:        h.seqNr,
+	}
+
+	s.conn.WriteToUDP(reset.encode(nil), addr)
+}
+
+func (s *Socket) send(packet []byte, addr *net.UDPAddr) error {
+	_, err := s.conn.WriteToUDP(packet, addr)
+
+	return err
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := connKey{c.addr.String(), c.recvId}
+
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+
+			for _, c := range conns {
+				c.tick(now)
+			}
+		}
+	}
+}
+
+// PacketConn returns a connection on which the datagrams of other protocols are read and
+// written through the socket. It is meant for a single user, closing it leaves the socket open.
+func (s *Socket) PacketConn() net.PacketConn {
+	return &packetConn{s: s, closed: make(chan struct{})}
+}
+
+type packetConn struct {
+	s         *Socket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (pc *packetConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-pc.s.other:
+		return copy(b, d.data), d.addr, nil
+	case <-pc.closed:
+		return 0, nil, net.ErrClosed
+	case <-pc.s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (pc *packetConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return pc.s.conn.WriteTo(b, addr)
+}
+
+func (pc *packetConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.closed)
+	})
+
+	return nil
+}
+
+func (pc *packetConn) LocalAddr() net.Addr {
+	return pc.s.conn.LocalAddr()
+}
+
+var errNoDeadlines = errors.New("deadlines are not supported on a shared utp socket")
+
+func (pc *packetConn) SetDeadline(t time.Time) error {
+	return errNoDeadlines
+}
+
+func (pc *packetConn) SetReadDeadline(t time.Time) error {
+	return errNoDeadlines
+}
+
+func (pc *packetConn) SetWriteDeadline(t time.Time) error {
+	return errNoDeadlines
+}
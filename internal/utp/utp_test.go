@@ -0,0 +1,219 @@
+package utp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPacketRoundTrip(t *testing.T) {
+	h := header{
+		typ:          stData,
+		connectionId: 0x1234,
+		timestamp:    1,
+		timestampDif: 2,
+		wndSize:      3,
+		seqNr:        4,
+		ackNr:        5,
+	}
+
+	decoded, payload, err := decodePacket(h.encode([]byte("payload")))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *decoded != h || string(payload) != "payload" {
+		t.Fatalf("decoded %+v %q, want %+v", *decoded, payload, h)
+	}
+}
+
+func TestDecodeSkipsExtensions(t *testing.T) {
+	h := header{typ: stState, extension: 1}
+
+	// a selective ack extension of 4 bytes, followed by no other extension
+	packet := h.encode([]byte{0, 4, 0xff, 0xff, 0xff, 0xff, 'd'})
+
+	_, payload, err := decodePacket(packet)
+
+	if err != nil || string(payload) != "d" {
+		t.Fatalf("payload %q %v, want the data after the extension", payload, err)
+	}
+
+	if _, _, err = decodePacket(packet[:headerLen+3]); err == nil {
+		t.Fatal("truncated extension decoded")
+	}
+}
+
+func TestIsPacket(t *testing.T) {
+	if isPacket([]byte("d1:ad2:id20:")) {
+		t.Fatal("dht message taken for a utp packet")
+	}
+
+	if isPacket(make([]byte, headerLen-1)) {
+		t.Fatal("short datagram taken for a utp packet")
+	}
+}
+
+func TestSeqLess(t *testing.T) {
+	if !seqLess(1, 2) || seqLess(2, 1) || seqLess(3, 3) {
+		t.Fatal("sequence numbers not ordered")
+	}
+
+	if !seqLess(0xfffe, 1) || seqLess(1, 0xfffe) {
+		t.Fatal("sequence numbers not ordered across the wrap around")
+	}
+}
+
+func TestCwndBelowTargetGrows(t *testing.T) {
+	c := newConn(nil, nil, 0, 1)
+
+	// the first sample sets the base delay
+	c.updateCwnd(maxPayload, 10000)
+
+	if c.cwnd <= minCwnd {
+		t.Fatalf("cwnd %d did not grow without queuing delay", c.cwnd)
+	}
+
+	cwnd := c.cwnd
+	c.updateCwnd(maxPayload, 10000+uint32(targetDelay/time.Microsecond)/2)
+
+	if c.cwnd <= cwnd || c.cwnd-cwnd > maxCwndIncrease {
+		t.Fatalf("cwnd went from %d to %d below the target delay", cwnd, c.cwnd)
+	}
+}
+
+func TestCwndAboveTargetShrinks(t *testing.T) {
+	c := newConn(nil, nil, 0, 1)
+	c.cwnd = 100 * maxPayload
+
+	c.updateCwnd(maxPayload, 10000)
+	cwnd := c.cwnd
+
+	c.updateCwnd(maxPayload, 10000+2*uint32(targetDelay/time.Microsecond))
+
+	if c.cwnd >= cwnd {
+		t.Fatalf("cwnd went from %d to %d above the target delay", cwnd, c.cwnd)
+	}
+
+	for i := 0; i < 1000; i++ {
+		c.updateCwnd(c.cwnd, 10000+10*uint32(targetDelay/time.Microsecond))
+	}
+
+	if c.cwnd != minCwnd {
+		t.Fatalf("cwnd is %d, want the minimum %d", c.cwnd, minCwnd)
+	}
+}
+
+func TestLoopbackTransfer(t *testing.T) {
+	server, err := Listen(0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer server.Close()
+
+	client, err := Listen(0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+
+	errs := make(chan error, 1)
+
+	// the server echoes the data back, then waits for the fin of the client
+	go func() {
+		conn, err := server.Accept()
+
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		defer conn.Close()
+
+		got := make([]byte, len(data))
+
+		if _, err = io.ReadFull(conn, got); err != nil {
+			errs <- err
+			return
+		}
+
+		if _, err = conn.Write(got); err != nil {
+			errs <- err
+			return
+		}
+
+		_, err = conn.Read(got)
+		errs <- err
+	}()
+
+	conn, err := client.Dial(fmt.Sprintf("127.0.0.1:%d", server.Addr().(*net.UDPAddr).Port), time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go conn.Write(data)
+
+	echoed := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	if _, err = io.ReadFull(conn, echoed); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(echoed, data) {
+		t.Fatal("data corrupted over the connection")
+	}
+
+	conn.Close()
+
+	select {
+	case err := <-errs:
+		if err != io.EOF {
+			t.Fatalf("server read %v after the close, want EOF", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("close not seen by the server")
+	}
+}
+
+func TestDialTimeout(t *testing.T) {
+	client, err := Listen(0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	// a socket which never answers
+	silent, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer silent.Close()
+
+	start := time.Now()
+
+	if _, err = client.Dial(silent.LocalAddr().String(), 100*time.Millisecond); err == nil {
+		t.Fatal("dial to a silent peer succeeded")
+	}
+
+	if time.Since(start) > time.Second {
+		t.Fatal("dial did not give up after its timeout")
+	}
+}
@@ -15,6 +15,11 @@ func New(total int) *ProgressBar {
 	return &ProgressBar{total: total}
 }
 
+// SetTotal changes the number of steps to complete
+func (pb *ProgressBar) SetTotal(total int) {
+	pb.total = total
+}
+
 func (pb *ProgressBar) Start() {
 	bar := pb.getBarString(0)
 	fmt.Printf("%s", bar)
@@ -30,7 +35,11 @@ func (pb *ProgressBar) Finish() {
 }
 
 func (pb *ProgressBar) getBarString(completed int) string {
-	percent := float64(completed) / float64(pb.total) * 100
+	percent := 100.0
+
+	if pb.total > 0 {
+		percent = float64(completed) / float64(pb.total) * 100
+	}
 	completeWidth := int(percent) * barWidth / 100
 
 	var sb strings.Builder
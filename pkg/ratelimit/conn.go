@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"net"
+	"sync"
+)
+
+// chunkSize is the most a connection reads or writes before waiting on its limiters, so that
+// large transfers are spread over time rather than let through in one burst
+const chunkSize = 16 * 1024
+
+// Conn limits the bytes read from and written to a connection, every read and write waits on each
+// of its limiters, such as one shared by all the connections and one for a single torrent
+type Conn struct {
+	net.Conn
+	read  []*Limiter
+	write []*Limiter
+
+	// writes are split in chunks, which must not interleave with the chunks of other writes
+	writeMu sync.Mutex
+}
+
+// NewConn limits the reads of conn with the read limiters and its writes with the write limiters,
+// nil limiters are ignored
+func NewConn(conn net.Conn, read, write []*Limiter) *Conn {
+	return &Conn{Conn: conn, read: read, write: write}
+}
+
+// Unwrap returns the connection being limited
+func (c *Conn) Unwrap() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+
+	n, err := c.Conn.Read(p)
+
+	// the bytes are already read, they are paid for before being handed over
+	for _, l := range c.read {
+		l.WaitN(n)
+	}
+
+	return n, err
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+
+	for written < len(p) {
+		chunk := p[written:]
+
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+
+		for _, l := range c.write {
+			l.WaitN(len(chunk))
+		}
+
+		n, err := c.Conn.Write(chunk)
+		written += n
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// maxWait is the longest a caller sleeps before looking at the rate again, so that a new rate
+// applies quickly to the connections waiting on the limiter
+const maxWait = 100 * time.Millisecond
+
+// Limiter is a token bucket limiting a transfer to a number of bytes per second, with bursts of
+// up to one second of transfer. It can be shared by several connections and its rate changed
+// while they use it. A nil Limiter does not limit anything.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	tokens float64
+	last   time.Time
+}
+
+// New returns a limiter allowing rate bytes per second, 0 does not limit anything
+func New(rate int) *Limiter {
+	return &Limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+// SetRate changes the number of bytes allowed per second, 0 removes the limit
+func (l *Limiter) SetRate(rate int) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill()
+
+	l.rate = rate
+
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+}
+
+// Rate returns the number of bytes allowed per second, 0 when there is no limit
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.rate
+}
+
+// refill adds the tokens earned since the last call, must be called with the lock held
+func (l *Limiter) refill() {
+	now := time.Now()
+
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	l.last = now
+
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+}
+
+// WaitN blocks until n bytes can be transferred
+func (l *Limiter) WaitN(n int) {
+	if l == nil {
+		return
+	}
+
+	for n > 0 {
+		wait, taken := l.take(n)
+
+		n -= taken
+
+		if wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// take takes as many of n tokens as the bucket allows at once, it returns how long to wait for
+// the next ones when the bucket does not hold enough of them
+func (l *Limiter) take(n int) (time.Duration, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return 0, n
+	}
+
+	l.refill()
+
+	// transfers larger than the bucket go through in several steps
+	chunk := n
+
+	if chunk > l.rate {
+		chunk = l.rate
+	}
+
+	if l.tokens >= float64(chunk) {
+		l.tokens -= float64(chunk)
+		return 0, chunk
+	}
+
+	wait := time.Duration((float64(chunk) - l.tokens) / float64(l.rate) * float64(time.Second))
+
+	if wait > maxWait {
+		wait = maxWait
+	}
+
+	return wait, 0
+}
@@ -0,0 +1,96 @@
+package ratelimit
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+
+	l.WaitN(1 << 20)
+	l.SetRate(1024)
+
+	if rate := l.Rate(); rate != 0 {
+		t.Fatalf("nil limiter rate = %d", rate)
+	}
+}
+
+func TestWaitN(t *testing.T) {
+	const rate = 1 << 20
+
+	l := New(rate)
+	start := time.Now()
+
+	// the bucket starts full, the half second of bytes above it is waited for
+	l.WaitN(rate + rate/2)
+
+	elapsed := time.Since(start)
+
+	if elapsed < 400*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Fatalf("1.5s of bytes at the rate took %s, want about 500ms", elapsed)
+	}
+}
+
+func TestUnlimited(t *testing.T) {
+	l := New(0)
+	start := time.Now()
+
+	l.WaitN(1 << 30)
+
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("unlimited limiter waited %s", elapsed)
+	}
+}
+
+func TestSetRateWhileWaiting(t *testing.T) {
+	l := New(1024)
+	l.WaitN(1024)
+
+	done := make(chan struct{})
+
+	go func() {
+		// would take a thousand seconds at the first rate
+		l.WaitN(1 << 20)
+		close(done)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	l.SetRate(0)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("removing the limit did not release the waiting transfer")
+	}
+}
+
+func TestConnWrite(t *testing.T) {
+	const rate = 256 * 1024
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go io.Copy(io.Discard, server)
+
+	conn := NewConn(client, nil, []*Limiter{nil, New(rate)})
+
+	if conn.Unwrap() != client {
+		t.Fatal("Unwrap does not return the limited connection")
+	}
+
+	start := time.Now()
+
+	n, err := conn.Write(make([]byte, rate+rate/2))
+
+	if err != nil || n != rate+rate/2 {
+		t.Fatalf("wrote %d bytes: %v", n, err)
+	}
+
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("write went through in %s, faster than the rate", elapsed)
+	}
+}